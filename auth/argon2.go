@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2idHasher hashes passwords with the memory-hard Argon2id key
+// derivation function. Its parameters are encoded alongside the salt so
+// they can be changed without invalidating existing passwords.
+type Argon2idHasher struct {
+	BaseHasher
+	time    uint32
+	memory  uint32 // In KiB
+	threads uint8
+	keyLen  uint32
+}
+
+// Limits of the parameters of stored hashes, so that a corrupt hash cannot
+// exhaust the memory or CPU of a login
+const (
+	maxArgon2Time    = 64
+	maxArgon2Memory  = 1024 * 1024 // 1 GiB in KiB
+	maxArgon2Threads = 255
+	maxHashLength    = 1024
+)
+
+func (h *Argon2idHasher) params() string {
+	return fmt.Sprintf("t=%d,m=%d,p=%d", h.time, h.memory, h.threads)
+}
+
+func (h *Argon2idHasher) Encode(cleartext, salt string) string {
+	hashed := EncodeBase64String(
+		argon2.IDKey(
+			[]byte(cleartext),
+			[]byte(salt),
+			h.time,
+			h.memory,
+			h.threads,
+			h.keyLen,
+		),
+	)
+	return strings.Join(
+		[]string{h.Algorithm(), h.params(), salt, hashed},
+		"$",
+	)
+}
+
+func (h *Argon2idHasher) Verify(cleartext, encoded string) bool {
+	// Split the saved hash apart
+	parts := strings.SplitN(encoded, "$", 4)
+	if len(parts) != 4 || parts[0] != h.Algorithm() {
+		return false
+	}
+	params, err := parseParams(parts[1], "t", "m", "p")
+	if err != nil {
+		return false
+	}
+	if params[0] < 1 || params[0] > maxArgon2Time {
+		return false
+	}
+	if params[1] < 1 || params[1] > maxArgon2Memory {
+		return false
+	}
+	if params[2] < 1 || params[2] > maxArgon2Threads {
+		return false
+	}
+	expected, err := DecodeBase64String(parts[3])
+	if err != nil || len(expected) == 0 || len(expected) > maxHashLength {
+		return false
+	}
+
+	// Generate a new hash using the given cleartext and saved parameters
+	hashed := argon2.IDKey(
+		[]byte(cleartext),
+		[]byte(parts[2]),
+		uint32(params[0]),
+		uint32(params[1]),
+		uint8(params[2]),
+		uint32(len(expected)),
+	)
+	return ConstantTimeStringCompare(
+		EncodeBase64String(hashed), parts[3],
+	)
+}
+
+// NewArgon2idHasher creates an Argon2id hasher with the given number of
+// passes, memory in KiB, and degree of parallelism.
+func NewArgon2idHasher(alg string, time, memory uint32, threads uint8) *Argon2idHasher {
+	return &Argon2idHasher{NewBaseHasher(alg), time, memory, threads, 32}
+}
+
+func init() {
+	// The second recommended option of RFC 9106
+	argon2id := NewArgon2idHasher("argon2id", 3, 64*1024, 4)
+	RegisterHasher(argon2id.algorithm, argon2id)
+}
@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aodin/sol"
+	"github.com/aodin/sol/postgres"
+	"github.com/aodin/sol/types"
+)
+
+// AuditAction is the kind of a security event
+type AuditAction string
+
+// The actions recorded by the audit log
+const (
+	LoginSucceeded         AuditAction = "login.success"
+	LoginFailed            AuditAction = "login.failure"
+	SecondFactorRequested  AuditAction = "login.second_factor"
+	LoggedOut              AuditAction = "logout"
+	SessionCreated         AuditAction = "session.create"
+	SessionDeleted         AuditAction = "session.delete"
+	TokenCreated           AuditAction = "token.create"
+	TokenUsed              AuditAction = "token.use"
+	TokenRejected          AuditAction = "token.reject"
+	TokenDeleted           AuditAction = "token.delete"
+	PasswordResetRequested AuditAction = "password.reset"
+	SuperuserCreated       AuditAction = "superuser.create"
+)
+
+// AuditEvent is a security event. Target is the ID of the session or
+// token acted on, and Reason explains failures. Events are chained: each
+// event's Hash covers its fields and the Hash of the previous event, so
+// modified, removed or reordered events are detected by VerifyAuditChain.
+type AuditEvent struct {
+	ID       int64       `db:"id,omitempty" json:"id,omitempty"`
+	Action   AuditAction `db:"action" json:"action"`
+	UserID   int64       `db:"user_id" json:"user_id,omitempty"`
+	Email    string      `db:"email" json:"email,omitempty"`
+	IP       string      `db:"ip" json:"ip,omitempty"`
+	Target   string      `db:"target" json:"target,omitempty"`
+	Reason   string      `db:"reason" json:"reason,omitempty"`
+	At       time.Time   `db:"at" json:"at"`
+	PrevHash string      `db:"prev_hash" json:"prev_hash"`
+	Hash     string      `db:"hash" json:"hash"`
+}
+
+// digest returns the keyed hash of the event's fields and previous hash
+func (event AuditEvent) digest(key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	io.WriteString(mac, strings.Join([]string{
+		event.PrevHash,
+		string(event.Action),
+		strconv.FormatInt(event.UserID, 10),
+		event.Email,
+		event.IP,
+		event.Target,
+		event.Reason,
+		event.At.UTC().Format(time.RFC3339Nano),
+	}, "\n"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chain links the event to the previous hash. Timestamps are truncated to
+// the precision kept by databases so that stored events still verify.
+func chain(key, prev string, event AuditEvent) AuditEvent {
+	event.At = event.At.UTC().Truncate(time.Microsecond)
+	event.PrevHash = prev
+	event.Hash = event.digest(key)
+	return event
+}
+
+// VerifyAuditChain returns an error if the given events, oldest first, were
+// not chained in order by the given key, starting from the given previous
+// hash. Use an empty previous hash for a complete log.
+func VerifyAuditChain(key, prev string, events []AuditEvent) error {
+	for i, event := range events {
+		if event.PrevHash != prev {
+			return fmt.Errorf(
+				"auth: audit event %d (%d) does not follow the previous event",
+				i, event.ID,
+			)
+		}
+		if !hmac.Equal([]byte(event.Hash), []byte(event.digest(key))) {
+			return fmt.Errorf("auth: audit event %d (%d) was modified", i, event.ID)
+		}
+		prev = event.Hash
+	}
+	return nil
+}
+
+// AuditSink records audit events. Sinks chain the events they record.
+type AuditSink interface {
+	Record(AuditEvent) error
+}
+
+// The longest email and reason that will be saved
+const (
+	maxAuditEmail  = 320
+	maxAuditReason = 256
+)
+
+// auditor records audit events to an optional sink. Failures are logged
+// rather than returned, so an unavailable sink does not lock users out.
+type auditor struct {
+	sink AuditSink
+}
+
+// SetAuditSink sets the sink of audit events. A nil sink disables auditing.
+func (a *auditor) SetAuditSink(sink AuditSink) {
+	a.sink = sink
+}
+
+func (a *auditor) record(event AuditEvent) {
+	if a.sink == nil {
+		return
+	}
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	event.Email = truncate(event.Email, maxAuditEmail)
+	event.Reason = truncate(event.Reason, maxAuditReason)
+	if err := a.sink.Record(event); err != nil {
+		log.Printf("auth: could not record audit event %s: %s", event.Action, err)
+	}
+}
+
+// truncate shortens the given value to at most n bytes without splitting
+// a UTF-8 encoded rune
+func truncate(value string, n int) string {
+	if len(value) <= n {
+		return value
+	}
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	return value[:n]
+}
+
+// AuditEvents is the postgres schema for audit events. The previous hash
+// is unique so that concurrent writers cannot fork the chain.
+var AuditEvents = postgres.Table("audit_events",
+	sol.Column("id", postgres.Serial()),
+	sol.Column("action", types.Varchar().Limit(32).NotNull()),
+	sol.Column("user_id", types.Integer().NotNull()),
+	sol.Column("email", types.Varchar().Limit(maxAuditEmail).NotNull()),
+	sol.Column("ip", types.Varchar().Limit(64).NotNull()),
+	sol.Column("target", types.Varchar().Limit(64).NotNull()),
+	sol.Column("reason", types.Varchar().Limit(maxAuditReason).NotNull()),
+	sol.Column("at", postgres.Timestamp().WithTimezone().NotNull()),
+	sol.Column("prev_hash", types.Varchar().Limit(64).NotNull()),
+	sol.Column("hash", types.Varchar().Limit(64).NotNull()),
+	sol.PrimaryKey("id"),
+	sol.Unique("prev_hash"),
+)
+
+// maxAuditRetries is how many times a chain conflict with another writer
+// is retried
+const maxAuditRetries = 3
+
+// PostgresAuditSink records audit events in the audit_events table. Events
+// from every process are kept in a single chain.
+type PostgresAuditSink struct {
+	sync.Mutex
+	conn sol.Conn
+	key  string
+}
+
+// last returns the most recent event
+func (sink *PostgresAuditSink) last() (event AuditEvent, err error) {
+	stmt := AuditEvents.Select().OrderBy(AuditEvents.C("id").Desc()).Limit(1)
+	err = sink.conn.Query(stmt, &event)
+	return
+}
+
+// Record chains the event to the most recent event and saves it
+func (sink *PostgresAuditSink) Record(event AuditEvent) (err error) {
+	sink.Lock()
+	defer sink.Unlock()
+	for attempt := 0; attempt < maxAuditRetries; attempt++ {
+		var last AuditEvent
+		if last, err = sink.last(); err != nil {
+			return
+		}
+		chained := chain(sink.key, last.Hash, event)
+		if err = sink.conn.Query(AuditEvents.Insert().Values(chained)); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// All returns all audit events, oldest first
+func (sink *PostgresAuditSink) All() (events []AuditEvent, err error) {
+	stmt := AuditEvents.Select().OrderBy(AuditEvents.C("id"))
+	err = sink.conn.Query(stmt, &events)
+	return
+}
+
+// Verify returns an error if any audit event was modified or removed. Only
+// the most recent events can be removed undetected.
+func (sink *PostgresAuditSink) Verify() error {
+	events, err := sink.All()
+	if err != nil {
+		return err
+	}
+	return VerifyAuditChain(sink.key, "", events)
+}
+
+// NewPostgresAuditSink creates an audit sink that chains events with the
+// given secret key
+func NewPostgresAuditSink(conn sol.Conn, key string) *PostgresAuditSink {
+	return &PostgresAuditSink{conn: conn, key: key}
+}
+
+// WriterAuditSink writes audit events as lines of JSON, such as to a log
+// file or a log shipper
+type WriterAuditSink struct {
+	sync.Mutex
+	w    io.Writer
+	key  string
+	last string
+}
+
+// Record chains the event to the last written event and writes it
+func (sink *WriterAuditSink) Record(event AuditEvent) error {
+	sink.Lock()
+	defer sink.Unlock()
+	chained := chain(sink.key, sink.last, event)
+	line, err := json.Marshal(chained)
+	if err != nil {
+		return err
+	}
+	if _, err = sink.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	sink.last = chained.Hash
+	return nil
+}
+
+// NewWriterAuditSink creates an audit sink that chains events with the
+// given secret key. To continue an existing log, last is the hash of its
+// final event, otherwise it is empty.
+func NewWriterAuditSink(w io.Writer, key, last string) *WriterAuditSink {
+	return &WriterAuditSink{w: w, key: key, last: last}
+}
+
+// ReadAuditEvents reads the lines of JSON written by a WriterAuditSink
+func ReadAuditEvents(r io.Reader) (events []AuditEvent, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return
+		}
+		events = append(events, event)
+	}
+	err = scanner.Err()
+	return
+}
+
+// The sinks should implement the AuditSink interface
+var (
+	_ AuditSink = &PostgresAuditSink{}
+	_ AuditSink = &WriterAuditSink{}
+)
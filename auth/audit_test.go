@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aodin/config"
+	"github.com/aodin/sol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// actions returns the actions of the given events
+func actions(events []AuditEvent) (actions []AuditAction) {
+	for _, event := range events {
+		actions = append(actions, event.Action)
+	}
+	return
+}
+
+func TestAudit(t *testing.T) {
+	assert := assert.New(t)
+
+	auth := NewInMemory(config.Default)
+	var log bytes.Buffer
+	auth.SetAuditSink(NewWriterAuditSink(&log, "secret", ""))
+
+	users, err := auth.Seed(
+		SeedUser{Email: "admin@example.com", Password: "secret", Superuser: true},
+	)
+	require.Nil(t, err)
+	user := users[0]
+
+	_, err = auth.ByPasswordFrom("admin@example.com", "1234", "10.0.0.1")
+	assert.NotNil(err)
+	_, err = auth.ByPassword("admin@example.com", "secret")
+	require.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	require.Nil(t, auth.CreateSession(w, user))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	require.Nil(t, auth.Logout(httptest.NewRecorder(), r))
+
+	token, err := auth.TokenStore().Create(user, "ci", nil)
+	require.Nil(t, err)
+	valid, _ := auth.ByToken(user.ID, token.Key)
+	assert.True(valid.Exists())
+	valid, _ = auth.ByToken(user.ID, token.Key)
+	assert.True(valid.Exists(), "Every use should be audited")
+	invalid, _ := auth.ByTokenFrom(user.ID, "invalid", "10.0.0.2")
+	assert.False(invalid.Exists())
+	require.Nil(t, token.Delete())
+
+	require.Nil(t, auth.ResetUserToken(&user))
+
+	// Sessions ended by password changes, sweeps and deactivation
+	require.Nil(t, auth.ChangePassword(&user, "new"))
+	auth.Sessions().Create(user)
+	auth.now = func() time.Time { return time.Now().Add(365 * 24 * time.Hour) }
+	_, err = auth.Sweeper().Sweep(context.Background())
+	require.Nil(t, err)
+	require.Nil(t, auth.Deactivate(&user))
+
+	events, err := ReadAuditEvents(&log)
+	require.Nil(t, err)
+	assert.Equal([]AuditAction{
+		SuperuserCreated,
+		LoginFailed,
+		LoginSucceeded,
+		SessionCreated,
+		LoggedOut,
+		TokenCreated,
+		TokenUsed,
+		TokenUsed,
+		TokenRejected,
+		TokenDeleted,
+		PasswordResetRequested,
+		SessionDeleted,
+		SessionDeleted,
+		SessionDeleted,
+	}, actions(events))
+	assert.Equal("10.0.0.1", events[1].IP)
+	assert.NotEqual("", events[1].Reason, "Failures should have a reason")
+	assert.Equal(user.ID, events[2].UserID)
+	assert.Equal(token.ID, events[5].Target)
+	assert.Equal("10.0.0.2", events[8].IP)
+	assert.Equal("unknown token", events[8].Reason)
+	assert.Equal("password changed", events[11].Reason)
+	assert.Equal("swept 1 expired sessions", events[12].Reason)
+	assert.Equal("deactivated", events[13].Reason)
+
+	// The chain detects modified, removed and reordered events
+	assert.Nil(VerifyAuditChain("secret", "", events))
+	assert.NotNil(VerifyAuditChain("other", "", events))
+
+	modified := append([]AuditEvent{}, events...)
+	modified[1].Reason = ""
+	assert.NotNil(VerifyAuditChain("secret", "", modified))
+
+	removed := append(append([]AuditEvent{}, events[:3]...), events[4:]...)
+	assert.NotNil(VerifyAuditChain("secret", "", removed))
+
+	reordered := append([]AuditEvent{}, events...)
+	reordered[2], reordered[3] = reordered[3], reordered[2]
+	assert.NotNil(VerifyAuditChain("secret", "", reordered))
+
+	// Writers continue existing logs
+	last := events[len(events)-1].Hash
+	sink := NewWriterAuditSink(&log, "secret", last)
+	require.Nil(t, sink.Record(AuditEvent{Action: LoggedOut, At: time.Now()}))
+	more, err := ReadAuditEvents(&log)
+	require.Nil(t, err)
+	assert.Nil(VerifyAuditChain("secret", last, more))
+}
+
+func TestAuditTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	var log bytes.Buffer
+	a := auditor{sink: NewWriterAuditSink(&log, "secret", "")}
+	a.record(AuditEvent{
+		Action: LoginFailed,
+		Email:  strings.Repeat("a", maxAuditEmail-1) + "é",
+		Reason: strings.Repeat("€", maxAuditReason),
+	})
+	events, err := ReadAuditEvents(&log)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(events))
+	assert.Equal(strings.Repeat("a", maxAuditEmail-1), events[0].Email)
+	assert.True(utf8.ValidString(events[0].Reason), "Runes should not be split")
+	assert.True(len(events[0].Reason) <= maxAuditReason)
+	assert.Equal("aé", truncate("aé", 3))
+}
+
+func TestPostgresAuditSink(t *testing.T) {
+	assert := assert.New(t)
+
+	// Get a blank DB and create the schemas
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens, AuditEvents)
+
+	auth := Mock(config.Default, tx)
+	sink := NewPostgresAuditSink(tx, "secret")
+	auth.SetAuditSink(sink)
+
+	user, err := auth.CreateSuperuser("admin@example.com", "admin", "guy", "secret")
+	require.Nil(t, err)
+	_, err = auth.ByPassword("admin@example.com", "1234")
+	assert.NotNil(err)
+	_, err = auth.Tokens().ForeverToken(user)
+	require.Nil(t, err)
+
+	events, err := sink.All()
+	require.Nil(t, err)
+	assert.Equal(
+		[]AuditAction{SuperuserCreated, LoginFailed, TokenCreated},
+		actions(events),
+	)
+	assert.Nil(sink.Verify(), "Stored events should verify")
+
+	// Modified events are detected
+	stmt := AuditEvents.Update().Values(
+		sol.Values{"reason": ""},
+	).Where(AuditEvents.C("id").Equals(events[1].ID))
+	require.Nil(t, tx.Query(stmt))
+	assert.NotNil(sink.Verify(), "Modified events should not verify")
+}
@@ -3,6 +3,7 @@ package auth
 import (
 	"crypto/subtle"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
@@ -13,10 +14,24 @@ import (
 type Auth struct {
 	conn     sol.Conn
 	config   config.Config
-	users    *UserManager
-	sessions *SessionManager
-	tokens   *TokenManager
+	users    UserStore
+	sessions SessionStore
+	tokens   TokenStore
+	throttle *Throttle
+	totp     *TOTPManager
+	webauthn *WebAuthnManager
+	policy   SessionPolicy
 	homeURL  string
+	audit    auditor
+
+	// Require superusers to log in with a second factor
+	superuser2FA bool
+
+	// Refuse users that have not verified their email address
+	verifiedOnly bool
+
+	// Delete API tokens along with sessions in LogoutEverywhere
+	revokeTokens bool
 
 	// For testing
 	now func() time.Time
@@ -24,71 +39,246 @@ type Auth struct {
 
 // ByPassword attempts to authenticate the given email using the given
 // cleartext password. On failure, a specific error will be returned.
-func (auth *Auth) ByPassword(email, password string) (user User, err error) {
+// If the user's password was hashed with a different hasher or work factor
+// than the user manager's hasher, it will be re-hashed and saved.
+func (auth *Auth) ByPassword(email, password string) (User, error) {
+	return auth.ByPasswordFrom(email, password, "")
+}
+
+// ByPasswordFrom is ByPassword for a login from the given client IP. If the
+// auth has a throttle, failed attempts are counted against both the email
+// and IP, and a LockoutError will be returned while either is throttled.
+// Users with two-factor authentication will return a SecondFactorRequired
+// error instead of a user, and if verified emails are required, unverified
+// users will return an EmailNotVerified error.
+func (auth *Auth) ByPasswordFrom(email, password, ip string) (user User, err error) {
+	user, err = auth.byPasswordFrom(email, password, ip)
+	auth.recordLogin(user.ID, email, ip, err)
+	if err != nil {
+		user = User{} // Do not leak user information
+	}
+	return
+}
+
+// recordLogin audits a login attempt. Logins that are waiting for a second
+// factor have not failed and are audited separately.
+func (auth *Auth) recordLogin(id int64, email, ip string, err error) {
+	event := AuditEvent{
+		Action: LoginSucceeded,
+		UserID: id,
+		Email:  email,
+		IP:     ip,
+		At:     auth.now(),
+	}
+	switch err.(type) {
+	case nil:
+	case SecondFactorRequired:
+		event.Action = SecondFactorRequested
+	default:
+		event.Action, event.Reason = LoginFailed, err.Error()
+	}
+	auth.audit.record(event)
+}
+
+func (auth *Auth) byPasswordFrom(email, password, ip string) (user User, err error) {
+	if auth.throttle != nil {
+		if err = auth.throttle.Allow(auth.now(), email, ip); err != nil {
+			return
+		}
+	}
+	if user, err = auth.byPassword(email, password); err != nil {
+		if auth.throttle == nil {
+			return
+		}
+		if failErr := auth.throttle.Fail(auth.now(), email, ip); failErr != nil {
+			log.Printf("auth: could not record failed login: %s", failErr)
+		}
+		return
+	}
+	if auth.throttle != nil {
+		if clearErr := auth.throttle.UnlockEmail(email); clearErr != nil {
+			log.Printf("auth: could not clear failed logins: %s", clearErr)
+		}
+	}
+	if auth.verifiedOnly && !user.IsVerified() {
+		return User{}, EmailNotVerified{Email: user.Email}
+	}
+	// The user is kept for the audit if a second factor is required
+	_, err = auth.secondFactor(user)
+	return
+}
+
+func (auth *Auth) byPassword(email, password string) (user User, err error) {
 	// Get the user by email - emails MUST be unique
 	if user, err = auth.users.GetByEmail(email); err != nil {
 		user = User{} // Do not leak user information
 		return
 	}
 
-	// Check the cleartext versus encrypted password
-	if !CheckPassword(auth.users.Hasher(), password, user.Password) {
+	// Check the cleartext versus encrypted password of active users. The
+	// same error is returned for inactive users to not leak their status.
+	if !user.IsActive || !CheckPassword(auth.users.Hasher(), password, user.Password) {
 		user = User{} // Do not leak user information
-		err = fmt.Errorf("auth: incorrect password for user %s", user.Email)
+		err = fmt.Errorf("auth: incorrect password for user %s", email)
+		return
+	}
+
+	// Upgrade the stored password - a failure here should not prevent login
+	if NeedsRehash(auth.users.Hasher(), user.Password) {
+		if rehashErr := auth.users.RehashPassword(&user, password); rehashErr != nil {
+			log.Printf(
+				"auth: could not rehash password for user %d: %s",
+				user.ID, rehashErr,
+			)
+		}
 	}
 	return
 }
 
-// BySession returns an authenticated user if the given session is valid
-func (auth *Auth) BySession(key string) (user User) {
-	session := auth.sessions.Get(key)
-	if !session.Exists() {
-		return
+// ByPasskey returns an authenticated user if the given WebAuthn login
+// response is valid. WebAuthn must first be enabled with EnableWebAuthn.
+// Like ByPassword, unverified users will return an EmailNotVerified error
+// if verified emails are required.
+func (auth *Auth) ByPasskey(response PublicKeyCredential) (user User, err error) {
+	user, err = auth.byPasskey(response)
+	auth.recordLogin(user.ID, user.Email, "", err)
+	if err != nil {
+		user = User{} // Do not leak user information
+	}
+	return
+}
+
+func (auth *Auth) byPasskey(response PublicKeyCredential) (user User, err error) {
+	if auth.webauthn == nil {
+		return User{}, fmt.Errorf("auth: webauthn is not enabled")
 	}
-	if !session.Expires.After(auth.now()) {
+	if user, err = auth.webauthn.FinishLogin(response); err != nil {
 		return
 	}
-	user, _ = auth.users.GetByID(session.UserID)
+	if auth.verifiedOnly && !user.IsVerified() {
+		return user, EmailNotVerified{Email: user.Email}
+	}
 	return
 }
 
-// ByToken returns an authenticated user if the given token is valid for the
-// given user id. Tokens are used for API access.
-func (auth *Auth) ByToken(id int64, key string) (user User) {
-	// Do not query the database directly for the token key because that could
-	// leak information through a timing attack - B-trees, yo
-	for _, token := range auth.tokens.All(id) {
-		if len(key) != len(token.Key) {
-			continue
+// BySession returns an authenticated user if the given session is valid
+func (auth *Auth) BySession(key string) User {
+	user, _ := auth.bySession(key)
+	return user
+}
+
+func (auth *Auth) bySession(key string) (user User, session Session) {
+	session = auth.sessions.Get(key)
+	if !session.Exists() {
+		return
+	}
+	now := auth.now()
+	if auth.policy.Expired(session, now) {
+		// Sessions past their idle timeout or lifetime can never be renewed
+		if session.Expires.After(now) {
+			auth.sessions.Delete(session.Key)
+			auth.audit.record(AuditEvent{
+				Action: SessionDeleted,
+				UserID: session.UserID,
+				Target: session.ID,
+				Reason: "expired",
+				At:     now,
+			})
 		}
-		if subtle.ConstantTimeCompare([]byte(key), []byte(token.Key)) != 1 {
-			continue
+		return User{}, Session{}
+	}
+	user, _ = auth.users.GetByID(session.UserID)
+	if !user.Exists() || !user.IsActive {
+		return User{}, Session{}
+	}
+	if stateless, ok := auth.sessions.(*CookieSessionStore); ok {
+		if !stateless.Valid(session, user) {
+			return User{}, Session{}
 		}
-		// Expires is optional, check if it exists before checking if expired
-		if token.Expires != nil && token.Expires.After(auth.now()) {
-			continue
+	}
+	if auth.verifiedOnly && !user.IsVerified() {
+		return User{}, Session{}
+	}
+
+	// Only record the last use of a valid session periodically
+	if now.Sub(session.LastSeenAt) > auth.policy.TouchInterval {
+		if auth.sessions.Touch(session.Key, session.Expires) == nil {
+			session.LastSeenAt = now
 		}
-		user, _ = auth.users.GetByID(token.UserID)
-		break
 	}
 	return
 }
 
+// ByToken returns an authenticated user and the scopes of the token if
+// the given token is valid for the given user id. Tokens are used for API
+// access, and handlers should check that the scopes they require were
+// granted.
+func (auth *Auth) ByToken(id int64, key string) (User, Scopes) {
+	return auth.ByTokenFrom(id, key, "")
+}
+
+// ByTokenFrom is ByToken for a request from the given IP. Every use and
+// rejection of a token is audited, while the token's last use is only
+// saved periodically.
+func (auth *Auth) ByTokenFrom(id int64, key, ip string) (user User, scopes Scopes) {
+	token, reason := auth.byToken(id, key)
+	event := AuditEvent{
+		Action: TokenUsed,
+		UserID: id,
+		IP:     ip,
+		Target: token.ID,
+		At:     auth.now(),
+	}
+	if reason != "" {
+		event.Action, event.Reason = TokenRejected, reason
+		auth.audit.record(event)
+		return
+	}
+	if user, _ = auth.users.GetByID(token.UserID); !user.Exists() || !user.IsActive {
+		event.Action, event.Reason = TokenRejected, "inactive user"
+		auth.audit.record(event)
+		return User{}, nil
+	}
+	auth.audit.record(event)
+
+	// Only record the last use of a token periodically
+	if token.LastUsedAt == nil || auth.now().Sub(*token.LastUsedAt) > auth.policy.TouchInterval {
+		if err := auth.tokens.Used(&token); err != nil {
+			log.Printf("auth: could not record use of token: %s", err)
+		}
+	}
+	return user, token.Scopes
+}
+
+// byToken returns the valid token with the given key and user id, or
+// the reason it was rejected
+func (auth *Auth) byToken(id int64, key string) (token Token, reason string) {
+	token = auth.tokens.Get(key)
+	if !token.Exists() || token.UserID != id {
+		return Token{}, "unknown token"
+	}
+	// Expires is optional, check if it exists before checking if expired
+	if token.Expired(auth.now()) {
+		return token, "expired"
+	}
+	return token, ""
+}
+
 // ByUserToken returns an authenticated user if the given user's token
 // matches the given token. Companies are not added as this method
 // is used only for password resets and initial account creation.
 // The user token also is attached to the user's model, not the separate
-// tokens table, which is used for API access.
+// tokens table, which is used for API access. Like session and API keys,
+// only the digest of the token is stored.
 func (auth *Auth) ByUserToken(id int64, key string) (user User, err error) {
-	// TODO get the user through the user manager?
-	stmt := Users.Select().Where(Users.C("id").Equals(id))
-	auth.conn.Query(stmt, &user)
-	if !user.Exists() {
+	if user, _ = auth.users.GetByID(id); !user.Exists() {
 		err = fmt.Errorf("Invalid token")
 		return
 	}
 
-	if (len(key) != len(user.Token)) || subtle.ConstantTimeCompare([]byte(key), []byte(user.Token)) != 1 {
+	// Cleared tokens are empty and should never match
+	digest := HashKey(key)
+	if user.Token == "" || subtle.ConstantTimeCompare([]byte(digest), []byte(user.Token)) != 1 {
 		user = User{} // Don't leak user info
 		err = fmt.Errorf("Invalid token")
 	}
@@ -105,19 +295,49 @@ func (auth *Auth) CreateUser(email, first, last, clear string) (User, error) {
 	return auth.users.Create(email, first, last, clear)
 }
 
+// CreateSuperuser creates a new superuser.
+func (auth *Auth) CreateSuperuser(email, first, last, clear string) (User, error) {
+	user, err := auth.users.CreateSuperuser(email, first, last, clear)
+	if err == nil {
+		auth.audit.record(AuditEvent{
+			Action: SuperuserCreated,
+			UserID: user.ID,
+			Email:  user.Email,
+			At:     auth.now(),
+		})
+	}
+	return user, err
+}
+
 // CreateSession creates a new session for the given user and redirects to
 // the given next URL.
 func (auth *Auth) CreateSession(w http.ResponseWriter, user User) error {
-	session := auth.sessions.Create(user)
+	return auth.setSession(w, auth.sessions.Create(user))
+}
+
+// CreateSessionFrom creates a new session for the given user and records
+// the client IP and user agent of the given request.
+func (auth *Auth) CreateSessionFrom(w http.ResponseWriter, r *http.Request, user User) error {
+	return auth.setSession(w, auth.sessions.CreateFrom(user, r))
+}
+
+func (auth *Auth) setSession(w http.ResponseWriter, session Session) error {
 	if !session.Exists() {
 		return fmt.Errorf("auth: could not create new session")
 	}
+	auth.audit.record(AuditEvent{
+		Action: SessionCreated,
+		UserID: session.UserID,
+		IP:     session.IP,
+		Target: session.ID,
+		At:     auth.now(),
+	})
 	SetCookie(w, auth.config.Cookie, session)
 	return nil
 }
 
 func (auth *Auth) CreateSessionAndRedirect(w http.ResponseWriter, r *http.Request, user User, next string) error {
-	if err := auth.CreateSession(w, user); err != nil {
+	if err := auth.CreateSessionFrom(w, r, user); err != nil {
 		return err
 	}
 
@@ -129,32 +349,102 @@ func (auth *Auth) CreateSessionAndRedirect(w http.ResponseWriter, r *http.Reques
 	return nil
 }
 
-// Logout removes the auth cookie's session key from the database
+// Logout removes the auth cookie's session key from the database and
+// expires the cookie
 func (auth *Auth) Logout(w http.ResponseWriter, r *http.Request) error {
 	// Remove the session
 	cookie, err := r.Cookie(auth.CookieName())
 	if err != nil {
 		return nil
 	}
+	session := auth.sessions.Get(cookie.Value)
 	auth.sessions.Delete(cookie.Value)
-
-	// TODO Remove all sessions for this user? Global Logout?
-	// TODO delete the cookie?
+	DeleteCookie(w, auth.config.Cookie)
+	if session.Exists() {
+		auth.audit.record(AuditEvent{
+			Action: LoggedOut,
+			UserID: session.UserID,
+			IP:     ClientIP(r),
+			Target: session.ID,
+			At:     auth.now(),
+		})
+	}
 
 	http.Redirect(w, r, auth.homeURL, 302)
 	return nil
 }
 
-// ResetUserToken generates a new user token and resets the token timestamp.
-func (auth *Auth) ResetUserToken(user *User) {
-	user.Token = RandomKey()
-	user.TokenSetAt = time.Now()
+// LogoutEverywhere deletes all sessions of the given user. If the auth
+// revokes tokens with sessions, all of the user's API tokens are also
+// deleted.
+func (auth *Auth) LogoutEverywhere(user User) error {
+	return auth.endSessions(user, "logout everywhere")
+}
 
+// endSessions deletes all sessions, and optionally tokens, of the given
+// user and audits the deletion with the given reason
+func (auth *Auth) endSessions(user User, reason string) error {
+	if err := auth.sessions.DeleteForUser(user.ID); err != nil {
+		return err
+	}
+	auth.audit.record(AuditEvent{
+		Action: SessionDeleted,
+		UserID: user.ID,
+		Reason: reason,
+		At:     auth.now(),
+	})
+	if auth.revokeTokens {
+		return auth.tokens.DeleteForUser(user.ID)
+	}
+	return nil
+}
+
+// RevokeTokensOnLogout sets whether LogoutEverywhere, and therefore
+// password changes and deactivations, also delete the user's API tokens.
+func (auth *Auth) RevokeTokensOnLogout(revoke bool) {
+	auth.revokeTokens = revoke
+}
+
+// ChangePassword sets the password of the given user and logs them
+// out everywhere.
+func (auth *Auth) ChangePassword(user *User, cleartext string) error {
+	if err := auth.users.SetPassword(user, cleartext); err != nil {
+		return err
+	}
+	return auth.endSessions(*user, "password changed")
+}
+
+// Deactivate marks the given user as inactive and logs them out
+// everywhere.
+func (auth *Auth) Deactivate(user *User) error {
+	if err := auth.users.SetActive(user, false); err != nil {
+		return err
+	}
+	return auth.endSessions(*user, "deactivated")
+}
+
+// ResetUserToken generates a new user token and resets the token timestamp.
+// Only the token's digest is saved, so the token itself is only set on
+// the given user.
+func (auth *Auth) ResetUserToken(user *User) error {
 	// Update the user before generating an email
-	stmt := Users.Update().Values(
-		sol.Values{"token": user.Token, "token_set_at": user.TokenSetAt},
-	).Where(Users.C("id").Equals(user.ID))
-	auth.conn.Query(stmt)
+	token := RandomKey()
+	if err := auth.users.SetToken(user, HashKey(token), auth.now()); err != nil {
+		return fmt.Errorf("auth: could not reset token of user %d: %s", user.ID, err)
+	}
+	user.Token = token
+	auth.audit.record(AuditEvent{
+		Action: PasswordResetRequested,
+		UserID: user.ID,
+		Email:  user.Email,
+		At:     auth.now(),
+	})
+	return nil
+}
+
+// ClearUserToken removes the user's token so it cannot be used again.
+func (auth *Auth) ClearUserToken(user *User) error {
+	return auth.users.SetToken(user, "", user.TokenSetAt)
 }
 
 // MakePassword returns an encrypted string of the given cleartext password
@@ -163,21 +453,189 @@ func (auth *Auth) MakePassword(cleartext string) string {
 	return MakePassword(auth.users.Hasher(), cleartext)
 }
 
-// Users returns the internal user manager
+// SetThrottle enables the throttling of failed logins by ByPassword using
+// the given throttle. A nil throttle disables throttling.
+func (auth *Auth) SetThrottle(throttle *Throttle) {
+	auth.throttle = throttle
+}
+
+// Unlock clears any failed login attempts for the given email
+func (auth *Auth) Unlock(email string) error {
+	if auth.throttle == nil {
+		return nil
+	}
+	return auth.throttle.UnlockEmail(email)
+}
+
+// RequireSuperuserSecondFactor sets whether superusers must log in with a
+// second factor. Superusers without a TOTP device must enroll one, so it
+// errors if TOTP has not been enabled with EnableTOTP.
+func (auth *Auth) RequireSuperuserSecondFactor(required bool) error {
+	if required && auth.totp == nil {
+		return fmt.Errorf("auth: superusers cannot require a second factor without TOTP")
+	}
+	auth.superuser2FA = required
+	return nil
+}
+
+// EnableWebAuthn enables passkey login for the given relying party ID,
+// name and origin, and returns the internal WebAuthn manager. The config's
+// SecretKey must be at least MinSecretLength bytes.
+func (auth *Auth) EnableWebAuthn(rpID, rpName, origin string) (*WebAuthnManager, error) {
+	if err := auth.requireConn("WebAuthn"); err != nil {
+		return nil, err
+	}
+	if err := CheckSecret(auth.config.SecretKey); err != nil {
+		return nil, err
+	}
+	auth.webauthn = NewWebAuthn(
+		auth.conn, auth.users, auth.config.SecretKey, rpID, rpName, origin,
+	)
+	return auth.webauthn, nil
+}
+
+// WebAuthn returns the internal WebAuthn manager, which is nil unless
+// enabled with EnableWebAuthn.
+func (auth *Auth) WebAuthn() *WebAuthnManager {
+	return auth.webauthn
+}
+
+// RequireVerifiedEmail sets whether users must verify their email address
+// before they can authenticate by password or session.
+func (auth *Auth) RequireVerifiedEmail(required bool) {
+	auth.verifiedOnly = required
+}
+
+// EnableTOTP enables TOTP two-factor authentication, whose devices and
+// recovery codes are kept in the totp_devices and recovery_codes tables,
+// and returns the internal TOTP manager. The config's SecretKey must be at
+// least MinSecretLength bytes.
+func (auth *Auth) EnableTOTP() (*TOTPManager, error) {
+	if err := auth.requireConn("TOTP"); err != nil {
+		return nil, err
+	}
+	if err := CheckSecret(auth.config.SecretKey); err != nil {
+		return nil, err
+	}
+	auth.totp = NewTOTP(auth.conn, auth.config.SecretKey, auth.users.Hasher())
+	return auth.totp, nil
+}
+
+// TOTP returns the internal TOTP manager, which is nil unless enabled with
+// EnableTOTP.
+func (auth *Auth) TOTP() *TOTPManager {
+	return auth.totp
+}
+
+// Users returns the internal user manager, which manages groups and
+// permissions. It is nil if users are kept by another store, such as by
+// NewInMemory. Use UserStore for any store.
 func (auth *Auth) Users() *UserManager {
+	manager, _ := auth.users.(*UserManager)
+	return manager
+}
+
+// UserStore returns the internal user store
+func (auth *Auth) UserStore() UserStore {
 	return auth.users
 }
 
-// Sessions returns the internal session manager
-func (auth *Auth) Sessions() *SessionManager {
+// Sessions returns the internal session store
+func (auth *Auth) Sessions() SessionStore {
 	return auth.sessions
 }
 
-// Tokens returns the internal token manager
+// ListSessions returns all sessions of the given user, such as for an
+// "active devices" page.
+func (auth *Auth) ListSessions(user User) []Session {
+	return auth.sessions.ListForUser(user.ID)
+}
+
+// RevokeSession deletes the session with the given ID if it belongs to
+// the given user. IDs are given by ListSessions.
+func (auth *Auth) RevokeSession(user User, id string) error {
+	for _, session := range auth.sessions.ListForUser(user.ID) {
+		if session.ID != id {
+			continue
+		}
+		if err := auth.sessions.DeleteByID(id); err != nil {
+			return err
+		}
+		auth.audit.record(AuditEvent{
+			Action: SessionDeleted,
+			UserID: user.ID,
+			Target: id,
+			Reason: "revoked",
+			At:     auth.now(),
+		})
+		return nil
+	}
+	return fmt.Errorf("auth: user %d has no session with that id", user.ID)
+}
+
+// RevokeOtherSessions deletes all sessions of the given user except the
+// session of the given request, signing them out of their other devices.
+func (auth *Auth) RevokeOtherSessions(user User, r *http.Request) error {
+	cookie, err := r.Cookie(auth.CookieName())
+	if err != nil {
+		return err
+	}
+	if err = auth.sessions.DeleteForUserExcept(user.ID, cookie.Value); err != nil {
+		return err
+	}
+	auth.audit.record(AuditEvent{
+		Action: SessionDeleted,
+		UserID: user.ID,
+		IP:     ClientIP(r),
+		Reason: "revoked other sessions",
+		At:     auth.now(),
+	})
+	return nil
+}
+
+// SetSessionStore replaces the session store, such as with a
+// MemorySessionStore for tests or single process applications, or a
+// CookieSessionStore for stateless sessions. An in-memory user store ends
+// the sessions of a MemorySessionStore itself.
+func (auth *Auth) SetSessionStore(store SessionStore) {
+	auth.sessions = store
+	if users, ok := auth.users.(*MemoryUserStore); ok {
+		sessions, _ := store.(*MemorySessionStore)
+		users.SetSessionStore(sessions)
+	}
+}
+
+// SetAuditSink records security events to the given sink, including the
+// events of the token store. A nil sink disables auditing.
+func (auth *Auth) SetAuditSink(sink AuditSink) {
+	auth.audit.SetAuditSink(sink)
+	if tokens, ok := auth.tokens.(interface{ SetAuditSink(AuditSink) }); ok {
+		tokens.SetAuditSink(sink)
+	}
+}
+
+// Tokens returns the internal token manager. It is nil if tokens are kept
+// by another store, such as by NewInMemory. Use TokenStore for any store.
 func (auth *Auth) Tokens() *TokenManager {
+	manager, _ := auth.tokens.(*TokenManager)
+	return manager
+}
+
+// TokenStore returns the internal token store
+func (auth *Auth) TokenStore() TokenStore {
 	return auth.tokens
 }
 
+// requireConn returns an error if the auth has no database connection,
+// such as an auth created by NewInMemory, since the given feature keeps
+// its own tables
+func (auth *Auth) requireConn(feature string) error {
+	if auth.conn == nil {
+		return fmt.Errorf("auth: %s requires a database connection", feature)
+	}
+	return nil
+}
+
 // New creates a new auth with users, sessions, and tokens
 func New(c config.Config, conn sol.Conn) *Auth {
 	return create(c, conn, NewUsers(conn))
@@ -188,6 +646,24 @@ func Mock(c config.Config, conn sol.Conn) *Auth {
 	return create(c, conn, MockUsers(conn))
 }
 
+// NewInMemory creates an auth with users, sessions, and tokens kept in
+// memory, such as for tests that should not need a database. Features with
+// their own tables, such as TOTP, WebAuthn, OIDC and the OAuth server,
+// cannot be used.
+func NewInMemory(c config.Config) *Auth {
+	users, sessions := NewMemoryUsers(), NewMemorySessions(c.Cookie)
+	users.SetSessionStore(sessions)
+	return &Auth{
+		config:   c,
+		users:    users,
+		sessions: sessions,
+		tokens:   NewMemoryTokens(),
+		policy:   DefaultSessionPolicy,
+		homeURL:  "/",
+		now:      func() time.Time { return time.Now().In(time.UTC) },
+	}
+}
+
 func create(c config.Config, conn sol.Conn, users *UserManager) *Auth {
 	return &Auth{
 		conn:     conn,
@@ -195,6 +671,7 @@ func create(c config.Config, conn sol.Conn, users *UserManager) *Auth {
 		users:    users,
 		sessions: NewSessions(c.Cookie, conn),
 		tokens:   NewTokens(conn),
+		policy:   DefaultSessionPolicy,
 		homeURL:  "/", // TODO Set this using the given config
 		now:      func() time.Time { return time.Now().In(time.UTC) },
 	}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"net/http"
 	"net/http/cookiejar"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/aodin/config"
 	"github.com/aodin/sol"
@@ -39,6 +41,17 @@ func getConn(t *testing.T) *sol.DB {
 	return testconn
 }
 
+// testSecret is long enough to derive keys from
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// testConfig returns the default config with a secret key, which features
+// that sign or encrypt values require
+func testConfig() config.Config {
+	c := config.Default
+	c.SecretKey = testSecret
+	return c
+}
+
 func initSchema(conn sol.Conn, tables ...sol.Tabular) {
 	// Create the given schemas
 	for _, table := range tables {
@@ -56,7 +69,7 @@ func TestAuth(t *testing.T) {
 	// Get a blank DB and create the schemas
 	tx, _ := getConn(t).Must().Begin()
 	defer tx.Rollback()
-	initSchema(tx, Users, Sessions, Tokens)
+	initSchema(tx, Users, Sessions, Tokens, TOTPDevices, RecoveryCodes)
 
 	// Create a mock Auth and test its methods
 	auth := Mock(config.Default, tx)
@@ -73,7 +86,8 @@ func TestAuth(t *testing.T) {
 	require.True(t, session.Exists(), "Failed to create session")
 	assert.Equal(user.ID, session.UserID)
 
-	token := auth.tokens.ForeverToken(user)
+	token, err := auth.tokens.ForeverToken(user)
+	require.Nil(t, err, "Failed to create token")
 	assert.Equal(user.ID, token.UserID)
 
 	// Duplicate users cannot be created
@@ -82,7 +96,7 @@ func TestAuth(t *testing.T) {
 	require.False(t, invalid.Exists(), "Invalid user was created")
 
 	// Update the user's existing token to perform auth by user token
-	auth.ResetUserToken(&user)
+	require.Nil(t, auth.ResetUserToken(&user))
 	assert.NotEqual("", user.Token, "No user token was set")
 	assert.False(user.TokenSetAt.IsZero(), "No user token timestamp was set")
 
@@ -99,6 +113,35 @@ func TestAuth(t *testing.T) {
 	_, err = auth.ByPassword("b@example.com", "secret")
 	assert.NotNil(err, "Missing email should have errored auth by password")
 
+	// Passwords from another hasher should be upgraded on login
+	legacy := NewPBKDF2Hasher("pbkdf2_sha256", 1, sha256.New)
+	tx.Query(Users.Update().Values(
+		sol.Values{"password": MakePassword(legacy, "secret")},
+	).Where(Users.C("id").Equals(user.ID)))
+
+	valid, err = auth.ByPassword("a@example.com", "secret")
+	require.Nil(t, err, "Could not auth by legacy password")
+	assert.False(NeedsRehash(auth.users.Hasher(), valid.Password))
+
+	stored, err := auth.users.GetByID(user.ID)
+	require.Nil(t, err, "Could not get user by ID")
+	assert.Equal(valid.Password, stored.Password, "Password was not saved")
+
+	// Throttle failed logins
+	auth.SetThrottle(NewThrottle(NewMemoryThrottleStore()))
+	for i := 0; i < auth.throttle.Limit; i++ {
+		_, err = auth.ByPasswordFrom("a@example.com", "1234", "127.0.0.1")
+		assert.NotNil(err, "Incorrect password should have errored during auth")
+	}
+	_, err = auth.ByPasswordFrom("a@example.com", "secret", "127.0.0.1")
+	assert.IsType(LockoutError{}, err, "Login should be locked out")
+
+	require.Nil(t, auth.Unlock("a@example.com"), "Unlock should not error")
+	valid, err = auth.ByPasswordFrom("a@example.com", "secret", "127.0.0.2")
+	require.Nil(t, err, "Could not auth by password after unlock")
+	assert.Equal(user.ID, valid.ID)
+	auth.SetThrottle(nil)
+
 	// Attempt auth by session
 	valid = auth.BySession(session.Key)
 	assert.True(valid.Exists(), "An invalid user was returned by session key")
@@ -124,16 +167,18 @@ func TestAuth(t *testing.T) {
 	assert.False(invalid.Exists())
 
 	// Attempt auth by token (used in APIs)
-	valid = auth.ByToken(user.ID, token.Key)
+	valid, _ = auth.ByToken(user.ID, token.Key)
 	assert.True(valid.Exists(), "An invalid user was returned by token")
 
-	invalid = auth.ByToken(user.ID, "")
+	invalid, _ = auth.ByToken(user.ID, "")
 	assert.False(invalid.Exists(), "A valid user returned from an empty token")
 
 	// Test getter methods
 	assert.NotNil(auth.Users(), "Users manager is missing")
 	assert.NotNil(auth.Sessions(), "Sessions manager is missing")
 	assert.NotNil(auth.Tokens(), "Tokens manager is missing")
+	assert.Equal(auth.Users(), auth.UserStore())
+	assert.Equal(auth.Tokens(), auth.TokenStore())
 
 	// Start a test server
 	create := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -187,6 +232,12 @@ func TestAuth(t *testing.T) {
 	require.NotNil(t, err, "Test server did not redirect")
 	assert.Equal(302, res.StatusCode)
 
+	// The cookie should be expired
+	expired := res.Cookies()
+	require.Equal(t, 1, len(expired))
+	assert.Equal("", expired[0].Value)
+	assert.True(expired[0].Expires.Before(time.Now()))
+
 	// The session should no longer exist
 	session = auth.Sessions().Get(cookies[0].Value)
 
@@ -196,3 +247,53 @@ func TestAuth(t *testing.T) {
 		"Session was not deleted",
 	)
 }
+
+func TestLogoutEverywhere(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens, TOTPDevices, RecoveryCodes)
+
+	auth := Mock(config.Default, tx)
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+
+	first := auth.sessions.Create(user)
+	second := auth.sessions.Create(user)
+	token, err := auth.tokens.ForeverToken(user)
+	require.Nil(t, err)
+
+	// Tokens are kept by default
+	assert.Nil(auth.LogoutEverywhere(user))
+	assert.False(auth.BySession(first.Key).Exists())
+	assert.False(auth.BySession(second.Key).Exists())
+	assert.True(auth.tokens.Get(token.Key).Exists())
+
+	// Changing a password logs the user out everywhere
+	auth.RevokeTokensOnLogout(true)
+	session := auth.sessions.Create(user)
+	assert.Nil(auth.ChangePassword(&user, "new secret"))
+	assert.False(auth.BySession(session.Key).Exists())
+	assert.False(auth.tokens.Get(token.Key).Exists())
+
+	_, err = auth.ByPassword("a@example.com", "new secret")
+	assert.Nil(err)
+
+	// The user manager also ends sessions without the auth
+	session = auth.sessions.Create(user)
+	assert.Nil(auth.users.SetPassword(&user, "new secret"))
+	assert.False(auth.BySession(session.Key).Exists())
+	session = auth.sessions.Create(user)
+	assert.Nil(auth.users.RehashPassword(&user, "new secret"))
+	assert.True(auth.BySession(session.Key).Exists(), "Rehashes should keep sessions")
+
+	// So does deactivating the user, who then cannot log in
+	session = auth.sessions.Create(user)
+	assert.Nil(auth.Deactivate(&user))
+	assert.False(user.IsActive)
+	assert.False(auth.BySession(session.Key).Exists())
+
+	_, err = auth.ByPassword("a@example.com", "new secret")
+	assert.NotNil(err, "Inactive users should not be able to log in")
+}
@@ -0,0 +1,128 @@
+package auth
+
+import "fmt"
+
+// decodeCBOR decodes a single CBOR (RFC 7049) data item from the given
+// bytes and returns it along with any remaining bytes. It supports the
+// subset of CBOR used by WebAuthn: integers are returned as int64, byte
+// strings as []byte, text as string, arrays as []interface{}, maps as
+// map[interface{}]interface{}, and simple values as bool or nil. Tags
+// are ignored.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORDepth(data, 0)
+}
+
+// maxCBORDepth limits the nesting of arrays and maps
+const maxCBORDepth = 16
+
+func decodeCBORDepth(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("auth: cbor is nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("auth: unexpected end of cbor")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	// Simple values
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		return nil, nil, fmt.Errorf("auth: unsupported cbor simple value %d", info)
+	}
+
+	// Read the argument, which is a value, length or count
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(data) < n {
+			return nil, nil, fmt.Errorf("auth: unexpected end of cbor")
+		}
+		for _, b := range data[:n] {
+			arg = arg<<8 | uint64(b)
+		}
+		data = data[n:]
+	default:
+		return nil, nil, fmt.Errorf("auth: unsupported cbor argument %d", info)
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("auth: cbor integer overflow")
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("auth: cbor integer overflow")
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if uint64(len(data)) < arg {
+			return nil, nil, fmt.Errorf("auth: unexpected end of cbor")
+		}
+		if major == 2 {
+			return append([]byte{}, data[:arg]...), data[arg:], nil
+		}
+		return string(data[:arg]), data[arg:], nil
+	case 4:
+		if uint64(len(data)) < arg {
+			return nil, nil, fmt.Errorf("auth: unexpected end of cbor")
+		}
+		array := make([]interface{}, arg)
+		var err error
+		for i := range array {
+			if array[i], data, err = decodeCBORDepth(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return array, data, nil
+	case 5:
+		if uint64(len(data)) < arg {
+			return nil, nil, fmt.Errorf("auth: unexpected end of cbor")
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			var err error
+			if key, data, err = decodeCBORDepth(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("auth: unsupported cbor map key")
+			}
+			if value, data, err = decodeCBORDepth(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, data, nil
+	}
+	// Major type 6 is a tag, decode the tagged item
+	return decodeCBORDepth(data, depth+1)
+}
+
+// cborMap decodes the given bytes as a CBOR map, ignoring trailing bytes
+func cborMap(data []byte) (map[interface{}]interface{}, []byte, error) {
+	item, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("auth: cbor item is not a map")
+	}
+	return m, rest, nil
+}
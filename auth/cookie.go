@@ -2,6 +2,7 @@ package auth
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/aodin/config"
 )
@@ -12,3 +13,8 @@ import (
 func SetCookie(w http.ResponseWriter, c config.Cookie, session Session) {
 	c.Set(w, session.Key, session.Expires)
 }
+
+// DeleteCookie expires the cookie of the given cookie configuration
+func DeleteCookie(w http.ResponseWriter, c config.Cookie) {
+	c.Set(w, "", time.Unix(0, 0))
+}
@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aodin/config"
+)
+
+// CookieSessionStore is a stateless SessionStore. The session key is the
+// cookie value itself: the user ID, expiration, the user's session version
+// and when the session was first created, signed with a key derived from the config's SecretKey. If
+// Encrypt is true, the value is also encrypted.
+//
+// No sessions table is needed, so BySession only performs a user lookup.
+// Individual sessions cannot be deleted - Delete is a no-op and the
+// cookie must be removed from the client. DeleteForUser bumps the user's
+// session version, which revokes all of their sessions.
+type CookieSessionStore struct {
+	users   UserStore
+	cookie  config.Cookie
+	key     []byte
+	nowFunc func() time.Time
+
+	Encrypt bool
+}
+
+func (m *CookieSessionStore) encode(session Session) string {
+	value := fmt.Sprintf(
+		"%d:%d:%d:%d",
+		session.UserID,
+		session.Expires.Unix(),
+		session.Version,
+		session.CreatedAt.Unix(),
+	)
+	if !m.Encrypt {
+		return Sign(m.key, value)
+	}
+	encrypted, err := Encrypt(m.key, []byte(value))
+	if err != nil {
+		panic(fmt.Sprintf("auth: could not encrypt session: %s", err))
+	}
+	return EncodeBase64String(encrypted)
+}
+
+func (m *CookieSessionStore) decode(key string) (session Session, ok bool) {
+	var value string
+	if m.Encrypt {
+		encrypted, err := DecodeBase64String(key)
+		if err != nil {
+			return
+		}
+		decrypted, err := Decrypt(m.key, encrypted)
+		if err != nil {
+			return
+		}
+		value = string(decrypted)
+	} else if value, ok = Unsign(m.key, key); !ok {
+		return
+	}
+
+	parts := strings.SplitN(value, ":", 4)
+	if len(parts) != 4 {
+		return Session{}, false
+	}
+	var expires, created int64
+	var err error
+	if session.UserID, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return Session{}, false
+	}
+	if expires, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return Session{}, false
+	}
+	if session.Version, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return Session{}, false
+	}
+	if created, err = strconv.ParseInt(parts[3], 10, 64); err != nil {
+		return Session{}, false
+	}
+	session.Key = key
+	session.ID = HashKey(key)
+	session.Expires = time.Unix(expires, 0).In(time.UTC)
+	session.CreatedAt = time.Unix(created, 0).In(time.UTC)
+	session.manager = m
+	return session, true
+}
+
+// Create creates a new signed session for the given User
+func (m *CookieSessionStore) Create(user User) Session {
+	return m.CreateFrom(user, nil)
+}
+
+// CreateFrom creates a new signed session for the given User. The client
+// of the request is not recorded.
+func (m *CookieSessionStore) CreateFrom(user User, r *http.Request) (session Session) {
+	now := m.nowFunc().Truncate(time.Second)
+	session = Session{
+		UserID:    user.ID,
+		Expires:   now.Add(m.cookie.Age),
+		CreatedAt: now,
+		Version:   user.SessionVersion,
+		manager:   m,
+	}
+	session.Key = m.encode(session)
+	session.ID = HashKey(session.Key)
+	return
+}
+
+// Renew returns a new signed session that expires at the given time. The
+// original creation time is kept, so renewals cannot extend a session past
+// the MaxLifetime of a SessionPolicy.
+func (m *CookieSessionStore) Renew(session Session, expires time.Time) Session {
+	session.Expires = expires.Truncate(time.Second)
+	session.manager = m
+	session.Key = m.encode(session)
+	session.ID = HashKey(session.Key)
+	return session
+}
+
+// Get returns the session of the given key if it is valid and has not
+// expired. The session version is checked against the user by Valid.
+func (m *CookieSessionStore) Get(key string) Session {
+	session, ok := m.decode(key)
+	if !ok || !session.Expires.After(m.nowFunc()) {
+		return Session{}
+	}
+	return session
+}
+
+// ListForUser returns nothing, stateless sessions cannot be listed.
+func (m *CookieSessionStore) ListForUser(id int64) []Session {
+	return nil
+}
+
+// Delete does nothing, stateless sessions are deleted by removing the
+// cookie or by DeleteForUser.
+func (m *CookieSessionStore) Delete(key string) error {
+	return nil
+}
+
+// DeleteByID does nothing, see Delete.
+func (m *CookieSessionStore) DeleteByID(id string) error {
+	return nil
+}
+
+// DeleteForUser revokes all sessions of the user with the given ID by
+// bumping their session version.
+func (m *CookieSessionStore) DeleteForUser(id int64) error {
+	return m.users.BumpSessionVersion(id)
+}
+
+// DeleteForUserExcept returns an error, stateless sessions can only be
+// revoked all at once.
+func (m *CookieSessionStore) DeleteForUserExcept(id int64, key string) error {
+	return fmt.Errorf("auth: stateless sessions cannot be revoked individually")
+}
+
+// Touch does nothing, stateless sessions must be re-created to change
+// their expiration.
+func (m *CookieSessionStore) Touch(key string, expires time.Time) error {
+	return nil
+}
+
+// Valid returns true if the given session has not been revoked for the
+// given user.
+func (m *CookieSessionStore) Valid(session Session, user User) bool {
+	return session.UserID == user.ID && session.Version == user.SessionVersion
+}
+
+// NewCookieSessions creates a stateless session store that sets expiration
+// using the given cookie config and signs sessions with a key derived from
+// the given secret. It will panic if the secret is too short, since anyone
+// could then forge sessions.
+func NewCookieSessions(c config.Cookie, users UserStore, secret string) *CookieSessionStore {
+	if err := CheckSecret(secret); err != nil {
+		log.Panic(err)
+	}
+	return &CookieSessionStore{
+		users:   users,
+		cookie:  c,
+		key:     DeriveKey(secret, "auth.sessions"),
+		nowFunc: func() time.Time { return time.Now().In(time.UTC) },
+	}
+}
+
+// CookieSessionStore should implement the SessionStore interface
+var _ SessionStore = &CookieSessionStore{}
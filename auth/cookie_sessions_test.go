@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Panics(func() {
+		NewCookieSessions(config.DefaultCookie, nil, "")
+	}, "Cookie sessions should require a secret")
+	assert.Panics(func() {
+		NewCookieSessions(config.DefaultCookie, nil, "secret")
+	}, "Cookie sessions should require a long secret")
+
+	for _, encrypt := range []bool{false, true} {
+		sessions := NewCookieSessions(config.DefaultCookie, nil, testSecret)
+		sessions.Encrypt = encrypt
+		now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+		sessions.nowFunc = func() time.Time { return now }
+
+		user := User{ID: 1, SessionVersion: 2}
+		session := sessions.Create(user)
+		require.True(t, session.Exists())
+		assert.Equal(user.ID, session.UserID)
+		assert.Equal(now.Add(config.DefaultCookie.Age), session.Expires)
+		assert.Equal(now, session.CreatedAt)
+
+		valid := sessions.Get(session.Key)
+		assert.True(valid.Exists())
+		assert.Equal(session.UserID, valid.UserID)
+		assert.Equal(session.Expires, valid.Expires)
+		assert.Equal(now, valid.CreatedAt, "The creation time should be signed")
+		assert.True(sessions.Valid(valid, user))
+
+		// Renewed sessions keep their creation time
+		renewed := sessions.Renew(valid, now.Add(time.Hour))
+		assert.NotEqual(session.Key, renewed.Key)
+		assert.Equal(now.Add(time.Hour), sessions.Get(renewed.Key).Expires)
+		assert.Equal(now, sessions.Get(renewed.Key).CreatedAt)
+
+		// Sessions are revoked by bumping the version
+		assert.False(sessions.Valid(valid, User{ID: 1, SessionVersion: 3}))
+		assert.False(sessions.Valid(valid, User{ID: 2, SessionVersion: 2}))
+
+		// Tampered and foreign sessions are invalid
+		assert.False(sessions.Get(session.Key[1:]).Exists())
+		assert.False(sessions.Get("").Exists())
+		other := NewCookieSessions(config.DefaultCookie, nil, testSecret+"other")
+		other.Encrypt = encrypt
+		assert.False(other.Get(session.Key).Exists())
+
+		// Sessions expire
+		now = now.Add(config.DefaultCookie.Age)
+		assert.False(sessions.Get(session.Key).Exists())
+	}
+}
+
+func TestCookieSessionsAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens, TOTPDevices, RecoveryCodes)
+
+	auth := Mock(config.Default, tx)
+	auth.SetSessionStore(NewCookieSessions(config.DefaultCookie, auth.Users(), testSecret))
+
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+
+	session := auth.Sessions().Create(user)
+	assert.Equal(user.ID, auth.BySession(session.Key).ID)
+
+	// Revoke all sessions of the user
+	require.Nil(t, auth.Sessions().DeleteForUser(user.ID))
+	assert.False(auth.BySession(session.Key).Exists())
+
+	// New sessions use the new version
+	user, err = auth.Users().GetByID(user.ID)
+	require.Nil(t, err)
+	session = auth.Sessions().Create(user)
+	assert.Equal(user.ID, auth.BySession(session.Key).ID)
+}
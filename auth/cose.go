@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers supported for WebAuthn credentials
+const (
+	COSEAlgES256 int64 = -7
+	COSEAlgEdDSA int64 = -8
+	COSEAlgRS256 int64 = -257
+)
+
+// COSE key parameters, see RFC 8152
+const (
+	coseKty    = 1
+	coseAlg    = 3
+	coseCrv    = -1
+	coseX      = -2
+	coseY      = -3
+	coseRSAN   = -1
+	coseRSAE   = -2
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+)
+
+// coseKey is a parsed COSE public key and its signature algorithm
+type coseKey struct {
+	alg    int64
+	public crypto.PublicKey
+}
+
+// parseCOSEKey parses the given CBOR encoded COSE public key
+func parseCOSEKey(data []byte) (key coseKey, err error) {
+	m, _, err := cborMap(data)
+	if err != nil {
+		return
+	}
+	kty, _ := m[int64(coseKty)].(int64)
+	key.alg, _ = m[int64(coseAlg)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && key.alg == COSEAlgES256:
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv, _ := m[int64(coseCrv)].(int64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			err = fmt.Errorf("auth: invalid P-256 cose key")
+			return
+		}
+		public := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			err = fmt.Errorf("auth: cose key is not on the P-256 curve")
+			return
+		}
+		key.public = public
+	case kty == coseKtyOKP && key.alg == COSEAlgEdDSA:
+		x, _ := m[int64(coseX)].([]byte)
+		if crv, _ := m[int64(coseCrv)].(int64); crv != 6 || len(x) != ed25519.PublicKeySize {
+			err = fmt.Errorf("auth: invalid Ed25519 cose key")
+			return
+		}
+		key.public = ed25519.PublicKey(x)
+	case kty == coseKtyRSA && key.alg == COSEAlgRS256:
+		n, _ := m[int64(coseRSAN)].([]byte)
+		e, _ := m[int64(coseRSAE)].([]byte)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			err = fmt.Errorf("auth: invalid RSA cose key")
+			return
+		}
+		var exponent int
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		key.public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+	default:
+		err = fmt.Errorf(
+			"auth: unsupported cose key type %d with algorithm %d", kty, key.alg,
+		)
+	}
+	return
+}
+
+// verifySignature verifies the given signature of the given data using
+// the given public key and COSE algorithm.
+func verifySignature(alg int64, public crypto.PublicKey, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+	switch alg {
+	case COSEAlgES256:
+		if key, ok := public.(*ecdsa.PublicKey); ok {
+			if ecdsa.VerifyASN1(key, digest[:], sig) {
+				return nil
+			}
+			return fmt.Errorf("auth: invalid ES256 signature")
+		}
+	case COSEAlgEdDSA:
+		if key, ok := public.(ed25519.PublicKey); ok {
+			if ed25519.Verify(key, data, sig) {
+				return nil
+			}
+			return fmt.Errorf("auth: invalid EdDSA signature")
+		}
+	case COSEAlgRS256:
+		if key, ok := public.(*rsa.PublicKey); ok {
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+		}
+	default:
+		return fmt.Errorf("auth: unsupported cose algorithm %d", alg)
+	}
+	return fmt.Errorf("auth: key does not match cose algorithm %d", alg)
+}
+
+// verifyCertificateSignature verifies a signature made by the given DER
+// encoded certificate's key, as used by packed attestation.
+func verifyCertificateSignature(alg int64, der, data, sig []byte) error {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	return verifySignature(alg, cert.PublicKey, data, sig)
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// MinSecretLength is the length in bytes of the shortest secret that keys
+// can be derived from
+const MinSecretLength = 32
+
+// CheckSecret returns an error if the given secret, such as the config's
+// SecretKey, is too short to derive keys from. Anyone could derive the
+// keys of an empty secret and forge the values they sign.
+func CheckSecret(secret string) error {
+	if len(secret) < MinSecretLength {
+		return fmt.Errorf(
+			"auth: the secret key must be at least %d bytes", MinSecretLength,
+		)
+	}
+	return nil
+}
+
+// DeriveKey derives a 32 byte key for the given purpose from the given
+// secret, such as the config's SecretKey, so that one secret can safely be
+// used to sign and encrypt different values.
+func DeriveKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func signature(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return EncodeBase64String(mac.Sum(nil))
+}
+
+// Sign appends an HMAC-SHA256 signature of the given value using the
+// given key. The value should not be secret, it is not encrypted.
+func Sign(key []byte, value string) string {
+	return value + "." + signature(key, value)
+}
+
+// Unsign returns the value of the given signed string and true if its
+// signature is valid for the given key.
+func Unsign(key []byte, signed string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+	if !ConstantTimeStringCompare(signature(key, value), signed[i+1:]) {
+		return "", false
+	}
+	return value, true
+}
+
+// Encrypt encrypts and authenticates the given plaintext with AES-GCM
+// using the given 32 byte key. The nonce is prepended to the ciphertext.
+func Encrypt(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := RandomBytes(gcm.NonceSize())
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt decrypts a ciphertext created by Encrypt with the given key.
+func Decrypt(key, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("auth: ciphertext is too short")
+	}
+	n := gcm.NonceSize()
+	return gcm.Open(nil, ciphertext[:n], ciphertext[n:], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrypto(t *testing.T) {
+	assert := assert.New(t)
+
+	key := DeriveKey("secret", "test")
+	assert.Equal(32, len(key))
+	assert.NotEqual(key, DeriveKey("secret", "other"))
+
+	// Signing
+	signed := Sign(key, "1:value")
+	value, ok := Unsign(key, signed)
+	assert.True(ok)
+	assert.Equal("1:value", value)
+
+	_, ok = Unsign(DeriveKey("secret", "other"), signed)
+	assert.False(ok, "Signature should not be valid for another key")
+	_, ok = Unsign(key, "2"+signed[1:])
+	assert.False(ok, "Signature should not be valid for another value")
+	_, ok = Unsign(key, "unsigned")
+	assert.False(ok)
+
+	// Encryption
+	ciphertext, err := Encrypt(key, []byte("plaintext"))
+	assert.Nil(err)
+	plaintext, err := Decrypt(key, ciphertext)
+	assert.Nil(err)
+	assert.Equal("plaintext", string(plaintext))
+
+	_, err = Decrypt(DeriveKey("secret", "other"), ciphertext)
+	assert.NotNil(err, "Decryption with another key should fail")
+	_, err = Decrypt(key, ciphertext[:4])
+	assert.NotNil(err, "Decryption of a short ciphertext should fail")
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/aodin/sol"
+	"github.com/aodin/sol/dialect"
+	"github.com/aodin/sol/postgres"
+	"github.com/aodin/sol/types"
+)
+
+// Dialect declares the database specific column types of the users,
+// sessions and tokens tables. Statements are compiled by the dialect of
+// the connection they are run on, so the managers work unchanged on every
+// supported database: only the tables created from Schema differ.
+type Dialect struct {
+	Name string
+
+	table     func(string, ...sol.Modifier) *sol.TableElem
+	serial    func() types.Type    // An auto incrementing integer
+	timestamp func() types.Type    // A nullable timestamp
+	created   func() types.Type    // A not null timestamp set on insert
+	text      func(int) types.Type // A not null string, bounded if it must be
+
+	// epoch fills created timestamps when they are added to existing rows
+	// of a table. It is empty if created timestamps have a default.
+	epoch string
+
+	// addColumn adds a column in a migration, if it does not exist when
+	// the database supports it
+	addColumn string
+
+	// alterType changes the type of a column in a migration. It is empty
+	// for dialects whose tables were always created with current types.
+	alterType string
+
+	// quote quotes identifiers that the database reserves
+	quote string
+}
+
+// ident returns the given column name, quoted if the dialect reserves it.
+// Only the key columns of the sessions and tokens tables are reserved.
+func (d Dialect) ident(name string) string {
+	return d.quote + name + d.quote
+}
+
+// Postgres declares the tables with SERIAL ids and timezone aware
+// timestamps. It is the dialect of the package's table variables.
+var Postgres = Dialect{
+	Name:  "postgres",
+	table: postgres.Table,
+	serial: func() types.Type {
+		return postgres.Serial()
+	},
+	timestamp: func() types.Type {
+		return postgres.Timestamp().WithTimezone()
+	},
+	created: func() types.Type {
+		return postgres.Timestamp().WithTimezone().NotNull().Default(postgres.Now)
+	},
+	text: func(int) types.Type {
+		return types.Text().NotNull()
+	},
+	addColumn: "ADD COLUMN IF NOT EXISTS",
+	alterType: "ALTER TABLE %s ALTER COLUMN %s TYPE %s",
+}
+
+// SQLite declares the tables for SQLite. An INTEGER primary key is an
+// alias of the row ID, so it is assigned automatically.
+var SQLite = Dialect{
+	Name:  "sqlite3",
+	table: sol.Table,
+	serial: func() types.Type {
+		return types.Integer()
+	},
+	timestamp: func() types.Type {
+		return types.Timestamp()
+	},
+	created: func() types.Type {
+		return types.Timestamp().NotNull()
+	},
+	text: func(int) types.Type {
+		return types.Text().NotNull()
+	},
+	epoch:     "'1970-01-01 00:00:00'",
+	addColumn: "ADD COLUMN",
+}
+
+// MySQL declares the tables for MySQL. Strings are VARCHAR rather than
+// TEXT, since MySQL does not allow TEXT columns a literal default, and
+// timestamps are DATETIME rather than TIMESTAMP, whose range begins after
+// the epoch and ends in 2038, and which MySQL may update automatically.
+// The reserved key columns are quoted.
+var MySQL = Dialect{
+	Name:  "mysql",
+	table: sol.Table,
+	serial: func() types.Type {
+		return autoIncrement{types.Integer().NotNull()}
+	},
+	timestamp: func() types.Type {
+		return renamedType{types.Timestamp(), "TIMESTAMP", "DATETIME"}
+	},
+	created: func() types.Type {
+		return renamedType{types.Timestamp().NotNull(), "TIMESTAMP", "DATETIME"}
+	},
+	text: func(limit int) types.Type {
+		return types.Varchar().Limit(limit).NotNull()
+	},
+	epoch:     "'1970-01-01 00:00:00'",
+	addColumn: "ADD COLUMN",
+	quote:     "`",
+}
+
+// autoIncrement adds MySQL's AUTO_INCREMENT to an integer column type
+type autoIncrement struct {
+	types.Type
+}
+
+// Create returns the column type with AUTO_INCREMENT
+func (t autoIncrement) Create(d dialect.Dialect) (string, error) {
+	create, err := t.Type.Create(d)
+	if err != nil {
+		return "", err
+	}
+	return create + " AUTO_INCREMENT", nil
+}
+
+// renamedType replaces the name of a column type, such as for a BIGINT
+// integer or a MySQL DATETIME
+type renamedType struct {
+	types.Type
+	from, to string
+}
+
+// Create returns the column type with its name replaced
+func (t renamedType) Create(d dialect.Dialect) (string, error) {
+	create, err := t.Type.Create(d)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(create, t.from, t.to, 1), nil
+}
+
+// Schema returns the users, sessions and tokens tables declared for the
+// given dialect, in the order they must be created. The remaining auth
+// tables are only declared for Postgres.
+func Schema(d Dialect) []*sol.TableElem {
+	return schemaAt(d, SchemaVersion)
+}
+
+// schemaAt returns the users, sessions and tokens tables as they were at
+// the given schema version
+func schemaAt(d Dialect, version int) []*sol.TableElem {
+	users := usersTable(d, version)
+	return []*sol.TableElem{
+		users,
+		sessionsTable(d, version, users),
+		tokensTable(d, version, users),
+	}
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+)
+
+// SessionPolicy controls how long sessions remain valid. The zero value
+// keeps the fixed expiration set by the cookie's age when the session
+// was created.
+type SessionPolicy struct {
+	// Sliding renews the expiration and re-issues the cookie when a
+	// session is used past half of the cookie's age
+	Sliding bool
+
+	// IdleTimeout ends sessions that have not been used for the given
+	// duration. Zero disables the idle timeout.
+	IdleTimeout time.Duration
+
+	// MaxLifetime ends sessions the given duration after they were
+	// created, even if they are still in use. Zero disables the limit.
+	MaxLifetime time.Duration
+
+	// TouchInterval is how often the last use of a session is saved.
+	// It should be well below the idle timeout.
+	TouchInterval time.Duration
+}
+
+// DefaultSessionPolicy keeps fixed expirations and saves the last use of
+// a session at most once a minute.
+var DefaultSessionPolicy = SessionPolicy{TouchInterval: time.Minute}
+
+// Expired returns true if the given session has been idle or alive for
+// too long at the given time. Idle timeouts are only checked if the
+// session's store records the last use, but sessions without a creation
+// time are always expired by a maximum lifetime.
+func (policy SessionPolicy) Expired(session Session, now time.Time) bool {
+	if !session.Expires.After(now) {
+		return true
+	}
+	if policy.IdleTimeout > 0 && !session.LastSeenAt.IsZero() {
+		if now.Sub(session.LastSeenAt) > policy.IdleTimeout {
+			return true
+		}
+	}
+	if policy.MaxLifetime > 0 && now.Sub(session.CreatedAt) > policy.MaxLifetime {
+		return true
+	}
+	return false
+}
+
+// Renewal returns the new expiration of the given session if it should be
+// renewed at the given time for a cookie of the given age. False will be
+// returned if the session should not be renewed.
+func (policy SessionPolicy) Renewal(session Session, now time.Time, age time.Duration) (time.Time, bool) {
+	if !policy.Sliding || session.Expires.Sub(now) > age/2 {
+		return time.Time{}, false
+	}
+	expires := now.Add(age)
+	if policy.MaxLifetime > 0 && !session.CreatedAt.IsZero() {
+		if limit := session.CreatedAt.Add(policy.MaxLifetime); expires.After(limit) {
+			expires = limit
+		}
+	}
+	if !expires.After(session.Expires) {
+		return time.Time{}, false
+	}
+	return expires, true
+}
+
+// SetSessionPolicy sets the expiration policy of sessions
+func (auth *Auth) SetSessionPolicy(policy SessionPolicy) {
+	auth.policy = policy
+}
+
+// SessionPolicy returns the expiration policy of sessions
+func (auth *Auth) SessionPolicy() SessionPolicy {
+	return auth.policy
+}
+
+// BySessionCookie returns an authenticated user if the session cookie of
+// the given request is valid. If sliding expiration is enabled, sessions
+// used past half their lifetime are renewed and their cookie is
+// re-issued to the given http.ResponseWriter.
+func (auth *Auth) BySessionCookie(w http.ResponseWriter, r *http.Request) User {
+	cookie, err := r.Cookie(auth.CookieName())
+	if err != nil {
+		return User{}
+	}
+	user, session := auth.bySession(cookie.Value)
+	if !user.Exists() {
+		return user
+	}
+	expires, ok := auth.policy.Renewal(session, auth.now(), auth.config.Cookie.Age)
+	if !ok {
+		return user
+	}
+
+	// Stateless sessions carry their expiration, so they must be re-signed
+	if stateless, ok := auth.sessions.(*CookieSessionStore); ok {
+		session = stateless.Renew(session, expires)
+	} else if err := auth.sessions.Touch(session.Key, expires); err != nil {
+		return user
+	} else {
+		session.Expires = expires
+	}
+	if session.Exists() {
+		SetCookie(w, auth.config.Cookie, session)
+	}
+	return user
+}
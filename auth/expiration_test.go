@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	age := 14 * 24 * time.Hour
+	session := Session{
+		Key:        "key",
+		Expires:    now.Add(age),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+
+	// The default policy only checks the expiration
+	policy := DefaultSessionPolicy
+	assert.False(policy.Expired(session, now))
+	assert.False(policy.Expired(session, now.Add(age-time.Second)))
+	assert.True(policy.Expired(session, now.Add(age)))
+	_, ok := policy.Renewal(session, now.Add(age-time.Second), age)
+	assert.False(ok, "Sessions should not be renewed without sliding")
+
+	// Idle timeout
+	policy.IdleTimeout = time.Hour
+	assert.False(policy.Expired(session, now.Add(time.Hour)))
+	assert.True(policy.Expired(session, now.Add(time.Hour+time.Second)))
+
+	// Stores that do not record the last use skip the idle timeout
+	assert.False(policy.Expired(
+		Session{Expires: session.Expires}, now.Add(2*time.Hour),
+	))
+
+	// Maximum lifetime
+	policy = SessionPolicy{Sliding: true, MaxLifetime: 20 * 24 * time.Hour}
+	session.LastSeenAt = now.Add(19 * 24 * time.Hour)
+	assert.False(policy.Expired(session, now.Add(time.Hour)))
+	assert.True(policy.Expired(session, now.Add(21*24*time.Hour)))
+	assert.True(policy.Expired(
+		Session{Expires: session.Expires}, now,
+	), "Sessions without a creation time should expire")
+
+	// Sliding expiration only renews past half of the lifetime
+	_, ok = policy.Renewal(session, now.Add(time.Hour), age)
+	assert.False(ok)
+
+	later := now.Add(8 * 24 * time.Hour)
+	expires, ok := policy.Renewal(session, later, age)
+	assert.True(ok)
+	assert.Equal(now.Add(20*24*time.Hour), expires, "Renewal should stop at the maximum lifetime")
+
+	policy.MaxLifetime = 0
+	expires, ok = policy.Renewal(session, later, age)
+	assert.True(ok)
+	assert.Equal(later.Add(age), expires)
+}
+
+func TestSlidingCookieSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	auth := NewInMemory(testConfig())
+	store := NewCookieSessions(config.Default.Cookie, auth.UserStore(), testSecret)
+	auth.SetSessionStore(store)
+	auth.SetSessionPolicy(SessionPolicy{
+		Sliding:       true,
+		MaxLifetime:   30 * 24 * time.Hour,
+		TouchInterval: time.Minute,
+	})
+	users, err := auth.Seed(SeedUser{Email: "a@example.com"})
+	require.Nil(t, err)
+	user := users[0]
+
+	now := time.Now().In(time.UTC)
+	store.nowFunc = func() time.Time { return now }
+	auth.now = func() time.Time { return now }
+	session := store.Create(user)
+	created := session.CreatedAt
+
+	request := func(key string) (*httptest.ResponseRecorder, User) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: auth.CookieName(), Value: key})
+		return w, auth.BySessionCookie(w, r)
+	}
+
+	// Renewed cookies keep the original creation time
+	now = now.Add(8 * 24 * time.Hour)
+	w, found := request(session.Key)
+	assert.Equal(user.ID, found.ID)
+	cookies := w.Result().Cookies()
+	require.Equal(t, 1, len(cookies), "The cookie should be re-issued")
+	renewed := store.Get(cookies[0].Value)
+	assert.Equal(created, renewed.CreatedAt)
+	assert.Equal(now.Add(config.Default.Cookie.Age).Truncate(time.Second), renewed.Expires)
+
+	// Renewals cannot extend a session past its maximum lifetime
+	now = now.Add(8 * 24 * time.Hour)
+	w, found = request(renewed.Key)
+	assert.Equal(user.ID, found.ID)
+	cookies = w.Result().Cookies()
+	require.Equal(t, 1, len(cookies))
+	renewed = store.Get(cookies[0].Value)
+	assert.Equal(created.Add(30*24*time.Hour), renewed.Expires)
+
+	now = now.Add(15 * 24 * time.Hour)
+	_, found = request(renewed.Key)
+	assert.False(found.Exists(), "Sessions should end at their maximum lifetime")
+}
+
+func TestSlidingSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens, TOTPDevices, RecoveryCodes)
+
+	auth := Mock(config.Default, tx)
+	store := NewMemorySessions(config.Default.Cookie)
+	auth.SetSessionStore(store)
+	auth.SetSessionPolicy(SessionPolicy{
+		Sliding:       true,
+		IdleTimeout:   3 * 24 * time.Hour,
+		TouchInterval: time.Minute,
+	})
+
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+
+	now := time.Now().In(time.UTC)
+	store.nowFunc = func() time.Time { return now }
+	auth.now = func() time.Time { return now }
+	session := store.Create(user)
+
+	request := func() (*httptest.ResponseRecorder, User) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: auth.CookieName(), Value: session.Key})
+		return w, auth.BySessionCookie(w, r)
+	}
+
+	// A new session should not be renewed
+	w, found := request()
+	assert.Equal(user.ID, found.ID)
+	assert.Equal(0, len(w.Result().Cookies()))
+
+	// Use the session every other day until past half of its lifetime
+	age := config.Default.Cookie.Age
+	for now.Before(session.CreatedAt.Add(age / 2)) {
+		now = now.Add(2 * 24 * time.Hour)
+		w, found = request()
+		assert.Equal(user.ID, found.ID)
+	}
+	cookies := w.Result().Cookies()
+	require.Equal(t, 1, len(cookies), "The cookie should be re-issued")
+	assert.Equal(session.Key, cookies[0].Value)
+	assert.Equal(now.Add(age), store.Get(session.Key).Expires)
+	assert.Equal(now, store.Get(session.Key).LastSeenAt)
+
+	// Idle sessions are deleted
+	now = now.Add(4 * 24 * time.Hour)
+	_, found = request()
+	assert.False(found.Exists())
+	assert.False(store.Get(session.Key).Exists())
+}
@@ -3,6 +3,8 @@ package auth
 import (
 	"fmt"
 	"hash"
+	"strconv"
+	"strings"
 )
 
 // Hasher is the target interface for included hashers.
@@ -19,11 +21,92 @@ func MakePassword(h Hasher, cleartext string) string {
 }
 
 // CheckPassword verifies the given cleartext password against the given
-// encoded string using the given hasher.
+// encoded string. If the encoded string was created by another registered
+// hasher, that hasher will be used instead of the given hasher.
 func CheckPassword(h Hasher, cleartext, encoded string) bool {
+	if algorithm := Algorithm(encoded); algorithm != h.Algorithm() {
+		if registered, err := GetHasher(algorithm); err == nil {
+			h = registered
+		}
+	}
 	return h.Verify(cleartext, encoded)
 }
 
+// Algorithm returns the algorithm prefix of the given encoded password.
+// Modular crypt format passwords, such as bcrypt's "$2b$...", return the
+// name of their registered hasher.
+func Algorithm(encoded string) string {
+	if strings.HasPrefix(encoded, "$") {
+		parts := strings.SplitN(encoded, "$", 3)
+		if len(parts) == 3 {
+			return cryptPrefixes[parts[1]]
+		}
+		return ""
+	}
+	return strings.SplitN(encoded, "$", 2)[0]
+}
+
+// NeedsRehash returns true if the given encoded password was not created by
+// the given hasher, or was created with a lower work factor, such as fewer
+// rounds. The password should then be encoded again. Passwords with a
+// higher work factor, such as those imported from Django, are kept.
+func NeedsRehash(h Hasher, encoded string) bool {
+	if Algorithm(encoded) != h.Algorithm() {
+		return true
+	}
+	if p, ok := h.(parameterized); ok {
+		parts := strings.SplitN(encoded, "$", 3)
+		if len(parts) < 3 {
+			return true
+		}
+		return weaker(parts[1], p.params())
+	}
+	return false
+}
+
+// weaker returns true if the stored work factors are malformed, or if no
+// current work factor is lower and at least one is higher. Mixed changes,
+// such as less time but more memory, are not rehashed.
+func weaker(stored, current string) bool {
+	old, err := workFactors(stored)
+	if err != nil {
+		return true
+	}
+	now, err := workFactors(current)
+	if err != nil || len(old) != len(now) {
+		return true
+	}
+	var higher bool
+	for i := range now {
+		if now[i] < old[i] {
+			return false
+		}
+		higher = higher || now[i] > old[i]
+	}
+	return higher
+}
+
+// workFactors parses encoded parameters, such as "10000" or "t=1,m=2",
+// into their values in order
+func workFactors(encoded string) (values []int, err error) {
+	for _, param := range strings.Split(encoded, ",") {
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			param = param[i+1:]
+		}
+		var value int
+		if value, err = strconv.Atoi(param); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return
+}
+
+// parameterized is implemented by hashers that encode their work factor
+type parameterized interface {
+	params() string
+}
+
 var hashers = make(map[string]Hasher)
 
 // RegisterHasher adds a new Hasher to the registry with the given name.
@@ -67,6 +150,34 @@ func NewBaseHasher(algorithm string) BaseHasher {
 	return BaseHasher{algorithm: algorithm}
 }
 
+// parseParams parses an encoded parameter string of the form "a=1,b=2" and
+// returns the integer values of the given keys in order. Every key must
+// be present.
+func parseParams(encoded string, keys ...string) ([]int, error) {
+	values := make(map[string]int)
+	for _, param := range strings.Split(encoded, ",") {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("auth: malformed hasher parameter %s", param)
+		}
+		value, err := strconv.Atoi(parts[1])
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("auth: invalid hasher parameter %s", param)
+		}
+		values[parts[0]] = value
+	}
+
+	params := make([]int, len(keys))
+	for i, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			return nil, fmt.Errorf("auth: missing hasher parameter %s", key)
+		}
+		params[i] = value
+	}
+	return params, nil
+}
+
 type mockHasher struct {
 	PBKDF2_Base
 }
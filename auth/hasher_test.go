@@ -2,6 +2,8 @@ package auth
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -19,6 +21,18 @@ func TestRegistry(t *testing.T) {
 	hashed := MakePassword(pbkdf2_sha256, cleartext)
 	assert.True(CheckPassword(pbkdf2_sha256, cleartext, hashed))
 
+	// Excessive rounds are rejected rather than derived
+	for _, rounds := range []string{"0", "-1", "1000000000"} {
+		encoded := "pbkdf2_sha256$" + rounds + "$salt$" + strings.SplitN(hashed, "$", 4)[3]
+		assert.False(CheckPassword(pbkdf2_sha256, cleartext, encoded), rounds)
+	}
+
+	// Passwords of other registered hashers should be verified by them
+	argon2id, err := GetHasher("argon2id")
+	assert.Nil(err, "GetHasher should not return an error")
+	assert.True(CheckPassword(argon2id, cleartext, hashed))
+	assert.False(CheckPassword(argon2id, "goodpassword", hashed))
+
 	// Get a hasher that doesn't exist
 	_, err = GetHasher("dne")
 	assert.NotNil(err)
@@ -53,3 +67,107 @@ func TestRegistry(t *testing.T) {
 		}
 	}()
 }
+
+func TestArgon2id(t *testing.T) {
+	assert := assert.New(t)
+
+	argon2id, err := GetHasher("argon2id")
+	assert.Nil(err, "GetHasher should not return an error")
+
+	cleartext := "badpassword"
+	hashed := MakePassword(argon2id, cleartext)
+	assert.True(strings.HasPrefix(hashed, "argon2id$t=3,m=65536,p=4$"))
+	assert.True(CheckPassword(argon2id, cleartext, hashed))
+	assert.False(CheckPassword(argon2id, "goodpassword", hashed))
+
+	// Parameters are read from the encoded string, not the hasher
+	cheap := NewArgon2idHasher("argon2id", 1, 1024, 1)
+	hashed = MakePassword(cheap, cleartext)
+	assert.True(CheckPassword(argon2id, cleartext, hashed))
+
+	// Malformed or foreign encodings should not verify
+	assert.False(CheckPassword(argon2id, cleartext, "argon2id$t=1$a$b"))
+	assert.False(CheckPassword(argon2id, cleartext, "argon2id"))
+
+	// Invalid or excessive parameters are rejected rather than derived
+	key := EncodeBase64String([]byte("0123456789abcdef0123456789abcdef"))
+	for _, params := range []string{
+		"t=0,m=1024,p=1",
+		"t=1,m=1024,p=0",
+		"t=1,m=0,p=1",
+		"t=1,m=1073741824,p=1",
+		"t=100000,m=1024,p=1",
+		"t=1,m=1024,p=256",
+	} {
+		encoded := "argon2id$" + params + "$salt$" + key
+		assert.False(CheckPassword(argon2id, cleartext, encoded), params)
+	}
+	assert.False(CheckPassword(
+		argon2id, cleartext, MakePassword(MockHasher("mock", 1, sha1.New), cleartext),
+	))
+}
+
+func TestScrypt(t *testing.T) {
+	assert := assert.New(t)
+
+	scrypt, err := GetHasher("scrypt")
+	assert.Nil(err, "GetHasher should not return an error")
+
+	cleartext := "badpassword"
+	hashed := MakePassword(scrypt, cleartext)
+	assert.True(strings.HasPrefix(hashed, "scrypt$n=32768,r=8,p=1$"))
+	assert.True(CheckPassword(scrypt, cleartext, hashed))
+	assert.False(CheckPassword(scrypt, "goodpassword", hashed))
+
+	// Parameters are read from the encoded string, not the hasher
+	cheap := NewScryptHasher("scrypt", 16, 1, 1)
+	hashed = MakePassword(cheap, cleartext)
+	assert.True(CheckPassword(scrypt, cleartext, hashed))
+
+	// Invalid parameters should not verify
+	assert.False(CheckPassword(scrypt, cleartext, "scrypt$n=3,r=8,p=1$a$b"))
+	assert.False(CheckPassword(scrypt, cleartext, "scrypt$$$"))
+
+	// Excessive parameters are rejected rather than derived
+	key := EncodeBase64String([]byte("0123456789abcdef0123456789abcdef"))
+	for _, params := range []string{
+		"n=16,r=0,p=1",
+		"n=16,r=1,p=0",
+		"n=1073741824,r=8,p=1",
+		"n=16,r=1,p=100000",
+	} {
+		encoded := "scrypt$" + params + "$salt$" + key
+		assert.False(CheckPassword(scrypt, cleartext, encoded), params)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	assert := assert.New(t)
+
+	pbkdf2_sha256, err := GetHasher("pbkdf2_sha256")
+	assert.Nil(err, "GetHasher should not return an error")
+	hashed := MakePassword(pbkdf2_sha256, "badpassword")
+	assert.Equal("pbkdf2_sha256", Algorithm(hashed))
+	assert.False(NeedsRehash(pbkdf2_sha256, hashed))
+
+	// An increase in rounds should require a rehash, but not a decrease
+	weak := NewPBKDF2Hasher("pbkdf2_sha256", 1, sha256.New)
+	assert.True(NeedsRehash(pbkdf2_sha256, MakePassword(weak, "badpassword")))
+	assert.False(NeedsRehash(weak, hashed), "Hashes should not be weakened")
+
+	// Mixed changes in work factors should not require a rehash
+	fast := NewScryptHasher("scrypt", 16, 2, 1)
+	wide := NewScryptHasher("scrypt", 32, 1, 1)
+	assert.False(NeedsRehash(fast, MakePassword(wide, "badpassword")))
+	assert.True(NeedsRehash(wide, MakePassword(NewScryptHasher("scrypt", 16, 1, 1), "badpassword")))
+
+	// As should a change in algorithm
+	argon2id, err := GetHasher("argon2id")
+	assert.Nil(err, "GetHasher should not return an error")
+	assert.True(NeedsRehash(argon2id, hashed))
+	assert.True(NeedsRehash(pbkdf2_sha256, MakePassword(argon2id, "badpassword")))
+
+	// Malformed passwords always require a rehash
+	assert.True(NeedsRehash(pbkdf2_sha256, ""))
+	assert.True(NeedsRehash(pbkdf2_sha256, "pbkdf2_sha256"))
+}
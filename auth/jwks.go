@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// JSONWebKey is a public key of a JSON Web Key Set as served by an OpenID
+// provider. Only RSA and P-256 keys are supported.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Elliptic curve
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// PublicKey returns the public key of the JSON web key
+func (key JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeBase64URL(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URL(key.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("auth: invalid RSA exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exponent.Int64()),
+		}, nil
+	case "EC":
+		if key.Crv != "P-256" {
+			return nil, fmt.Errorf("auth: unsupported curve %s", key.Crv)
+		}
+		x, err := decodeBase64URL(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URL(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		public := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return nil, fmt.Errorf("auth: EC key is not on its curve")
+		}
+		return public, nil
+	}
+	return nil, fmt.Errorf("auth: unsupported key type %s", key.Kty)
+}
+
+// JSONWebKeySet is a set of JSON web keys
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// Key returns the key with the given key ID. If the given ID is empty
+// and the set has only one key, that key is returned.
+func (set JSONWebKeySet) Key(kid string) (JSONWebKey, bool) {
+	if kid == "" && len(set.Keys) == 1 {
+		return set.Keys[0], true
+	}
+	for _, key := range set.Keys {
+		if key.Kid == kid {
+			return key, true
+		}
+	}
+	return JSONWebKey{}, false
+}
+
+// jwsHeader is the header of a compact JSON web signature
+type jwsHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verifyJWS verifies the signature of the given compact JSON web signature
+// with the public key returned for its header and returns the payload.
+// Only RS256 and ES256 signatures are accepted.
+func verifyJWS(token string, keyFunc func(jwsHeader) (crypto.PublicKey, error)) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("auth: malformed JSON web signature")
+	}
+	rawHeader, err := decodeBase64URL(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var header jwsHeader
+	if err = json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, err
+	}
+	sig, err := decodeBase64URL(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	public, err := keyFunc(header)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		key, ok := public.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("auth: RS256 requires an RSA key")
+		}
+		if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, fmt.Errorf("auth: invalid JSON web signature")
+		}
+	case "ES256":
+		key, ok := public.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return nil, fmt.Errorf("auth: ES256 requires a P-256 key")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, fmt.Errorf("auth: invalid JSON web signature")
+		}
+	default:
+		return nil, fmt.Errorf("auth: unsupported signature algorithm %s", header.Alg)
+	}
+	return decodeBase64URL(parts[1])
+}
@@ -0,0 +1,286 @@
+// Package jwt issues and verifies short-lived JSON Web Tokens for users, so
+// that services can authenticate each other's requests without sharing the
+// sessions table. Tokens are signed with HS256, RS256 or EdDSA keys, and
+// keys are rotated by their key ID.
+package jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aodin/volta/auth"
+)
+
+// Audience is the "aud" claim, which may be a single string or an array
+type Audience []string
+
+// Has returns true if the given audience is included
+func (aud Audience) Has(audience string) bool {
+	for _, value := range aud {
+		if value == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON encodes a single audience as a string
+func (aud Audience) MarshalJSON() ([]byte, error) {
+	if len(aud) == 1 {
+		return json.Marshal(aud[0])
+	}
+	return json.Marshal([]string(aud))
+}
+
+// UnmarshalJSON decodes the audience from either a string or an array
+func (aud *Audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*aud = Audience{single}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(aud))
+}
+
+// Claims are the claims of a user's token. The subject is the user's ID.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat"`
+	ID        string   `json:"jti,omitempty"`
+	Email     string   `json:"email,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+}
+
+// Scopes returns the scopes granted to the token
+func (claims Claims) Scopes() auth.Scopes {
+	return auth.ParseScopes(claims.Scope)
+}
+
+// User returns the user described by the claims. Services that verify
+// tokens may not have access to the users table, so only the ID and email
+// are set and the user is assumed to be active.
+func (claims Claims) User() auth.User {
+	id, _ := strconv.ParseInt(claims.Subject, 10, 64)
+	return auth.User{ID: id, Email: claims.Email, IsActive: id != 0}
+}
+
+// header is the JOSE header of a token
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Manager signs and verifies tokens. It signs with a single key but
+// verifies with every key it has been given, so that tokens signed before
+// a rotation remain valid until they expire or their key is removed.
+type Manager struct {
+	// Issuer is set as the "iss" claim of issued tokens and, if not
+	// empty, must match the "iss" claim of verified tokens
+	Issuer string
+
+	// Audience must be included in the "aud" claim of verified tokens.
+	// It is the name of this service. Managers without an audience
+	// reject every token.
+	Audience string
+
+	// TTL is the lifetime of issued tokens
+	TTL time.Duration
+
+	// Leeway is the allowed clock skew when checking times
+	Leeway time.Duration
+
+	sync.RWMutex
+	signing string
+	keys    map[string]Key
+	nowFunc func() time.Time
+}
+
+// AddKey adds a key that will be accepted during verification
+func (m *Manager) AddKey(key Key) {
+	m.Lock()
+	defer m.Unlock()
+	m.keys[key.ID] = key
+}
+
+// Rotate signs all new tokens with the given key. The previous signing
+// key is still accepted during verification until it is removed.
+func (m *Manager) Rotate(key Key) error {
+	if !key.CanSign() {
+		return fmt.Errorf("jwt: key %q cannot sign tokens", key.ID)
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.keys[key.ID] = key
+	m.signing = key.ID
+	return nil
+}
+
+// RemoveKey removes the key with the given ID. Tokens signed by the key
+// will no longer verify. The signing key cannot be removed.
+func (m *Manager) RemoveKey(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	if id == m.signing {
+		return fmt.Errorf("jwt: the signing key cannot be removed")
+	}
+	delete(m.keys, id)
+	return nil
+}
+
+// Issue signs a token for the given user that is valid for the manager's
+// TTL. The audience is the name of the service the token is meant for and
+// is required.
+func (m *Manager) Issue(user auth.User, audience string, scopes ...string) (string, error) {
+	if !user.Exists() || !user.IsActive {
+		return "", fmt.Errorf("jwt: tokens can only be issued to active users")
+	}
+	if audience == "" {
+		return "", fmt.Errorf("jwt: tokens must have an audience")
+	}
+	now := m.nowFunc()
+	claims := Claims{
+		Issuer:    m.Issuer,
+		Subject:   strconv.FormatInt(user.ID, 10),
+		ExpiresAt: now.Add(m.TTL).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        auth.RandomKeyN(16),
+		Email:     user.Email,
+		Audience:  Audience{audience},
+		Scope:     auth.NewScopes(scopes...).String(),
+	}
+	return m.Sign(claims)
+}
+
+// Sign signs the given claims with the signing key
+func (m *Manager) Sign(claims Claims) (string, error) {
+	m.RLock()
+	key := m.keys[m.signing]
+	m.RUnlock()
+
+	rawHeader, err := json.Marshal(header{Alg: key.Algorithm, Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := encode(rawHeader) + "." + encode(payload)
+	sig, err := key.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + encode(sig), nil
+}
+
+// Verify checks the signature of the given token with the key named by its
+// "kid" header and returns its claims if they are currently valid. The
+// token must have the algorithm of its key and an expiration.
+func (m *Manager) Verify(token string) (claims Claims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("jwt: malformed token")
+	}
+	rawHeader, err := decode(parts[0])
+	if err != nil {
+		return
+	}
+	var h header
+	if err = json.Unmarshal(rawHeader, &h); err != nil {
+		return claims, fmt.Errorf("jwt: malformed header: %s", err)
+	}
+
+	m.RLock()
+	key, ok := m.keys[h.Kid]
+	m.RUnlock()
+	if !ok {
+		return claims, fmt.Errorf("jwt: unknown key %q", h.Kid)
+	}
+	// The algorithm is fixed by the key, never chosen by the token
+	if h.Alg != key.Algorithm {
+		return claims, fmt.Errorf("jwt: key %q does not sign %s tokens", h.Kid, h.Alg)
+	}
+	sig, err := decode(parts[2])
+	if err != nil {
+		return
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return claims, fmt.Errorf("jwt: invalid signature")
+	}
+
+	payload, err := decode(parts[1])
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return claims, fmt.Errorf("jwt: malformed claims: %s", err)
+	}
+	return claims, m.check(claims)
+}
+
+// check validates the times, issuer and audience of the given claims
+func (m *Manager) check(claims Claims) error {
+	now := m.nowFunc()
+	if claims.ExpiresAt == 0 {
+		return fmt.Errorf("jwt: token has no expiration")
+	}
+	if !time.Unix(claims.ExpiresAt, 0).Add(m.Leeway).After(now) {
+		return fmt.Errorf("jwt: token has expired")
+	}
+	if claims.NotBefore != 0 && time.Unix(claims.NotBefore, 0).Add(-m.Leeway).After(now) {
+		return fmt.Errorf("jwt: token is not valid yet")
+	}
+	if claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).Add(-m.Leeway).After(now) {
+		return fmt.Errorf("jwt: token was issued in the future")
+	}
+	if m.Issuer != "" && claims.Issuer != m.Issuer {
+		return fmt.Errorf("jwt: unexpected issuer %q", claims.Issuer)
+	}
+	if m.Audience == "" {
+		return fmt.Errorf("jwt: the manager has no audience")
+	}
+	if !claims.Audience.Has(m.Audience) {
+		return fmt.Errorf("jwt: token is not meant for %s", m.Audience)
+	}
+	return nil
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(value string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed token: %s", err)
+	}
+	return b, nil
+}
+
+// NewManager creates a manager with the given issuer that signs tokens with
+// the given key and only verifies tokens meant for the given audience, the
+// name of this service. Tokens are valid for five minutes with thirty
+// seconds of leeway for clock skew. Services that only verify tokens should
+// create a manager with a verification key.
+func NewManager(issuer, audience string, key Key) *Manager {
+	return &Manager{
+		Issuer:   issuer,
+		Audience: audience,
+		TTL:      5 * time.Minute,
+		Leeway:   30 * time.Second,
+		signing:  key.ID,
+		keys:     map[string]Key{key.ID: key},
+		nowFunc:  time.Now,
+	}
+}
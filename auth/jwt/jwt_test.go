@@ -0,0 +1,156 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/aodin/volta/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var user = auth.User{ID: 7, Email: "a@example.com", IsActive: true}
+
+func TestAudience(t *testing.T) {
+	assert := assert.New(t)
+
+	var claims Claims
+	require.Nil(t, json.Unmarshal([]byte(`{"aud":"billing"}`), &claims))
+	assert.Equal(Audience{"billing"}, claims.Audience)
+	require.Nil(t, json.Unmarshal([]byte(`{"aud":["billing","users"]}`), &claims))
+	assert.True(claims.Audience.Has("users"))
+	assert.False(claims.Audience.Has("other"))
+
+	b, _ := json.Marshal(Audience{"billing"})
+	assert.Equal(`"billing"`, string(b))
+}
+
+func TestManager(t *testing.T) {
+	assert := assert.New(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	_, err = ConfigKey(config.Config{SecretKey: "secret"})
+	assert.NotNil(err, "Config keys should require a long secret")
+	configKey, err := ConfigKey(config.Config{
+		SecretKey: "0123456789abcdef0123456789abcdef",
+	})
+	require.Nil(t, err)
+
+	for _, key := range []Key{
+		configKey,
+		RSA("rsa", rsaKey),
+		Ed25519("ed", edKey),
+	} {
+		issuer := NewManager("users", "users", key)
+		token, err := issuer.Issue(user, "billing", "read:users", "read:users")
+		require.Nil(t, err, "%s token could not be issued", key.Algorithm)
+		_, err = issuer.Verify(token)
+		assert.NotNil(err, "Tokens for other services should fail")
+
+		verifier := NewManager("users", "billing", key)
+		claims, err := verifier.Verify(token)
+		require.Nil(t, err, "%s token failed verification", key.Algorithm)
+		assert.Equal(user.ID, claims.User().ID)
+		assert.Equal(user.Email, claims.User().Email)
+		assert.Equal(auth.Scopes{"read:users"}, claims.Scopes())
+
+		verifier.Audience = "other"
+		_, err = verifier.Verify(token)
+		assert.NotNil(err, "Other audiences should fail")
+
+		verifier.Audience = ""
+		_, err = verifier.Verify(token)
+		assert.NotNil(err, "Managers without an audience should fail")
+
+		verifier.Audience, verifier.Issuer = "billing", "other"
+		_, err = verifier.Verify(token)
+		assert.NotNil(err, "Other issuers should fail")
+
+		parts := strings.Split(token, ".")
+		_, err = verifier.Verify(parts[0] + "." + parts[1] + ".")
+		assert.NotNil(err, "Unsigned tokens should fail")
+	}
+
+	// Public keys can verify but not sign
+	verifier := NewManager("", "billing", RSAPublic("rsa", &rsaKey.PublicKey))
+	_, err = verifier.Issue(user, "billing")
+	assert.NotNil(err)
+	token, _ := NewManager("", "users", RSA("rsa", rsaKey)).Issue(user, "billing")
+	_, err = verifier.Verify(token)
+	assert.Nil(err)
+
+	m := NewManager("", "users", HMAC("a", []byte("secret")))
+	_, err = m.Issue(auth.User{ID: 1}, "billing")
+	assert.NotNil(err, "Inactive users should not be issued tokens")
+	_, err = m.Issue(user, "")
+	assert.NotNil(err, "Tokens should not be issued without an audience")
+}
+
+func TestManagerTimes(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewManager("users", "users", HMAC("a", []byte("secret")))
+	token, err := m.Issue(user, "users")
+	require.Nil(t, err)
+
+	now := time.Now()
+	m.nowFunc = func() time.Time { return now.Add(m.TTL + m.Leeway) }
+	_, err = m.Verify(token)
+	assert.NotNil(err, "Expired tokens should fail")
+
+	m.nowFunc = func() time.Time { return now.Add(m.TTL) }
+	_, err = m.Verify(token)
+	assert.Nil(err, "Expiration allows for leeway")
+
+	m.nowFunc = func() time.Time { return now.Add(-time.Minute) }
+	_, err = m.Verify(token)
+	assert.NotNil(err, "Tokens should not be valid before nbf")
+
+	m.nowFunc = time.Now
+	token, _ = m.Sign(Claims{Subject: "7"})
+	_, err = m.Verify(token)
+	assert.NotNil(err, "Tokens without expiration should fail")
+}
+
+func TestManagerRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	old := HMAC("old", []byte("old secret"))
+	m := NewManager("users", "users", old)
+	token, _ := m.Issue(user, "users")
+
+	assert.NotNil(m.Rotate(RSAPublic("public", &rsa.PublicKey{})))
+	require.Nil(t, m.Rotate(HMAC("new", []byte("new secret"))))
+	rotated, _ := m.Issue(user, "users")
+	assert.Contains(rotated, encode([]byte(`{"alg":"HS256","typ":"JWT","kid":"new"}`)))
+
+	_, err := m.Verify(token)
+	assert.Nil(err, "Tokens of the previous key should verify")
+	assert.NotNil(m.RemoveKey("new"), "The signing key cannot be removed")
+	require.Nil(t, m.RemoveKey("old"))
+	_, err = m.Verify(token)
+	assert.NotNil(err, "Tokens of removed keys should fail")
+	_, err = m.Verify(rotated)
+	assert.Nil(err)
+}
+
+func TestManagerAlgorithmConfusion(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	m := NewManager("", "users", RSAPublic("rsa", &rsaKey.PublicKey))
+
+	// Sign a token with HS256 and the RSA key ID
+	forger := NewManager("", "users", HMAC("rsa", rsaKey.PublicKey.N.Bytes()))
+	token, _ := forger.Issue(user, "users")
+	_, err = m.Verify(token)
+	assert.NotNil(t, err, "Algorithms must match the key")
+}
@@ -0,0 +1,130 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/aodin/config"
+	"github.com/aodin/volta/auth"
+)
+
+// The supported signature algorithms
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+// Key is a signing or verification key identified by its key ID, which is
+// sent as the "kid" header of every token it signs. Keys without a private
+// half can only verify tokens.
+type Key struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	private   crypto.Signer
+	public    crypto.PublicKey
+}
+
+// CanSign returns true if the key can sign tokens
+func (key Key) CanSign() bool {
+	return key.secret != nil || key.private != nil
+}
+
+// sign signs the given input with the key
+func (key Key) sign(input []byte) ([]byte, error) {
+	switch key.Algorithm {
+	case HS256:
+		if key.secret != nil {
+			mac := hmac.New(sha256.New, key.secret)
+			mac.Write(input)
+			return mac.Sum(nil), nil
+		}
+	case RS256:
+		if private, ok := key.private.(*rsa.PrivateKey); ok {
+			digest := sha256.Sum256(input)
+			return rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+		}
+	case EdDSA:
+		if private, ok := key.private.(ed25519.PrivateKey); ok {
+			return ed25519.Sign(private, input), nil
+		}
+	}
+	return nil, fmt.Errorf("jwt: key %q cannot sign %s tokens", key.ID, key.Algorithm)
+}
+
+// verify returns true if the given signature of the input is valid
+func (key Key) verify(input, sig []byte) bool {
+	switch key.Algorithm {
+	case HS256:
+		if key.secret == nil {
+			return false
+		}
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write(input)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case RS256:
+		public, ok := key.public.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], sig) == nil
+	case EdDSA:
+		public, ok := key.public.(ed25519.PublicKey)
+		return ok && len(public) == ed25519.PublicKeySize && ed25519.Verify(public, input, sig)
+	}
+	return false
+}
+
+// HMAC creates an HS256 key from the given secret. The secret must be
+// shared by every service that verifies its tokens.
+func HMAC(id string, secret []byte) Key {
+	return Key{ID: id, Algorithm: HS256, secret: secret}
+}
+
+// ConfigKey creates an HS256 key derived from the config's SecretKey,
+// which must be at least auth.MinSecretLength bytes. Its ID is a
+// fingerprint of the key, so changing the SecretKey also changes the ID.
+func ConfigKey(c config.Config) (Key, error) {
+	if err := auth.CheckSecret(c.SecretKey); err != nil {
+		return Key{}, err
+	}
+	secret := auth.DeriveKey(c.SecretKey, "auth.jwt")
+	return HMAC(auth.HashKey(string(secret))[:auth.PrefixLength], secret), nil
+}
+
+// RSA creates an RS256 signing key
+func RSA(id string, private *rsa.PrivateKey) Key {
+	return Key{
+		ID:        id,
+		Algorithm: RS256,
+		private:   private,
+		public:    &private.PublicKey,
+	}
+}
+
+// RSAPublic creates an RS256 key that can only verify tokens
+func RSAPublic(id string, public *rsa.PublicKey) Key {
+	return Key{ID: id, Algorithm: RS256, public: public}
+}
+
+// Ed25519 creates an EdDSA signing key
+func Ed25519(id string, private ed25519.PrivateKey) Key {
+	return Key{
+		ID:        id,
+		Algorithm: EdDSA,
+		private:   private,
+		public:    private.Public(),
+	}
+}
+
+// Ed25519Public creates an EdDSA key that can only verify tokens
+func Ed25519Public(id string, public ed25519.PublicKey) Key {
+	return Key{ID: id, Algorithm: EdDSA, public: public}
+}
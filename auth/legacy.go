@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Legacy hashers verify passwords imported from other systems. They
+// cannot encode new passwords: users should be migrated to the user
+// manager's hasher on their next login, which Auth.ByPassword does
+// automatically.
+//
+// Django's pbkdf2_sha256 and pbkdf2_sha1 passwords are verified by the
+// PBKDF2 hashers of the same names.
+
+// cryptPrefixes maps the identifiers of modular crypt format passwords,
+// such as "$2b$...", to the name of their registered hasher.
+var cryptPrefixes = map[string]string{
+	"2a": "bcrypt",
+	"2b": "bcrypt",
+	"2y": "bcrypt",
+	"P":  "phpass",
+	"H":  "phpass",
+}
+
+// legacyHasher is the parent of all verify-only hashers
+type legacyHasher struct {
+	BaseHasher
+}
+
+// verifyOnly marks the hasher as unable to encode passwords
+func (h *legacyHasher) verifyOnly() {}
+
+// Encode panics - legacy hashers cannot create new passwords
+func (h *legacyHasher) Encode(cleartext, salt string) string {
+	panic(fmt.Sprintf(
+		"auth: the %s hasher can only verify passwords", h.Algorithm(),
+	))
+}
+
+// BcryptHasher verifies bcrypt passwords with the $2a$, $2b$, or $2y$
+// prefix, as well as Django's "bcrypt$" passwords.
+type BcryptHasher struct {
+	legacyHasher
+}
+
+func (h *BcryptHasher) Verify(cleartext, encoded string) bool {
+	encoded = strings.TrimPrefix(encoded, h.Algorithm()+"$")
+	return bcrypt.CompareHashAndPassword(
+		[]byte(encoded), []byte(cleartext),
+	) == nil
+}
+
+// DjangoBcryptSHA256Hasher verifies Django's "bcrypt_sha256$" passwords,
+// which bcrypt the hex encoded SHA-256 digest of the cleartext.
+type DjangoBcryptSHA256Hasher struct {
+	legacyHasher
+}
+
+func (h *DjangoBcryptSHA256Hasher) Verify(cleartext, encoded string) bool {
+	if !strings.HasPrefix(encoded, h.Algorithm()+"$") {
+		return false
+	}
+	digest := sha256.Sum256([]byte(cleartext))
+	return bcrypt.CompareHashAndPassword(
+		[]byte(strings.TrimPrefix(encoded, h.Algorithm()+"$")),
+		[]byte(hex.EncodeToString(digest[:])),
+	) == nil
+}
+
+// itoa64 is the alphabet used by phpass for its base64 variant
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// maxPHPassLog2 bounds the log2 of the rounds of stored phpass hashes,
+// which phpass allows up to 30. WordPress uses 8.
+const maxPHPassLog2 = 16
+
+// PHPassHasher verifies the portable $P$ and $H$ passwords created by
+// phpass, as used by WordPress, phpBB and others.
+type PHPassHasher struct {
+	legacyHasher
+}
+
+func (h *PHPassHasher) Verify(cleartext, encoded string) bool {
+	// Prefix, log2 of the iteration count, an 8 char salt and the hash
+	if len(encoded) != 34 {
+		return false
+	}
+	if !strings.HasPrefix(encoded, "$P$") && !strings.HasPrefix(encoded, "$H$") {
+		return false
+	}
+	countLog2 := strings.IndexByte(itoa64, encoded[3])
+	if countLog2 < 7 || countLog2 > maxPHPassLog2 {
+		return false
+	}
+	salt := encoded[4:12]
+
+	hashed := md5.Sum([]byte(salt + cleartext))
+	for count := 1 << uint(countLog2); count > 0; count-- {
+		hashed = md5.Sum(append(hashed[:], cleartext...))
+	}
+	return ConstantTimeStringCompare(
+		encoded[:12]+encodePHPass(hashed[:]), encoded,
+	)
+}
+
+// encodePHPass encodes the given bytes with the phpass base64 variant
+func encodePHPass(input []byte) string {
+	var output []byte
+	for i := 0; i < len(input); i += 3 {
+		value := int(input[i])
+		output = append(output, itoa64[value&0x3f])
+		if i+1 < len(input) {
+			value |= int(input[i+1]) << 8
+		}
+		output = append(output, itoa64[(value>>6)&0x3f])
+		if i+1 >= len(input) {
+			break
+		}
+		if i+2 < len(input) {
+			value |= int(input[i+2]) << 16
+		}
+		output = append(output, itoa64[(value>>12)&0x3f])
+		if i+2 >= len(input) {
+			break
+		}
+		output = append(output, itoa64[(value>>18)&0x3f])
+	}
+	return string(output)
+}
+
+// CanEncode returns false if the given hasher can only verify passwords
+func CanEncode(hasher Hasher) bool {
+	_, verifyOnly := hasher.(interface{ verifyOnly() })
+	return !verifyOnly
+}
+
+func init() {
+	bcryptHasher := &BcryptHasher{legacyHasher{NewBaseHasher("bcrypt")}}
+	RegisterHasher(bcryptHasher.algorithm, bcryptHasher)
+
+	bcryptSHA256 := &DjangoBcryptSHA256Hasher{
+		legacyHasher{NewBaseHasher("bcrypt_sha256")},
+	}
+	RegisterHasher(bcryptSHA256.algorithm, bcryptSHA256)
+
+	phpass := &PHPassHasher{legacyHasher{NewBaseHasher("phpass")}}
+	RegisterHasher(phpass.algorithm, phpass)
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLegacyHashers(t *testing.T) {
+	assert := assert.New(t)
+
+	// Use the default hasher, other hashers should be found by prefix
+	hasher, err := GetHasher("pbkdf2_sha256")
+	assert.Nil(err, "GetHasher should not return an error")
+
+	// Django PBKDF2
+	django := "pbkdf2_sha256$260000$seasalt$9wzfIaBrAOHlfB7dk2QaX9pAVwWZnNJJq5nfgXIuT+Y="
+	assert.True(CheckPassword(hasher, "badpassword", django))
+	assert.False(CheckPassword(hasher, "goodpassword", django))
+	assert.False(NeedsRehash(hasher, django), "Stronger hashes should be kept")
+
+	// bcrypt
+	encoded, err := bcrypt.GenerateFromPassword([]byte("badpassword"), 4)
+	assert.Nil(err)
+	assert.Equal("bcrypt", Algorithm(string(encoded)))
+	assert.True(CheckPassword(hasher, "badpassword", string(encoded)))
+	assert.True(CheckPassword(hasher, "badpassword", "bcrypt$"+string(encoded)))
+	assert.False(CheckPassword(hasher, "goodpassword", string(encoded)))
+	assert.True(NeedsRehash(hasher, string(encoded)))
+
+	// Django bcrypt_sha256
+	digest := sha256.Sum256([]byte("badpassword"))
+	encoded, err = bcrypt.GenerateFromPassword(
+		[]byte(hex.EncodeToString(digest[:])), 4,
+	)
+	assert.Nil(err)
+	assert.True(CheckPassword(hasher, "badpassword", "bcrypt_sha256$"+string(encoded)))
+	assert.False(CheckPassword(hasher, "goodpassword", "bcrypt_sha256$"+string(encoded)))
+
+	// phpass
+	phpass := "$P$9IQRaTwmfeRo7ud9Fh4E2PdI0S3r.L0"
+	assert.Equal("phpass", Algorithm(phpass))
+	assert.True(CheckPassword(hasher, "test12345", phpass))
+	assert.False(CheckPassword(hasher, "test1234", phpass))
+	assert.True(CheckPassword(hasher, "badpassword", "$P$BabcdefghEzsrCXqnAxxIFGEAn16wy0"))
+	assert.False(CheckPassword(hasher, "badpassword", "$P$BabcdefghEzsrCXqnAxxIFGEAn16wy"))
+	assert.False(
+		CheckPassword(hasher, "badpassword", "$P$SabcdefghEzsrCXqnAxxIFGEAn16wy0"),
+		"Excessive rounds should be rejected rather than derived",
+	)
+	assert.Equal("", Algorithm("$Z$BabcdefghEzsrCXqnAxxIFGEAn16wy0"))
+
+	// Legacy hashers cannot create new passwords
+	bcryptHasher, err := GetHasher("bcrypt")
+	assert.Nil(err, "GetHasher should not return an error")
+	assert.Panics(func() { MakePassword(bcryptHasher, "badpassword") })
+	assert.False(CanEncode(bcryptHasher))
+	assert.True(CanEncode(hasher))
+	for _, name := range []string{"bcrypt", "bcrypt_sha256", "phpass"} {
+		assert.Panics(func() { NewUsersWithHasher(nil, name) }, name)
+	}
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aodin/config"
+)
+
+// MemorySessionStore is a SessionStore that keeps sessions in memory. It is
+// suitable for tests and single process applications - all sessions are
+// lost when the process exits. Like the SessionManager, sessions are
+// kept by ID and their keys are not stored.
+type MemorySessionStore struct {
+	sync.RWMutex
+	sessions map[string]Session
+	cookie   config.Cookie
+	keyFunc  KeyFunc
+	nowFunc  func() time.Time
+}
+
+// Create creates a new session using a key generated for the given User
+func (m *MemorySessionStore) Create(user User) Session {
+	return m.CreateFrom(user, nil)
+}
+
+// CreateFrom creates a new session using a key generated for the given
+// User and records the client of the given request.
+func (m *MemorySessionStore) CreateFrom(user User, r *http.Request) Session {
+	m.Lock()
+	defer m.Unlock()
+
+	session := newSession(user, r, m.nowFunc(), m.cookie.Age)
+	session.manager = m
+
+	// Generate a new random session key - no duplicates
+	for {
+		session.Key = m.keyFunc()
+		session.ID = HashKey(session.Key)
+		if _, duplicate := m.sessions[session.ID]; !duplicate {
+			break
+		}
+	}
+	stored := session
+	stored.Key = ""
+	m.sessions[session.ID] = stored
+	return session
+}
+
+// Get returns the session with the given key.
+func (m *MemorySessionStore) Get(key string) Session {
+	m.RLock()
+	defer m.RUnlock()
+	session, exists := m.sessions[HashKey(key)]
+	if exists {
+		session.Key = key
+	}
+	return session
+}
+
+// ListForUser returns all sessions of the user with the given ID, most
+// recently used first. Their keys are not known.
+func (m *MemorySessionStore) ListForUser(id int64) (sessions []Session) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, session := range m.sessions {
+		if session.UserID == id {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return
+}
+
+// Delete removes the session with the given key.
+func (m *MemorySessionStore) Delete(key string) error {
+	return m.DeleteByID(HashKey(key))
+}
+
+// DeleteByID removes the session with the given ID.
+func (m *MemorySessionStore) DeleteByID(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// DeleteExpired removes up to limit sessions that expired by the given
+// time and returns the number removed.
+func (m *MemorySessionStore) DeleteExpired(now time.Time, limit int) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	var removed int64
+	for id, session := range m.sessions {
+		if removed >= int64(limit) {
+			break
+		}
+		if !session.Expires.After(now) {
+			delete(m.sessions, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// DeleteForUser removes all sessions of the user with the given ID.
+func (m *MemorySessionStore) DeleteForUser(id int64) error {
+	m.Lock()
+	defer m.Unlock()
+	for sessionID, session := range m.sessions {
+		if session.UserID == id {
+			delete(m.sessions, sessionID)
+		}
+	}
+	return nil
+}
+
+// DeleteForUserExcept removes all sessions of the user with the given ID
+// except the session with the given key.
+func (m *MemorySessionStore) DeleteForUserExcept(id int64, except string) error {
+	m.Lock()
+	defer m.Unlock()
+	except = HashKey(except)
+	for sessionID, session := range m.sessions {
+		if session.UserID == id && sessionID != except {
+			delete(m.sessions, sessionID)
+		}
+	}
+	return nil
+}
+
+// Touch sets the expiration of the session with the given key and marks it
+// as last seen now.
+func (m *MemorySessionStore) Touch(key string, expires time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+	id := HashKey(key)
+	if session, exists := m.sessions[id]; exists {
+		session.Expires = expires
+		session.LastSeenAt = m.nowFunc()
+		m.sessions[id] = session
+	}
+	return nil
+}
+
+// NewMemorySessions creates an empty in-memory session store that sets
+// expiration using the given cookie config.
+func NewMemorySessions(c config.Cookie) *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]Session),
+		cookie:   c,
+		keyFunc:  RandomKey,
+		nowFunc:  func() time.Time { return time.Now().In(time.UTC) },
+	}
+}
+
+// MemorySessionStore should implement the SessionStore interface
+var _ SessionStore = &MemorySessionStore{}
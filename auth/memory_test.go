@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemory(t *testing.T) {
+	assert := assert.New(t)
+
+	auth := NewInMemory(config.Default)
+	users, err := auth.Seed(
+		SeedUser{Email: "a@example.com", Password: "secret"},
+		SeedUser{
+			Email:       "b@example.com",
+			Password:    "secret",
+			Unverified:  true,
+			Permissions: []string{"billing.refund"},
+		},
+		SeedUser{Email: "c@example.com", Password: "secret", Inactive: true},
+	)
+	require.Nil(t, err, "Error while seeding users")
+	user := users[0]
+	assert.True(user.IsVerified())
+	assert.False(users[1].IsVerified())
+	assert.True(users[1].HasPerm("billing.refund"))
+	assert.False(user.HasPerm("billing.refund"))
+
+	_, err = auth.Seed(SeedUser{Email: "a@example.com"})
+	assert.NotNil(err, "Duplicate users should not be created")
+
+	// Passwords
+	valid, err := auth.ByPassword("a@example.com", "secret")
+	require.Nil(t, err, "Could not auth by password")
+	assert.Equal(user.ID, valid.ID)
+	_, err = auth.ByPassword("a@example.com", "1234")
+	assert.NotNil(err)
+	_, err = auth.ByPassword("c@example.com", "secret")
+	assert.NotNil(err, "Inactive users should not log in")
+	_, incorrect := auth.ByPassword("c@example.com", "1234")
+	assert.Equal(incorrect, err, "Inactive users should not be revealed")
+
+	// Sessions
+	cookie, err := auth.SeedSession(user)
+	require.Nil(t, err)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	assert.Equal(user.ID, auth.BySessionCookie(httptest.NewRecorder(), r).ID)
+
+	w := httptest.NewRecorder()
+	require.Nil(t, auth.Logout(w, r))
+	assert.False(auth.BySession(cookie.Value).Exists())
+
+	// Changing the password logs out everywhere
+	cookie, _ = auth.SeedSession(user)
+	require.Nil(t, auth.ChangePassword(&user, "changed"))
+	assert.False(auth.BySession(cookie.Value).Exists())
+	_, err = auth.ByPassword("a@example.com", "changed")
+	assert.Nil(err)
+
+	// User tokens
+	assert.NotNil(auth.ResetUserToken(&User{ID: user.ID + 100}))
+	require.Nil(t, auth.ResetUserToken(&user))
+	valid, err = auth.ByUserToken(user.ID, user.Token)
+	require.Nil(t, err)
+	assert.Equal(user.ID, valid.ID)
+	stored, err := auth.UserStore().GetByID(user.ID)
+	require.Nil(t, err)
+	assert.Equal(HashKey(user.Token), stored.Token, "Only digests should be stored")
+	consumed, err := auth.UserStore().ConsumeToken(user.ID, stored.Token)
+	require.Nil(t, err)
+	assert.True(consumed)
+	consumed, _ = auth.UserStore().ConsumeToken(user.ID, stored.Token)
+	assert.False(consumed, "Tokens should only be consumed once")
+	_, err = auth.ByUserToken(user.ID, user.Token)
+	assert.NotNil(err)
+	require.Nil(t, auth.ClearUserToken(&user))
+	_, err = auth.ByUserToken(user.ID, "")
+	assert.NotNil(err)
+
+	// API tokens
+	expires := time.Now().Add(time.Hour)
+	token, err := auth.TokenStore().Create(user, "ci", &expires, "read:users")
+	require.Nil(t, err)
+	valid, scopes := auth.ByToken(user.ID, token.Key)
+	assert.Equal(user.ID, valid.ID)
+	assert.Equal(Scopes{"read:users"}, scopes)
+	assert.NotNil(auth.TokenStore().Get(token.Key).LastUsedAt, "Use should be recorded")
+
+	rotated, err := auth.TokenStore().Rotate(token.Key, 0)
+	require.Nil(t, err)
+	invalid, _ := auth.ByToken(user.ID, token.Key)
+	assert.False(invalid.Exists(), "Rotated tokens should expire")
+	valid, _ = auth.ByToken(user.ID, rotated.Key)
+	assert.Equal(user.ID, valid.ID)
+	assert.Equal(2, len(auth.TokenStore().All(user.ID)))
+
+	// Inactive users cannot use their tokens
+	inactive, err := auth.TokenStore().Create(users[2], "ci", nil)
+	require.Nil(t, err)
+	invalid, scopes = auth.ByToken(users[2].ID, inactive.Key)
+	assert.False(invalid.Exists(), "Inactive users should not authenticate")
+	assert.Nil(scopes)
+
+	// Deactivation
+	cookie, _ = auth.SeedSession(user)
+	auth.RevokeTokensOnLogout(true)
+	require.Nil(t, auth.Deactivate(&user))
+	assert.False(auth.BySession(cookie.Value).Exists())
+	assert.Equal(0, len(auth.TokenStore().All(user.ID)))
+
+	// Deleted users cannot authenticate
+	other := users[1]
+	cookie, _ = auth.SeedSession(other)
+	require.Nil(t, other.Delete())
+	assert.False(auth.BySession(cookie.Value).Exists())
+
+	// The user store ends memory sessions without the auth
+	seeded, err := auth.Seed(SeedUser{Email: "e@example.com"})
+	require.Nil(t, err)
+	member := seeded[0]
+	cookie, _ = auth.SeedSession(member)
+	require.Nil(t, auth.UserStore().SetPassword(&member, "changed"))
+	assert.False(auth.BySession(cookie.Value).Exists())
+	cookie, _ = auth.SeedSession(member)
+	require.Nil(t, auth.UserStore().RehashPassword(&member, "changed"))
+	assert.True(auth.BySession(cookie.Value).Exists(), "Rehashes should keep sessions")
+	require.Nil(t, auth.UserStore().SetActive(&member, false))
+	assert.Equal(0, len(auth.Sessions().ListForUser(member.ID)))
+
+	// Cookie sessions are revoked by the in-memory user store
+	auth.SetSessionStore(NewCookieSessions(config.DefaultCookie, auth.UserStore(), testSecret))
+	admin, err := auth.Seed(SeedUser{Email: "d@example.com", Superuser: true})
+	require.Nil(t, err)
+	cookie, err = auth.SeedSession(admin[0])
+	require.Nil(t, err)
+	assert.True(auth.BySession(cookie.Value).HasPerm("anything"))
+	require.Nil(t, auth.LogoutEverywhere(admin[0]))
+	assert.False(auth.BySession(cookie.Value).Exists())
+
+	// The user store ends cookie sessions without the auth
+	cookie, _ = auth.SeedSession(admin[0])
+	require.Nil(t, auth.UserStore().SetPassword(&admin[0], "changed"))
+	assert.False(auth.BySession(cookie.Value).Exists())
+	cookie, _ = auth.SeedSession(admin[0])
+	require.Nil(t, auth.UserStore().RehashPassword(&admin[0], "changed"))
+	assert.True(auth.BySession(cookie.Value).Exists(), "Rehashes should keep sessions")
+	require.Nil(t, auth.UserStore().SetActive(&admin[0], false))
+	assert.False(auth.BySession(cookie.Value).Exists())
+}
+
+func TestInMemoryFeatures(t *testing.T) {
+	assert := assert.New(t)
+
+	// Only the stores are kept in memory
+	auth := NewInMemory(testConfig())
+	assert.Nil(auth.Users(), "In-memory users have no user manager")
+	assert.Nil(auth.Tokens(), "In-memory tokens have no token manager")
+	assert.NotNil(auth.UserStore())
+	assert.NotNil(auth.TokenStore())
+
+	// Features with their own tables cannot be used
+	_, err := auth.EnableTOTP()
+	assert.NotNil(err, "TOTP should require a database")
+	_, err = auth.EnableWebAuthn("example.com", "Example", "https://example.com")
+	assert.NotNil(err, "WebAuthn should require a database")
+	_, err = NewOAuthServer(auth)
+	assert.NotNil(err, "The OAuth server should require a database")
+
+	oidc, err := NewOIDC(auth, OIDCProvider{Name: "test"})
+	require.Nil(t, err)
+	users, err := auth.Seed(SeedUser{Email: "a@example.com"})
+	require.Nil(t, err)
+	assert.NotNil(oidc.Link(users[0], IDToken{Subject: "1"}), "OIDC should require a database")
+	assert.False(oidc.GetIdentity("1").Exists())
+}
+
+func TestSeedSession(t *testing.T) {
+	auth := NewInMemory(config.Default)
+	users, err := auth.Seed(SeedUser{Email: "a@example.com"})
+	require.Nil(t, err)
+
+	cookie, err := auth.SeedSession(users[0])
+	require.Nil(t, err)
+	assert.Equal(t, config.Default.Cookie.Name, cookie.Name)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	assert.Equal(t, users[0].ID, auth.BySessionCookie(httptest.NewRecorder(), r).ID)
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryTokenStore is a TokenStore that keeps tokens in memory. It is
+// meant for tests - all tokens are lost when the process exits. Like the
+// TokenManager, tokens are kept by ID and their keys are not stored.
+type MemoryTokenStore struct {
+	sync.RWMutex
+	auditor
+	tokens  map[string]Token
+	keyFunc KeyFunc
+	nowFunc func() time.Time
+}
+
+// All returns all tokens of the user with the given ID, oldest first.
+// Their keys are not known.
+func (m *MemoryTokenStore) All(id int64) (tokens []Token) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, token := range m.tokens {
+		if token.UserID == id {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return
+}
+
+// Create creates a new token for the given user with the given label and
+// scopes. A nil expires creates a token that never expires.
+func (m *MemoryTokenStore) Create(user User, name string, expires *time.Time, scopes ...string) (Token, error) {
+	parsed := NewScopes(scopes...)
+	if err := checkNewToken(user, name, parsed, expires, m.nowFunc()); err != nil {
+		return Token{}, err
+	}
+	return m.create(Token{
+		UserID:  user.ID,
+		Name:    name,
+		Scopes:  parsed,
+		Expires: expires,
+	}), nil
+}
+
+// ForeverToken creates a new unnamed and unscoped token for the user that
+// never expires
+func (m *MemoryTokenStore) ForeverToken(user User) (Token, error) {
+	return m.Create(user, "", nil)
+}
+
+func (m *MemoryTokenStore) create(token Token) Token {
+	m.Lock()
+	defer m.Unlock()
+	token.manager = m
+	token.CreatedAt = m.nowFunc()
+
+	// Generate a new random token key - no duplicates
+	for {
+		token.Key = m.keyFunc()
+		token.ID = HashKey(token.Key)
+		token.Prefix = KeyPrefix(token.Key)
+		if _, duplicate := m.tokens[token.ID]; !duplicate {
+			break
+		}
+	}
+	stored := token
+	stored.Key = ""
+	m.tokens[token.ID] = stored
+	m.record(AuditEvent{
+		Action: TokenCreated,
+		UserID: token.UserID,
+		Target: token.ID,
+		At:     token.CreatedAt,
+	})
+	return token
+}
+
+// Get returns the token with the given key
+func (m *MemoryTokenStore) Get(key string) Token {
+	m.RLock()
+	defer m.RUnlock()
+	token, exists := m.tokens[HashKey(key)]
+	if exists {
+		token.Key = key
+	}
+	return token
+}
+
+// Rotate creates a replacement for the token with the given key, with the
+// same user, name, scopes and expiration. The old token keeps working for
+// the given grace period.
+func (m *MemoryTokenStore) Rotate(key string, grace time.Duration) (Token, error) {
+	old := m.Get(key)
+	if !old.Exists() || old.Expired(m.nowFunc()) {
+		return Token{}, fmt.Errorf("auth: no valid token exists with that key")
+	}
+	replacement := m.create(Token{
+		UserID:  old.UserID,
+		Name:    old.Name,
+		Scopes:  old.Scopes,
+		Expires: old.Expires,
+	})
+
+	// The grace period cannot extend the old token's expiration
+	ends := m.nowFunc().Add(grace)
+	if old.Expires != nil && old.Expires.Before(ends) {
+		return replacement, nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	if stored, exists := m.tokens[old.ID]; exists {
+		stored.Expires = &ends
+		m.tokens[old.ID] = stored
+	}
+	return replacement, nil
+}
+
+// Used records that the given token was used now
+func (m *MemoryTokenStore) Used(token *Token) error {
+	m.Lock()
+	defer m.Unlock()
+	now := m.nowFunc()
+	if stored, exists := m.tokens[token.ID]; exists {
+		stored.LastUsedAt = &now
+		m.tokens[token.ID] = stored
+	}
+	token.LastUsedAt = &now
+	return nil
+}
+
+// Delete removes the token with the given key
+func (m *MemoryTokenStore) Delete(key string) error {
+	return m.DeleteByID(HashKey(key))
+}
+
+// DeleteByID removes the token with the given ID
+func (m *MemoryTokenStore) DeleteByID(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.tokens, id)
+	m.record(AuditEvent{Action: TokenDeleted, Target: id, At: m.nowFunc()})
+	return nil
+}
+
+// DeleteExpired removes up to limit tokens that expired by the given time
+// and returns the number removed
+func (m *MemoryTokenStore) DeleteExpired(now time.Time, limit int) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	var removed int64
+	for id, token := range m.tokens {
+		if removed >= int64(limit) {
+			break
+		}
+		if token.Expired(now) {
+			delete(m.tokens, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// DeleteForUser removes all tokens of the user with the given ID
+func (m *MemoryTokenStore) DeleteForUser(id int64) error {
+	m.Lock()
+	defer m.Unlock()
+	for tokenID, token := range m.tokens {
+		if token.UserID == id {
+			delete(m.tokens, tokenID)
+		}
+	}
+	m.record(AuditEvent{
+		Action: TokenDeleted,
+		UserID: id,
+		Reason: "all tokens of user",
+		At:     m.nowFunc(),
+	})
+	return nil
+}
+
+// NewMemoryTokens creates an empty in-memory token store
+func NewMemoryTokens() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		tokens:  make(map[string]Token),
+		keyFunc: RandomKey,
+		nowFunc: time.Now,
+	}
+}
+
+// MemoryTokenStore should implement the TokenStore interface
+var _ TokenStore = &MemoryTokenStore{}
@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryUserStore is a UserStore that keeps users in memory. It is meant
+// for tests - all users are lost when the process exits. Passwords are
+// hashed with a fast mock hasher. Permissions are set per user with
+// SetPermissions rather than through groups.
+type MemoryUserStore struct {
+	sync.RWMutex
+	users     map[int64]User
+	perms     map[int64][]string
+	sessions  *MemorySessionStore
+	lastID    int64
+	hash      Hasher
+	tokenFunc KeyFunc
+	nowFunc   func() time.Time
+}
+
+// SetSessionStore sets the session store whose sessions are ended when a
+// user's password is changed or they are deactivated. Stateless cookie
+// sessions are always revoked by the user's session version.
+func (m *MemoryUserStore) SetSessionStore(sessions *MemorySessionStore) {
+	m.Lock()
+	defer m.Unlock()
+	m.sessions = sessions
+}
+
+// endSessions deletes the user's sessions from the session store
+func (m *MemoryUserStore) endSessions(id int64) error {
+	m.RLock()
+	sessions := m.sessions
+	m.RUnlock()
+	if sessions == nil {
+		return nil
+	}
+	return sessions.DeleteForUser(id)
+}
+
+// Create creates a new user with the given email and cleartext password
+func (m *MemoryUserStore) Create(email, first, last, clear string) (User, error) {
+	return m.create(email, first, last, clear, false)
+}
+
+// CreateSuperuser creates a new superuser with the given email and
+// cleartext password
+func (m *MemoryUserStore) CreateSuperuser(email, first, last, clear string) (User, error) {
+	return m.create(email, first, last, clear, true)
+}
+
+func (m *MemoryUserStore) create(email, first, last, clear string, isAdmin bool) (User, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, user := range m.users {
+		if user.Email == email {
+			return User{}, fmt.Errorf(
+				"auth: user with email %s already exists", email,
+			)
+		}
+	}
+
+	now := m.nowFunc()
+	token := m.tokenFunc()
+	m.lastID++
+	user := User{
+		ID:          m.lastID,
+		Email:       email,
+		FirstName:   first,
+		LastName:    last,
+		IsActive:    true,
+		IsSuperuser: isAdmin,
+		Password:    MakePassword(m.hash, clear),
+		Token:       HashKey(token),
+		TokenSetAt:  now,
+		CreatedAt:   now,
+	}
+	m.users[user.ID] = user
+	m.attach(&user)
+	user.Token = token // Only the digest is stored
+	return user, nil
+}
+
+// Delete removes the user with the given ID
+func (m *MemoryUserStore) Delete(id int64) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.users, id)
+	delete(m.perms, id)
+	return nil
+}
+
+// GetByEmail returns the user with the given email
+func (m *MemoryUserStore) GetByEmail(email string) (User, error) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, user := range m.users {
+		if user.Email == email {
+			m.attach(&user)
+			return user, nil
+		}
+	}
+	return User{}, fmt.Errorf("auth: no user with email %s exists", email)
+}
+
+// GetByID returns the user with the given ID
+func (m *MemoryUserStore) GetByID(id int64) (User, error) {
+	m.RLock()
+	defer m.RUnlock()
+	user, exists := m.users[id]
+	if !exists {
+		return User{}, fmt.Errorf("auth: no user with id %d exists", id)
+	}
+	m.attach(&user)
+	return user, nil
+}
+
+// All returns all users ordered by ID
+func (m *MemoryUserStore) All() (users []User) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, user := range m.users {
+		m.attach(&user)
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return
+}
+
+// attach sets the store of the given user and gives it an empty
+// permission cache
+func (m *MemoryUserStore) attach(user *User) {
+	user.manager = m
+	user.perms = &permCache{}
+}
+
+// update applies the given change to the stored user with the given ID
+func (m *MemoryUserStore) update(id int64, change func(*User)) error {
+	m.Lock()
+	defer m.Unlock()
+	user, exists := m.users[id]
+	if !exists {
+		return fmt.Errorf("auth: no user with id %d exists", id)
+	}
+	change(&user)
+	m.users[id] = user
+	return nil
+}
+
+// Hasher returns the hasher used by the store
+func (m *MemoryUserStore) Hasher() Hasher {
+	return m.hash
+}
+
+// SetPassword hashes the given cleartext password and saves it to the
+// given user
+func (m *MemoryUserStore) SetPassword(user *User, cleartext string) error {
+	password := MakePassword(m.hash, cleartext)
+	var version int64
+	err := m.update(user.ID, func(stored *User) {
+		stored.Password = password
+		stored.SessionVersion++
+		version = stored.SessionVersion
+	})
+	if err != nil {
+		return err
+	}
+	user.Password, user.SessionVersion = password, version
+	return m.endSessions(user.ID)
+}
+
+// RehashPassword hashes and saves the user's current cleartext password
+// without ending their sessions
+func (m *MemoryUserStore) RehashPassword(user *User, cleartext string) error {
+	password := MakePassword(m.hash, cleartext)
+	err := m.update(user.ID, func(stored *User) { stored.Password = password })
+	if err != nil {
+		return err
+	}
+	user.Password = password
+	return nil
+}
+
+// SetVerified marks the email address of the given user as verified at
+// the given time
+func (m *MemoryUserStore) SetVerified(user *User, at time.Time) error {
+	err := m.update(user.ID, func(stored *User) { stored.EmailVerifiedAt = &at })
+	if err != nil {
+		return err
+	}
+	user.EmailVerifiedAt = &at
+	return nil
+}
+
+// SetActive sets whether the given user is active
+func (m *MemoryUserStore) SetActive(user *User, active bool) error {
+	var version int64
+	err := m.update(user.ID, func(stored *User) {
+		stored.IsActive = active
+		if !active {
+			stored.SessionVersion++
+		}
+		version = stored.SessionVersion
+	})
+	if err != nil {
+		return err
+	}
+	user.IsActive, user.SessionVersion = active, version
+	if active {
+		return nil
+	}
+	return m.endSessions(user.ID)
+}
+
+// SetToken saves the given user token and the time it was set
+func (m *MemoryUserStore) SetToken(user *User, token string, at time.Time) error {
+	err := m.update(user.ID, func(stored *User) {
+		stored.Token, stored.TokenSetAt = token, at
+	})
+	if err != nil {
+		return err
+	}
+	user.Token, user.TokenSetAt = token, at
+	return nil
+}
+
+// ConsumeToken clears the token of the user with the given ID if it is the
+// given token, and returns true if this call cleared it
+func (m *MemoryUserStore) ConsumeToken(id int64, token string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	user, exists := m.users[id]
+	if !exists || token == "" || user.Token != token {
+		return false, nil
+	}
+	user.Token = ""
+	m.users[id] = user
+	return true, nil
+}
+
+// ClearTokensBefore clears up to limit user tokens that were set before
+// the given time and returns the number cleared
+func (m *MemoryUserStore) ClearTokensBefore(before time.Time, limit int) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	var cleared int64
+	for id, user := range m.users {
+		if cleared >= int64(limit) {
+			break
+		}
+		if user.Token != "" && user.TokenSetAt.Before(before) {
+			user.Token = ""
+			m.users[id] = user
+			cleared++
+		}
+	}
+	return cleared, nil
+}
+
+// BumpSessionVersion increments the session version of the user with the
+// given ID
+func (m *MemoryUserStore) BumpSessionVersion(id int64) error {
+	return m.update(id, func(stored *User) { stored.SessionVersion++ })
+}
+
+// SetPermissions replaces the permissions of the user with the given ID
+func (m *MemoryUserStore) SetPermissions(id int64, names ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.perms[id] = append([]string(nil), names...)
+}
+
+// Permissions returns the names of the permissions of the user with the
+// given ID
+func (m *MemoryUserStore) Permissions(id int64) []string {
+	m.RLock()
+	defer m.RUnlock()
+	return append([]string(nil), m.perms[id]...)
+}
+
+// NewMemoryUsers creates an empty in-memory user store
+func NewMemoryUsers() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:     make(map[int64]User),
+		perms:     make(map[int64][]string),
+		hash:      MockHasher("mock", 1, sha1.New),
+		tokenFunc: RandomKey,
+		nowFunc:   func() time.Time { return time.Now().In(time.UTC) },
+	}
+}
+
+// MemoryUserStore should implement the UserStore interface
+var _ UserStore = &MemoryUserStore{}
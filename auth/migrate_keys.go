@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/aodin/sol"
+)
+
+// addTokenPrefix adds the lookup prefix column to a tokens table created
+// before keys were hashed, using the tokens prefix migration of the given
+// dialect. Only Postgres can skip adding a column that exists, so other
+// databases are first checked for the column.
+func addTokenPrefix(conn sol.Conn, d Dialect) error {
+	migrations, err := Migrations(d)
+	if err != nil {
+		return err
+	}
+	var add *Migration
+	for i := range migrations {
+		if migrations[i].Name == "tokens_prefix" {
+			add = &migrations[i]
+		}
+	}
+	if add == nil {
+		return fmt.Errorf("auth: there is no tokens prefix migration")
+	}
+	if d.Name != Postgres.Name {
+		var prefixes []string
+		stmt := sol.Select(Tokens.C("prefix")).Limit(1)
+		if conn.Query(stmt, &prefixes) == nil {
+			return nil // The column exists
+		}
+	}
+	for _, stmt := range add.Up {
+		if err = conn.Query(sol.Text(stmt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HashStoredKeys migrates sessions, tokens and user tokens created before
+// they were hashed: the tokens table is given its prefix column and every
+// raw key is replaced by its digest. Existing cookies, API keys and
+// password reset links remain valid. It is safe to run more than once. The given dialect must match
+// the connection, and its sol package must be imported.
+func HashStoredKeys(conn sol.Conn, d Dialect) error {
+	if err := addTokenPrefix(conn, d); err != nil {
+		return err
+	}
+
+	var sessions []string
+	if err := conn.Query(sol.Select(Sessions.C("key")), &sessions); err != nil {
+		return err
+	}
+	for _, key := range sessions {
+		if isDigest(key) {
+			continue
+		}
+		stmt := Sessions.Update().Values(
+			sol.Values{"key": HashKey(key)},
+		).Where(Sessions.C("key").Equals(key))
+		if err := conn.Query(stmt); err != nil {
+			return err
+		}
+	}
+
+	var tokens []string
+	if err := conn.Query(sol.Select(Tokens.C("key")), &tokens); err != nil {
+		return err
+	}
+	for _, key := range tokens {
+		if isDigest(key) {
+			continue
+		}
+		stmt := Tokens.Update().Values(
+			sol.Values{"key": HashKey(key), "prefix": KeyPrefix(key)},
+		).Where(Tokens.C("key").Equals(key))
+		if err := conn.Query(stmt); err != nil {
+			return err
+		}
+	}
+
+	var users []User
+	stmt := sol.Select(Users.C("id"), Users.C("token")).Where(
+		Users.C("token").DoesNotEqual(""),
+	)
+	if err := conn.Query(stmt, &users); err != nil {
+		return err
+	}
+	for _, user := range users {
+		if isDigest(user.Token) {
+			continue
+		}
+		stmt := Users.Update().Values(
+			sol.Values{"token": HashKey(user.Token)},
+		).Where(
+			Users.C("id").Equals(user.ID),
+			Users.C("token").Equals(user.Token),
+		)
+		if err := conn.Query(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aodin/sol"
+	"github.com/aodin/sol/dialect"
+)
+
+// SchemaVersion is the version of the users, sessions and tokens tables
+// declared by this package, which is the version of their last migration.
+const SchemaVersion = 8
+
+// Migration is a numbered change to the users, sessions and tokens tables
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// Filename returns the name of the migration's goose SQL file
+func (m Migration) Filename() string {
+	return fmt.Sprintf("%05d_auth_%s.sql", m.Version, m.Name)
+}
+
+// SQL returns the migration as a goose SQL migration
+func (m Migration) SQL() string {
+	var sql strings.Builder
+	sql.WriteString("-- +goose Up\n")
+	for _, stmt := range m.Up {
+		sql.WriteString(strings.TrimSuffix(strings.TrimSpace(stmt), ";") + ";\n")
+	}
+	sql.WriteString("\n-- +goose Down\n")
+	for _, stmt := range m.Down {
+		sql.WriteString(strings.TrimSuffix(strings.TrimSpace(stmt), ";") + ";\n")
+	}
+	return sql.String()
+}
+
+// addedColumn is a column added to a table after it was created. Fill is
+// the default that sets the column of existing rows, and created columns
+// are filled with the dialect's epoch.
+type addedColumn struct {
+	name    string
+	fill    string
+	created bool
+}
+
+// retypedColumn is a column whose type was changed after its table was
+// created, by the dialect's alterType
+type retypedColumn struct {
+	name string
+	to   string
+	from string
+}
+
+// upgrade adds columns to, or changes the types of columns of, one of the
+// tables
+type upgrade struct {
+	name    string
+	table   string
+	columns []addedColumn
+	retyped []retypedColumn
+}
+
+// upgrades are the columns added to the tables since they were created,
+// oldest first: the first upgrade is version 2. A column added to a table
+// declaration must be added here along with a new SchemaVersion.
+//
+// The key and scopes columns were unbounded VARCHARs in postgres tables
+// created before volta had migrations. Their keys must be hashed by
+// HashStoredKeys before the key columns are limited to digests.
+var upgrades = []upgrade{
+	{name: "users_email_verified_at", table: "users", columns: []addedColumn{
+		{name: "email_verified_at"},
+	}},
+	{name: "users_session_version", table: "users", columns: []addedColumn{
+		{name: "session_version"},
+	}},
+	{name: "sessions_client", table: "sessions", columns: []addedColumn{
+		{name: "created_at", created: true},
+		{name: "last_seen_at", created: true},
+		{name: "ip", fill: "''"},
+		{name: "user_agent", fill: "''"},
+	}},
+	{name: "tokens_prefix", table: "tokens", columns: []addedColumn{
+		{name: "prefix", fill: "''"},
+	}},
+	{name: "tokens_name_scopes", table: "tokens", columns: []addedColumn{
+		{name: "name", fill: "''"},
+		{name: "scopes", fill: "''"},
+		{name: "last_used_at"},
+	}},
+	{name: "sessions_key_type", table: "sessions", retyped: []retypedColumn{
+		{name: "key", to: "VARCHAR(64)", from: "VARCHAR"},
+	}},
+	{name: "tokens_key_scopes_types", table: "tokens", retyped: []retypedColumn{
+		{name: "key", to: "VARCHAR(64)", from: "VARCHAR"},
+		{name: "scopes", to: "TEXT", from: "VARCHAR"},
+	}},
+}
+
+// Migrations returns the migrations of the users, sessions and tokens
+// tables for the given dialect, oldest first. The first migration creates
+// the tables if they do not exist, so databases created before volta had
+// migrations are upgraded from their existing tables. The tokens prefix
+// migration does not hash stored keys, see HashStoredKeys. Only postgres
+// tables need their column types changed, so those migrations are empty
+// for the other dialects.
+//
+// The sol package of the dialect must be imported so it is registered.
+func Migrations(d Dialect) ([]Migration, error) {
+	compiler, err := dialect.Get(d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	create := Migration{Version: 1, Name: "create_tables"}
+	tables := schemaAt(d, create.Version)
+	for i, table := range tables {
+		stmt, err := table.Create().IfNotExists().Compile(compiler, sol.Params())
+		if err != nil {
+			return nil, err
+		}
+		create.Up = append(create.Up, stmt)
+		drop := tables[len(tables)-1-i]
+		create.Down = append(create.Down, fmt.Sprintf("DROP TABLE %s", drop.Name()))
+	}
+	migrations := []Migration{create}
+
+	for i, change := range upgrades {
+		m := Migration{Version: i + 2, Name: change.name}
+		var table *sol.TableElem
+		for _, declared := range schemaAt(d, m.Version) {
+			if declared.Name() == change.table {
+				table = declared
+			}
+		}
+		if table == nil {
+			return nil, fmt.Errorf("auth: migration %d changes unknown table %s", m.Version, change.table)
+		}
+		for _, column := range change.columns {
+			definition, err := table.C(column.name).Type().Create(compiler)
+			if err != nil {
+				return nil, err
+			}
+			fill := column.fill
+			if column.created {
+				fill = d.epoch
+			}
+			if fill != "" {
+				definition += " DEFAULT " + fill
+			}
+			m.Up = append(m.Up, fmt.Sprintf(
+				"ALTER TABLE %s %s %s %s",
+				change.table, d.addColumn, column.name, definition,
+			))
+			m.Down = append([]string{fmt.Sprintf(
+				"ALTER TABLE %s DROP COLUMN %s", change.table, column.name,
+			)}, m.Down...)
+		}
+		for _, column := range change.retyped {
+			if d.alterType == "" {
+				continue
+			}
+			m.Up = append(m.Up, fmt.Sprintf(
+				d.alterType, change.table, column.name, column.to,
+			))
+			m.Down = append([]string{fmt.Sprintf(
+				d.alterType, change.table, column.name, column.from,
+			)}, m.Down...)
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+// WriteMigrations writes the migrations of the given dialect as goose SQL
+// files to the given directory and returns the names of the files it
+// wrote. Existing migration files are left as they are, but an error is
+// returned if one no longer matches its migration, since the tables would
+// drift from their declarations. Use a separate goose version table for
+// the directory if the application has migrations of its own.
+func WriteMigrations(dir string, d Dialect) (written []string, err error) {
+	migrations, err := Migrations(d)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range migrations {
+		path := filepath.Join(dir, m.Filename())
+		existing, err := ioutil.ReadFile(path)
+		if err == nil {
+			if string(existing) != m.SQL() {
+				return written, fmt.Errorf(
+					"auth: %s does not match migration %d", path, m.Version,
+				)
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return written, err
+		}
+		if err = ioutil.WriteFile(path, []byte(m.SQL()), 0644); err != nil {
+			return written, err
+		}
+		written = append(written, m.Filename())
+	}
+	return written, nil
+}
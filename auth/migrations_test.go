@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aodin/sol/dialect"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// columnDDL returns the compiled definition of each column of the given
+// table, by column name
+func columnDDL(t *testing.T, d Dialect, version int, name string) map[string]string {
+	compiler, err := dialect.Get(d.Name)
+	require.Nil(t, err)
+	columns := make(map[string]string)
+	for _, table := range schemaAt(d, version) {
+		if table.Name() != name {
+			continue
+		}
+		for _, column := range table.Columns() {
+			ddl, err := column.Type().Create(compiler)
+			require.Nil(t, err)
+			columns[column.Name()] = ddl
+		}
+	}
+	return columns
+}
+
+func TestMigrations(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, d := range []Dialect{Postgres, SQLite, MySQL} {
+		migrations, err := Migrations(d)
+		require.Nil(t, err, "Error while building %s migrations", d.Name)
+		require.Equal(t, SchemaVersion, len(migrations))
+		for i, m := range migrations {
+			assert.Equal(i+1, m.Version)
+			assert.True(strings.HasSuffix(m.Filename(), ".sql"))
+			assert.Contains(m.SQL(), "-- +goose Up")
+			assert.Contains(m.SQL(), "-- +goose Down")
+			assert.Equal(len(m.Up), len(m.Down))
+		}
+		assert.Equal("00001_auth_create_tables.sql", migrations[0].Filename())
+	}
+
+	// The migrations must add every column added to the declarations, as
+	// it was declared when it was added
+	for _, d := range []Dialect{Postgres, SQLite, MySQL} {
+		for _, table := range []string{"users", "sessions", "tokens"} {
+			columns := columnDDL(t, d, 1, table)
+			for i, change := range upgrades {
+				if change.table != table {
+					continue
+				}
+				added := columnDDL(t, d, i+2, table)
+				for _, column := range change.columns {
+					columns[column.name] = added[column.name]
+				}
+			}
+			assert.Equal(columnDDL(t, d, SchemaVersion, table), columns,
+				"%s migrations of the %s table drifted from its declaration",
+				d.Name, table,
+			)
+		}
+	}
+
+	// MySQL does not allow TEXT columns a default, timestamps are DATETIME
+	// and the reserved key columns are quoted
+	migrations, err := Migrations(MySQL)
+	require.Nil(t, err)
+	for _, m := range migrations[1:] {
+		assert.NotContains(m.SQL(), "TEXT", "Migration %d", m.Version)
+	}
+	for _, m := range migrations {
+		assert.NotContains(m.SQL(), "TIMESTAMP", "Migration %d", m.Version)
+	}
+	assert.Contains(migrations[0].SQL(), "`key` VARCHAR(64)")
+
+	// Only postgres tables predate the current column types
+	migrations, err = Migrations(Postgres)
+	require.Nil(t, err)
+	assert.Equal([]string{
+		"ALTER TABLE tokens ALTER COLUMN key TYPE VARCHAR(64)",
+		"ALTER TABLE tokens ALTER COLUMN scopes TYPE TEXT",
+	}, migrations[SchemaVersion-1].Up)
+	migrations, err = Migrations(SQLite)
+	require.Nil(t, err)
+	assert.Equal(0, len(migrations[SchemaVersion-1].Up))
+}
+
+func TestWriteMigrations(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	written, err := WriteMigrations(dir, Postgres)
+	require.Nil(t, err)
+	assert.Equal(SchemaVersion, len(written))
+
+	again, err := WriteMigrations(dir, Postgres)
+	require.Nil(t, err)
+	assert.Equal(0, len(again), "Existing migrations should not be written")
+
+	// Modified migrations are an error
+	path := filepath.Join(dir, written[0])
+	require.Nil(t, ioutil.WriteFile(path, []byte("-- +goose Up\n"), 0644))
+	_, err = WriteMigrations(dir, Postgres)
+	assert.NotNil(err, "Modified migrations should error")
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aodin/config"
+	"github.com/aodin/sol"
+	_ "github.com/aodin/sol/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMySQLMigrations runs the MySQL migrations against the server given
+// by VOLTA_MYSQL, such as "root@tcp(localhost:3306)/volta_test?parseTime=true"
+// with a UTC time zone and strict mode. It is skipped without a server.
+func TestMySQLMigrations(t *testing.T) {
+	credentials := os.Getenv("VOLTA_MYSQL")
+	if credentials == "" {
+		t.Skip("VOLTA_MYSQL is not set")
+	}
+	conn, err := sol.Open("mysql", credentials)
+	require.Nil(t, err, "Failed to open a MySQL connection")
+	defer conn.Close()
+
+	migrations, err := Migrations(MySQL)
+	require.Nil(t, err)
+	for _, m := range migrations {
+		for _, stmt := range m.Up {
+			require.Nil(t, conn.Query(sol.Text(stmt)), "Failed migration %d", m.Version)
+		}
+	}
+	defer func() {
+		for i := len(migrations) - 1; i >= 0; i-- {
+			for _, stmt := range migrations[i].Down {
+				assert.Nil(t, conn.Query(sol.Text(stmt)), "Failed to revert migration %d", migrations[i].Version)
+			}
+		}
+	}()
+
+	// The migrated tables match their declarations
+	auth := Mock(config.Default, conn)
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+	session := auth.Sessions().Create(user)
+	require.True(t, session.Exists())
+	assert.Equal(t, user.ID, auth.BySession(session.Key).ID)
+	token, err := auth.Tokens().Create(user, "ci", nil, "read:users")
+	require.Nil(t, err)
+	valid, _ := auth.ByToken(user.ID, token.Key)
+	assert.Equal(t, user.ID, valid.ID)
+}
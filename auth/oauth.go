@@ -0,0 +1,569 @@
+package auth
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aodin/sol"
+	"github.com/aodin/sol/postgres"
+	"github.com/aodin/sol/types"
+)
+
+// OAuthError is an OAuth 2.0 error response, such as "invalid_grant"
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Error implements the error interface
+func (err OAuthError) Error() string {
+	if err.Description == "" {
+		return "auth: oauth " + err.Code
+	}
+	return fmt.Sprintf("auth: oauth %s: %s", err.Code, err.Description)
+}
+
+func oauthError(code, format string, args ...interface{}) OAuthError {
+	return OAuthError{Code: code, Description: fmt.Sprintf(format, args...)}
+}
+
+// OAuthClient is a registered third-party client of the OAuth server.
+// Public clients, such as mobile apps, have no secret and can only use the
+// authorization code grant. Only a digest of the secret is stored.
+type OAuthClient struct {
+	ID           string    `db:"id"`
+	Secret       string    `db:"secret"`
+	OwnerID      int64     `db:"owner_id"`
+	Name         string    `db:"name"`
+	RedirectURIs string    `db:"redirect_uris"`
+	Scopes       Scopes    `db:"scopes"`
+	CreatedAt    time.Time `db:"created_at,omitempty"`
+}
+
+// Exists returns true if the client exists
+func (client OAuthClient) Exists() bool {
+	return client.ID != ""
+}
+
+// IsPublic returns true if the client has no secret
+func (client OAuthClient) IsPublic() bool {
+	return client.Secret == ""
+}
+
+// AllowsRedirect returns true if the given URI exactly matches one of the
+// client's registered redirect URIs
+func (client OAuthClient) AllowsRedirect(uri string) bool {
+	for _, allowed := range strings.Fields(client.RedirectURIs) {
+		if allowed == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// OAuthClients is the postgres schema for OAuth clients
+var OAuthClients = postgres.Table("oauth_clients",
+	sol.Column("id", types.Varchar().Limit(64).NotNull()),
+	sol.Column("secret", types.Varchar().Limit(64).NotNull()),
+	sol.ForeignKey(
+		"owner_id",
+		Users.C("id"),
+		types.Integer().NotNull(),
+	).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+	sol.Column("name", types.Varchar().Limit(128).NotNull()),
+	sol.Column("redirect_uris", types.Varchar().Limit(2048).NotNull()),
+	sol.Column("scopes", types.Varchar().NotNull()),
+	sol.Column(
+		"created_at",
+		postgres.Timestamp().WithTimezone().NotNull().Default(postgres.Now),
+	),
+	sol.PrimaryKey("id"),
+)
+
+// oauthGrant is a stored authorization code or refresh token. Only a
+// digest of its key is stored.
+type oauthGrant struct {
+	ID          string    `db:"key"`
+	ClientID    string    `db:"client_id"`
+	UserID      int64     `db:"user_id"`
+	Scopes      Scopes    `db:"scopes"`
+	RedirectURI string    `db:"redirect_uri"`
+	Challenge   string    `db:"challenge"`
+	Expires     time.Time `db:"expires"`
+}
+
+func (grant oauthGrant) Exists() bool {
+	return grant.ID != ""
+}
+
+func oauthGrantTable(name string) *sol.TableElem {
+	return postgres.Table(name,
+		sol.Column("key", types.Varchar().NotNull()),
+		sol.ForeignKey(
+			"client_id",
+			OAuthClients.C("id"),
+			types.Varchar().Limit(64).NotNull(),
+		).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+		sol.ForeignKey(
+			"user_id",
+			Users.C("id"),
+			types.Integer().NotNull(),
+		).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+		sol.Column("scopes", types.Varchar().NotNull()),
+		sol.Column("redirect_uri", types.Varchar().Limit(1024).NotNull()),
+		sol.Column("challenge", types.Varchar().Limit(128).NotNull()),
+		sol.Column("expires", postgres.Timestamp().WithTimezone().NotNull()),
+		sol.PrimaryKey("key"),
+	)
+}
+
+// OAuthCodes is the postgres schema for single use authorization codes
+var OAuthCodes = oauthGrantTable("oauth_codes")
+
+// OAuthRefreshTokens is the postgres schema for refresh tokens
+var OAuthRefreshTokens = oauthGrantTable("oauth_refresh_tokens")
+
+// AuthorizationRequest is a validated request for a user's consent to
+// issue a client an authorization code
+type AuthorizationRequest struct {
+	Client      OAuthClient
+	RedirectURI string
+	Scopes      Scopes
+	State       string
+	Challenge   string
+}
+
+// Redirect returns the redirect URI with the given parameters and the
+// request's state added to its query
+func (req AuthorizationRequest) Redirect(values url.Values) string {
+	if req.State != "" {
+		values.Set("state", req.State)
+	}
+	separator := "?"
+	if strings.Contains(req.RedirectURI, "?") {
+		separator = "&"
+	}
+	return req.RedirectURI + separator + values.Encode()
+}
+
+// Deny returns the redirect URI for a user that refused consent
+func (req AuthorizationRequest) Deny() string {
+	return req.Redirect(url.Values{"error": {"access_denied"}})
+}
+
+// Values returns the request as the query of an authorization request, so
+// it can be carried through a consent form
+func (req AuthorizationRequest) Values() url.Values {
+	values := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {req.Client.ID},
+		"redirect_uri":          {req.RedirectURI},
+		"scope":                 {req.Scopes.String()},
+		"code_challenge":        {req.Challenge},
+		"code_challenge_method": {"S256"},
+	}
+	if req.State != "" {
+		values.Set("state", req.State)
+	}
+	return values
+}
+
+// OAuthToken is the response of the token endpoint. Access tokens are of
+// the form "<user id>.<key>" so they are accepted as Bearer tokens by
+// Auth.ByToken.
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+// Introspection is the response of the introspection endpoint
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Expires   int64  `json:"exp,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+}
+
+// oauthTokenPrefix prefixes the names of access tokens issued to clients
+const oauthTokenPrefix = "oauth:"
+
+// OAuthServer is an OAuth 2.0 authorization server for third-party API
+// clients. It supports the authorization code grant with PKCE, the client
+// credentials grant and refresh tokens. Access tokens are API tokens of
+// the auth's token manager, scoped and named for their client.
+type OAuthServer struct {
+	auth    *Auth
+	consent []byte
+	nowFunc func() time.Time
+
+	CodeTTL    time.Duration
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// RegisterClient registers a new client owned by the given user. Clients
+// are limited to the given scopes. Confidential clients are returned with
+// their cleartext secret, which cannot be retrieved again.
+func (s *OAuthServer) RegisterClient(owner User, name string, redirectURIs []string, scopes []string, confidential bool) (client OAuthClient, secret string, err error) {
+	if !owner.Exists() {
+		err = fmt.Errorf("auth: oauth clients must have an owner")
+		return
+	}
+	for _, uri := range redirectURIs {
+		parsed, parseErr := url.Parse(uri)
+		if parseErr != nil || !parsed.IsAbs() || parsed.Fragment != "" || strings.ContainsAny(uri, " \t\n") {
+			err = fmt.Errorf("auth: invalid redirect URI %q", uri)
+			return
+		}
+	}
+	client = OAuthClient{
+		ID:           RandomKey(),
+		OwnerID:      owner.ID,
+		Name:         name,
+		RedirectURIs: strings.Join(redirectURIs, " "),
+		Scopes:       NewScopes(scopes...),
+	}
+	if confidential {
+		secret = RandomKey()
+		client.Secret = HashKey(secret)
+	}
+	err = s.auth.conn.Query(OAuthClients.Insert().Values(client))
+	return
+}
+
+// GetClient returns the client with the given ID
+func (s *OAuthServer) GetClient(id string) (client OAuthClient) {
+	stmt := OAuthClients.Select().Where(OAuthClients.C("id").Equals(id))
+	s.auth.conn.Query(stmt, &client)
+	return
+}
+
+// DeleteClient removes the client with the given ID along with all of its
+// codes, refresh tokens and access tokens
+func (s *OAuthServer) DeleteClient(id string) error {
+	stmt := Tokens.Delete().Where(
+		Tokens.C("name").Equals(oauthTokenPrefix + id),
+	)
+	if err := s.auth.conn.Query(stmt); err != nil {
+		return err
+	}
+	return s.auth.conn.Query(
+		OAuthClients.Delete().Where(OAuthClients.C("id").Equals(id)),
+	)
+}
+
+// AuthenticateClient returns the client with the given ID if the given
+// secret is correct. Public clients authenticate with their ID alone.
+func (s *OAuthServer) AuthenticateClient(id, secret string) (OAuthClient, error) {
+	client := s.GetClient(id)
+	if !client.Exists() {
+		return client, oauthError("invalid_client", "unknown client")
+	}
+	if client.IsPublic() {
+		if secret != "" {
+			return OAuthClient{}, oauthError("invalid_client", "public clients have no secret")
+		}
+		return client, nil
+	}
+	if !ConstantTimeStringCompare(HashKey(secret), client.Secret) {
+		return OAuthClient{}, oauthError("invalid_client", "incorrect client secret")
+	}
+	return client, nil
+}
+
+// allowedScopes returns the requested scopes if the client may request
+// them. If none were requested, all of the client's scopes are returned.
+func allowedScopes(client OAuthClient, requested Scopes) (Scopes, error) {
+	if len(requested) == 0 {
+		return client.Scopes, nil
+	}
+	for _, scope := range requested {
+		if !client.Scopes.Has(scope) {
+			return nil, oauthError("invalid_scope", "scope %s is not allowed", scope)
+		}
+	}
+	return requested, nil
+}
+
+// ParseAuthorization validates the given authorization request query.
+// Errors about the client or redirect URI must be shown to the user,
+// never redirected.
+func (s *OAuthServer) ParseAuthorization(values url.Values) (req AuthorizationRequest, err error) {
+	req.Client = s.GetClient(values.Get("client_id"))
+	if !req.Client.Exists() {
+		err = oauthError("invalid_client", "unknown client")
+		return
+	}
+	req.RedirectURI = values.Get("redirect_uri")
+	if !req.Client.AllowsRedirect(req.RedirectURI) {
+		err = oauthError("invalid_request", "redirect URI is not registered")
+		return
+	}
+	req.State = values.Get("state")
+	if values.Get("response_type") != "code" {
+		err = oauthError("unsupported_response_type", "only code is supported")
+		return
+	}
+
+	// PKCE is required of every client, and the plain method is refused
+	req.Challenge = values.Get("code_challenge")
+	if len(req.Challenge) != 43 || values.Get("code_challenge_method") != "S256" {
+		err = oauthError("invalid_request", "an S256 code challenge is required")
+		return
+	}
+	req.Scopes, err = allowedScopes(req.Client, ParseScopes(values.Get("scope")))
+	return
+}
+
+// consentValue is the value signed by consent tokens
+func consentValue(req AuthorizationRequest, user User, expires int64) string {
+	digest := HashKey(req.Values().Encode())
+	return fmt.Sprintf("%d:%s:%d", user.ID, digest, expires)
+}
+
+// ConsentToken returns a token that must be submitted with the user's
+// consent to the given request, protecting the consent form from cross
+// site request forgery.
+func (s *OAuthServer) ConsentToken(req AuthorizationRequest, user User) string {
+	expires := s.nowFunc().Add(s.CodeTTL).Unix()
+	return Sign(s.consent, consentValue(req, user, expires))
+}
+
+// CheckConsent returns true if the given consent token was created for
+// the given request and user and has not expired
+func (s *OAuthServer) CheckConsent(req AuthorizationRequest, user User, token string) bool {
+	value, ok := Unsign(s.consent, token)
+	if !ok {
+		return false
+	}
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return false
+	}
+	expires, err := strconv.ParseInt(value[i+1:], 10, 64)
+	if err != nil || !s.nowFunc().Before(time.Unix(expires, 0)) {
+		return false
+	}
+	return ConstantTimeStringCompare(value, consentValue(req, user, expires))
+}
+
+// Approve issues an authorization code for the given request and user and
+// returns the URI that the user should be redirected to
+func (s *OAuthServer) Approve(req AuthorizationRequest, user User) (string, error) {
+	if !user.Exists() || !user.IsActive {
+		return "", fmt.Errorf("auth: only active users can approve clients")
+	}
+	code := RandomKey()
+	err := s.auth.conn.Query(OAuthCodes.Insert().Values(oauthGrant{
+		ID:          HashKey(code),
+		ClientID:    req.Client.ID,
+		UserID:      user.ID,
+		Scopes:      req.Scopes,
+		RedirectURI: req.RedirectURI,
+		Challenge:   req.Challenge,
+		Expires:     s.nowFunc().Add(s.CodeTTL),
+	}))
+	if err != nil {
+		return "", err
+	}
+	return req.Redirect(url.Values{"code": {code}}), nil
+}
+
+// takeGrant deletes and returns the grant with the given key. The grant
+// is returned by the delete itself, so it can only be taken once.
+func (s *OAuthServer) takeGrant(table *sol.TableElem, key string) (grant oauthGrant, err error) {
+	stmt := sol.Text(
+		fmt.Sprintf("DELETE FROM %s WHERE key = :key RETURNING *", table.Name()),
+		sol.Values{"key": HashKey(key)},
+	)
+	err = s.auth.conn.Query(stmt, &grant)
+	return
+}
+
+// ExchangeCode redeems an authorization code for tokens. Codes can only
+// be used once, and the verifier must match the code's PKCE challenge.
+func (s *OAuthServer) ExchangeCode(client OAuthClient, code, redirectURI, verifier string) (OAuthToken, error) {
+	grant, err := s.takeGrant(OAuthCodes, code)
+	switch {
+	case err != nil:
+		return OAuthToken{}, err
+	case !grant.Exists() || grant.ClientID != client.ID:
+		return OAuthToken{}, oauthError("invalid_grant", "unknown authorization code")
+	case !grant.Expires.After(s.nowFunc()):
+		return OAuthToken{}, oauthError("invalid_grant", "authorization code has expired")
+	case grant.RedirectURI != redirectURI:
+		return OAuthToken{}, oauthError("invalid_grant", "redirect URI does not match")
+	case !ConstantTimeStringCompare(pkceChallenge(verifier), grant.Challenge):
+		return OAuthToken{}, oauthError("invalid_grant", "code verifier does not match")
+	}
+	return s.issue(client, grant.UserID, grant.Scopes, true)
+}
+
+// ClientCredentials issues an access token for the client itself, which
+// acts as its owner. Only confidential clients may use this grant.
+func (s *OAuthServer) ClientCredentials(client OAuthClient, requested Scopes) (OAuthToken, error) {
+	if client.IsPublic() {
+		return OAuthToken{}, oauthError("unauthorized_client", "public clients cannot use client credentials")
+	}
+	scopes, err := allowedScopes(client, requested)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	return s.issue(client, client.OwnerID, scopes, false)
+}
+
+// Refresh issues new tokens for the given refresh token, which is rotated:
+// it cannot be used again. The requested scopes must not exceed those of
+// the original grant.
+func (s *OAuthServer) Refresh(client OAuthClient, refresh string, requested Scopes) (OAuthToken, error) {
+	grant, err := s.takeGrant(OAuthRefreshTokens, refresh)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	if !grant.Exists() || grant.ClientID != client.ID {
+		return OAuthToken{}, oauthError("invalid_grant", "unknown refresh token")
+	}
+	if !grant.Expires.After(s.nowFunc()) {
+		return OAuthToken{}, oauthError("invalid_grant", "refresh token has expired")
+	}
+	scopes := grant.Scopes
+	if len(requested) > 0 {
+		if !grant.Scopes.HasAll(requested...) {
+			return OAuthToken{}, oauthError("invalid_scope", "scopes exceed the original grant")
+		}
+		scopes = requested
+	}
+	return s.issue(client, grant.UserID, scopes, true)
+}
+
+// issue creates an access token and optionally a refresh token
+func (s *OAuthServer) issue(client OAuthClient, userID int64, scopes Scopes, refresh bool) (token OAuthToken, err error) {
+	user, err := s.auth.users.GetByID(userID)
+	if err != nil || !user.IsActive {
+		return token, oauthError("invalid_grant", "user is not active")
+	}
+	expires := s.nowFunc().Add(s.AccessTTL)
+	access, err := s.auth.tokens.Create(
+		user, oauthTokenPrefix+client.ID, &expires, scopes...,
+	)
+	if err != nil {
+		return
+	}
+	token = OAuthToken{
+		AccessToken: fmt.Sprintf("%d.%s", user.ID, access.Key),
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.AccessTTL.Seconds()),
+		Scope:       scopes.String(),
+	}
+	if !refresh {
+		return
+	}
+	token.RefreshToken = RandomKey()
+	err = s.auth.conn.Query(OAuthRefreshTokens.Insert().Values(oauthGrant{
+		ID:       HashKey(token.RefreshToken),
+		ClientID: client.ID,
+		UserID:   user.ID,
+		Scopes:   scopes,
+		Expires:  s.nowFunc().Add(s.RefreshTTL),
+	}))
+	return
+}
+
+// accessToken returns the access token of the given "<user id>.<key>"
+// value if it was issued to a client
+func (s *OAuthServer) accessToken(value string) (token Token) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return
+	}
+	token = s.auth.tokens.Get(parts[1])
+	if token.UserID != id || !strings.HasPrefix(token.Name, oauthTokenPrefix) {
+		return Token{}
+	}
+	return
+}
+
+// Revoke revokes the given access or refresh token if it was issued to
+// the given client. Unknown tokens are ignored, as required by RFC 7009.
+func (s *OAuthServer) Revoke(client OAuthClient, value string) error {
+	if token := s.accessToken(value); token.Exists() {
+		if token.Name != oauthTokenPrefix+client.ID {
+			return nil
+		}
+		return s.auth.tokens.DeleteByID(token.ID)
+	}
+	return s.auth.conn.Query(OAuthRefreshTokens.Delete().Where(
+		OAuthRefreshTokens.C("key").Equals(HashKey(value)),
+		OAuthRefreshTokens.C("client_id").Equals(client.ID),
+	))
+}
+
+// Introspect describes the given access or refresh token
+func (s *OAuthServer) Introspect(value string) (info Introspection) {
+	now := s.nowFunc()
+	if token := s.accessToken(value); token.Exists() {
+		if token.Expired(now) {
+			return
+		}
+		info = Introspection{
+			Active:    true,
+			Scope:     token.Scopes.String(),
+			ClientID:  strings.TrimPrefix(token.Name, oauthTokenPrefix),
+			Subject:   strconv.FormatInt(token.UserID, 10),
+			TokenType: "access_token",
+		}
+		if token.Expires != nil {
+			info.Expires = token.Expires.Unix()
+		}
+		return
+	}
+
+	var grant oauthGrant
+	stmt := OAuthRefreshTokens.Select().Where(
+		OAuthRefreshTokens.C("key").Equals(HashKey(value)),
+	)
+	s.auth.conn.Query(stmt, &grant)
+	if !grant.Exists() || !grant.Expires.After(now) {
+		return
+	}
+	return Introspection{
+		Active:    true,
+		Scope:     grant.Scopes.String(),
+		ClientID:  grant.ClientID,
+		Subject:   strconv.FormatInt(grant.UserID, 10),
+		Expires:   grant.Expires.Unix(),
+		TokenType: "refresh_token",
+	}
+}
+
+// NewOAuthServer creates an OAuth server that issues tokens for users of
+// the given auth. Consent tokens are signed with a key derived from the
+// auth's secret key, which must be at least MinSecretLength bytes.
+func NewOAuthServer(auth *Auth) (*OAuthServer, error) {
+	if err := auth.requireConn("the OAuth server"); err != nil {
+		return nil, err
+	}
+	if err := CheckSecret(auth.config.SecretKey); err != nil {
+		return nil, err
+	}
+	return &OAuthServer{
+		auth:       auth,
+		consent:    DeriveKey(auth.config.SecretKey, "auth.oauth.consent"),
+		nowFunc:    func() time.Time { return time.Now().In(time.UTC) },
+		CodeTTL:    10 * time.Minute,
+		AccessTTL:  time.Hour,
+		RefreshTTL: 30 * 24 * time.Hour,
+	}, nil
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/aodin/sol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOAuthConsent(t *testing.T) {
+	assert := assert.New(t)
+
+	// Consent tokens do not use the connection
+	conn := &sol.DB{}
+	_, err := NewOAuthServer(Mock(config.Default, conn))
+	assert.NotNil(err, "Consent tokens should require a secret key")
+
+	server, err := NewOAuthServer(Mock(testConfig(), conn))
+	require.Nil(t, err)
+	req := AuthorizationRequest{
+		Client:      OAuthClient{ID: "client"},
+		RedirectURI: "https://example.com/callback?a=b",
+		Scopes:      Scopes{"read:users"},
+		State:       "xyz",
+		Challenge:   pkceChallenge("verifier"),
+	}
+	user := User{ID: 1}
+
+	token := server.ConsentToken(req, user)
+	assert.True(server.CheckConsent(req, user, token))
+	assert.False(server.CheckConsent(req, User{ID: 2}, token))
+	assert.False(server.CheckConsent(req, user, token+"x"))
+
+	changed := req
+	changed.Scopes = Scopes{"read:users", "write:users"}
+	assert.False(server.CheckConsent(changed, user, token))
+
+	server.nowFunc = func() time.Time { return time.Now().Add(time.Hour) }
+	assert.False(server.CheckConsent(req, user, token), "Consent should expire")
+
+	assert.Equal(
+		"https://example.com/callback?a=b&error=access_denied&state=xyz",
+		req.Deny(),
+	)
+}
+
+func TestOAuthServer(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(
+		tx, Users, Sessions, Tokens, TOTPDevices, RecoveryCodes,
+		OAuthClients, OAuthCodes, OAuthRefreshTokens,
+	)
+
+	auth := Mock(testConfig(), tx)
+	server, err := NewOAuthServer(auth)
+	require.Nil(t, err)
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+
+	redirect := "https://partner.example.com/callback"
+	_, _, err = server.RegisterClient(user, "bad", []string{"/relative"}, nil, true)
+	assert.NotNil(err, "Relative redirect URIs should be refused")
+
+	client, secret, err := server.RegisterClient(
+		user, "Partner", []string{redirect}, []string{"read:users", "write:users"}, true,
+	)
+	require.Nil(t, err, "Error during client registration")
+	assert.NotEqual(secret, client.Secret, "Only a digest of the secret is stored")
+
+	_, err = server.AuthenticateClient(client.ID, "wrong")
+	assert.NotNil(err)
+	client, err = server.AuthenticateClient(client.ID, secret)
+	require.Nil(t, err)
+
+	// Authorization code with PKCE
+	verifier := randomValue(32)
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {redirect},
+		"scope":                 {"read:users"},
+		"state":                 {"xyz"},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	req, err := server.ParseAuthorization(query)
+	require.Nil(t, err, "Valid authorization request failed")
+	assert.Equal(Scopes{"read:users"}, req.Scopes)
+
+	for key, value := range map[string]string{
+		"redirect_uri":          "https://evil.example.com",
+		"code_challenge_method": "plain",
+		"scope":                 "admin",
+		"response_type":         "token",
+	} {
+		invalid := url.Values{}
+		for k, v := range query {
+			invalid[k] = v
+		}
+		invalid.Set(key, value)
+		_, err = server.ParseAuthorization(invalid)
+		assert.NotNil(err, "Invalid %s was accepted", key)
+	}
+
+	location, err := server.Approve(req, user)
+	require.Nil(t, err)
+	approved, _ := url.Parse(location)
+	code := approved.Query().Get("code")
+	assert.Equal("xyz", approved.Query().Get("state"))
+
+	_, err = server.ExchangeCode(client, code, redirect, "wrong")
+	assert.NotNil(err, "Incorrect verifiers should fail")
+	_, err = server.ExchangeCode(client, code, redirect, verifier)
+	assert.NotNil(err, "Codes should only be used once")
+
+	location, _ = server.Approve(req, user)
+	approved, _ = url.Parse(location)
+	token, err := server.ExchangeCode(client, approved.Query().Get("code"), redirect, verifier)
+	require.Nil(t, err, "Code exchange failed")
+	assert.Equal("read:users", token.Scope)
+	assert.NotEqual("", token.RefreshToken)
+
+	// Access tokens are accepted by ByToken
+	parts := strings.SplitN(token.AccessToken, ".", 2)
+	id, _ := strconv.ParseInt(parts[0], 10, 64)
+	valid, scopes := auth.ByToken(id, parts[1])
+	assert.Equal(user.ID, valid.ID)
+	assert.Equal(Scopes{"read:users"}, scopes)
+
+	info := server.Introspect(token.AccessToken)
+	assert.True(info.Active)
+	assert.Equal(client.ID, info.ClientID)
+	assert.Equal("access_token", info.TokenType)
+	assert.False(server.Introspect("1.unknown").Active)
+
+	// Refresh tokens are rotated and cannot widen the scopes
+	refreshed, err := server.Refresh(client, token.RefreshToken, nil)
+	require.Nil(t, err, "Refresh failed")
+	assert.NotEqual(token.RefreshToken, refreshed.RefreshToken)
+	assert.True(server.Introspect(refreshed.RefreshToken).Active)
+	assert.False(server.Introspect(token.RefreshToken).Active)
+	_, err = server.Refresh(client, token.RefreshToken, nil)
+	assert.NotNil(err, "Refresh tokens should only be used once")
+	_, err = server.Refresh(client, refreshed.RefreshToken, Scopes{"write:users"})
+	assert.NotNil(err, "Refreshed scopes should not exceed the grant")
+
+	location, _ = server.Approve(req, user)
+	approved, _ = url.Parse(location)
+	token, _ = server.ExchangeCode(client, approved.Query().Get("code"), redirect, verifier)
+	refreshed, err = server.Refresh(client, token.RefreshToken, nil)
+	require.Nil(t, err)
+
+	// Client credentials are for confidential clients only
+	machine, err := server.ClientCredentials(client, Scopes{"write:users"})
+	require.Nil(t, err)
+	assert.Equal("", machine.RefreshToken)
+
+	public, _, err := server.RegisterClient(user, "App", []string{redirect}, nil, false)
+	require.Nil(t, err)
+	_, err = server.ClientCredentials(public, nil)
+	assert.NotNil(err)
+
+	// Revocation
+	assert.Nil(server.Revoke(public, machine.AccessToken))
+	assert.True(server.Introspect(machine.AccessToken).Active, "Only the issued client can revoke")
+	assert.Nil(server.Revoke(client, machine.AccessToken))
+	assert.False(server.Introspect(machine.AccessToken).Active)
+	assert.Nil(server.Revoke(client, refreshed.RefreshToken))
+	assert.False(server.Introspect(refreshed.RefreshToken).Active)
+}
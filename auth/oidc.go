@@ -0,0 +1,556 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aodin/sol"
+	"github.com/aodin/sol/postgres"
+	"github.com/aodin/sol/types"
+)
+
+// OIDCProvider is an external OpenID Connect provider that users can sign
+// in with. The endpoints can be set manually or by DiscoverOIDC.
+type OIDCProvider struct {
+	// Name identifies the provider in identities and cookies, such as
+	// "google"
+	Name         string `json:"-"`
+	ClientID     string `json:"-"`
+	ClientSecret string `json:"-"`
+	RedirectURL  string `json:"-"`
+
+	// Scopes default to "openid email profile"
+	Scopes []string `json:"-"`
+
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// DiscoverOIDC sets the endpoints of the given provider from its issuer's
+// OpenID configuration document.
+func DiscoverOIDC(client *http.Client, provider OIDCProvider) (OIDCProvider, error) {
+	issuer := strings.TrimSuffix(provider.Issuer, "/")
+	res, err := client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return provider, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return provider, fmt.Errorf(
+			"auth: openid configuration returned status %d", res.StatusCode,
+		)
+	}
+	discovered := provider
+	if err = json.NewDecoder(res.Body).Decode(&discovered); err != nil {
+		return provider, err
+	}
+	if discovered.Issuer != provider.Issuer {
+		return provider, fmt.Errorf(
+			"auth: openid configuration is for issuer %s", discovered.Issuer,
+		)
+	}
+	return discovered, nil
+}
+
+// Identity links the subject ID of an external provider to a user
+type Identity struct {
+	Provider  string    `db:"provider"`
+	Subject   string    `db:"subject"`
+	UserID    int64     `db:"user_id"`
+	Email     string    `db:"email"`
+	CreatedAt time.Time `db:"created_at,omitempty"`
+}
+
+// Exists returns true if the identity exists
+func (identity Identity) Exists() bool {
+	return identity.Subject != ""
+}
+
+// Identities is the postgres schema for external identities
+var Identities = postgres.Table("identities",
+	sol.Column("provider", types.Varchar().Limit(64).NotNull()),
+	sol.Column("subject", types.Varchar().Limit(256).NotNull()),
+	sol.ForeignKey(
+		"user_id",
+		Users.C("id"),
+		types.Integer().NotNull(),
+	).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+	sol.Column("email", types.Varchar().Limit(256).NotNull()),
+	sol.Column(
+		"created_at",
+		postgres.Timestamp().WithTimezone().NotNull().Default(postgres.Now),
+	),
+	sol.PrimaryKey("provider", "subject"),
+)
+
+// audience is the aud claim, which may be a string or a list of strings
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*aud = multiple
+	return nil
+}
+
+func (aud audience) contains(value string) bool {
+	for _, item := range aud {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// looseBool is a boolean claim that some providers send as a string
+type looseBool bool
+
+func (b *looseBool) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseBool(strings.Trim(string(data), `"`))
+	*b = looseBool(value)
+	return err
+}
+
+// IDToken holds the claims of a verified OpenID Connect ID token
+type IDToken struct {
+	Issuer          string    `json:"iss"`
+	Subject         string    `json:"sub"`
+	Audience        audience  `json:"aud"`
+	AuthorizedParty string    `json:"azp"`
+	Expires         int64     `json:"exp"`
+	IssuedAt        int64     `json:"iat"`
+	Nonce           string    `json:"nonce"`
+	Email           string    `json:"email"`
+	EmailVerified   looseBool `json:"email_verified"`
+	GivenName       string    `json:"given_name"`
+	FamilyName      string    `json:"family_name"`
+}
+
+// clockSkew is the allowed difference between the clocks of the provider
+// and this server when validating ID tokens
+const clockSkew = time.Minute
+
+// OIDCClient signs users in with an external OpenID Connect provider
+// using the authorization code flow with PKCE. The state, nonce and PKCE
+// verifier of a sign in are kept in a short-lived signed cookie.
+type OIDCClient struct {
+	auth     *Auth
+	provider OIDCProvider
+	client   *http.Client
+	key      []byte
+	timeout  time.Duration
+	nowFunc  func() time.Time
+
+	sync.Mutex
+	jwks      JSONWebKeySet
+	fetchedAt time.Time
+
+	// CreateUsers creates a new user for identities that do not match an
+	// existing user. Otherwise only linked identities and existing users
+	// with the same verified email can sign in.
+	CreateUsers bool
+}
+
+// Provider returns the client's provider
+func (c *OIDCClient) Provider() OIDCProvider {
+	return c.provider
+}
+
+func (c *OIDCClient) cookieName() string {
+	return "oidc_" + c.provider.Name
+}
+
+// setCookie sets the sign in cookie - it is sent on the provider's
+// redirect, so it cannot be SameSite strict
+func (c *OIDCClient) setCookie(w http.ResponseWriter, value string, age time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.cookieName(),
+		Value:    value,
+		Path:     "/",
+		Domain:   c.auth.config.Cookie.Domain,
+		MaxAge:   int(age.Seconds()),
+		Secure:   c.auth.config.Cookie.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// randomValue returns a random URL safe value without padding, as
+// required of PKCE verifiers
+func randomValue(n int) string {
+	return base64.RawURLEncoding.EncodeToString(RandomBytes(n))
+}
+
+// pkceChallenge returns the S256 challenge of the given verifier
+func pkceChallenge(verifier string) string {
+	digest := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// safeNext returns the given URL if it is a local path, preventing the
+// sign in from redirecting to another site
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return ""
+	}
+	return next
+}
+
+// Start redirects to the provider to sign in. The user will be redirected
+// to the given next URL after the callback, if it is a local path.
+func (c *OIDCClient) Start(w http.ResponseWriter, r *http.Request, next string) error {
+	if c.provider.AuthorizationEndpoint == "" {
+		return fmt.Errorf("auth: provider %s has no authorization endpoint", c.provider.Name)
+	}
+	state, nonce, verifier := randomValue(16), randomValue(16), randomValue(32)
+	expires := c.nowFunc().Add(c.timeout).Unix()
+	value := fmt.Sprintf(
+		"%s:%s:%s:%d:%s", state, nonce, verifier, expires, safeNext(next),
+	)
+	c.setCookie(w, base64.RawURLEncoding.EncodeToString(
+		[]byte(Sign(c.key, value)),
+	), c.timeout)
+
+	scopes := c.provider.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.provider.ClientID},
+		"redirect_uri":          {c.provider.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(c.provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(
+		w, r, c.provider.AuthorizationEndpoint+separator+query.Encode(), 302,
+	)
+	return nil
+}
+
+// signIn is the state of a sign in kept in its cookie
+type signIn struct {
+	state, nonce, verifier, next string
+}
+
+// readCookie returns the sign in of the given request's cookie and
+// removes the cookie so it cannot be used again
+func (c *OIDCClient) readCookie(w http.ResponseWriter, r *http.Request) (in signIn, err error) {
+	cookie, err := r.Cookie(c.cookieName())
+	if err != nil {
+		return in, fmt.Errorf("auth: no sign in was started with %s", c.provider.Name)
+	}
+	c.setCookie(w, "", -time.Second)
+
+	signed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return
+	}
+	value, ok := Unsign(c.key, string(signed))
+	parts := strings.SplitN(value, ":", 5)
+	if !ok || len(parts) != 5 {
+		return in, fmt.Errorf("auth: invalid sign in cookie")
+	}
+	expires, _ := strconv.ParseInt(parts[3], 10, 64)
+	if !c.nowFunc().Before(time.Unix(expires, 0)) {
+		return in, fmt.Errorf("auth: sign in with %s has expired", c.provider.Name)
+	}
+	return signIn{
+		state: parts[0], nonce: parts[1], verifier: parts[2], next: parts[4],
+	}, nil
+}
+
+// Callback completes a sign in from the provider's redirect. The ID token
+// is verified, the identity is linked to a user, and a session is created
+// with Auth.CreateSessionAndRedirect. Users with two-factor authentication
+// will return a SecondFactorRequired error instead.
+func (c *OIDCClient) Callback(w http.ResponseWriter, r *http.Request) error {
+	user, next, err := c.callback(w, r)
+	c.auth.recordLogin(user.ID, user.Email, ClientIP(r), err)
+	if err != nil {
+		return err
+	}
+	return c.auth.CreateSessionAndRedirect(w, r, user, next)
+}
+
+// callback returns the user of the provider's redirect and the page they
+// should be sent to. The user is kept for the audit if a second factor is
+// required.
+func (c *OIDCClient) callback(w http.ResponseWriter, r *http.Request) (user User, next string, err error) {
+	in, err := c.readCookie(w, r)
+	if err != nil {
+		return
+	}
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		err = fmt.Errorf("auth: %s sign in failed: %s", c.provider.Name, reason)
+		return
+	}
+	if !ConstantTimeStringCompare(in.state, query.Get("state")) {
+		err = fmt.Errorf("auth: sign in state does not match")
+		return
+	}
+
+	raw, err := c.exchange(query.Get("code"), in.verifier)
+	if err != nil {
+		return
+	}
+	token, err := c.Verify(raw, in.nonce)
+	if err != nil {
+		return
+	}
+	if user, err = c.userFor(token); err != nil {
+		return
+	}
+	if c.auth.verifiedOnly && !user.IsVerified() {
+		return user, "", EmailNotVerified{Email: user.Email}
+	}
+	_, err = c.auth.secondFactor(user)
+	return user, in.next, err
+}
+
+// exchange trades the given authorization code for an ID token
+func (c *OIDCClient) exchange(code, verifier string) (string, error) {
+	if code == "" {
+		return "", fmt.Errorf("auth: no authorization code was given")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.provider.RedirectURL},
+		"client_id":     {c.provider.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(
+		"POST", c.provider.TokenEndpoint, strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.provider.ClientSecret != "" {
+		req.SetBasicAuth(
+			url.QueryEscape(c.provider.ClientID),
+			url.QueryEscape(c.provider.ClientSecret),
+		)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf(
+			"auth: token endpoint returned status %d: %s", res.StatusCode, body,
+		)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.Unmarshal(body, &tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("auth: token endpoint did not return an ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+// Verify checks the signature of the given ID token against the
+// provider's keys and validates its claims and nonce.
+func (c *OIDCClient) Verify(raw, nonce string) (token IDToken, err error) {
+	payload, err := verifyJWS(raw, c.publicKey)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(payload, &token); err != nil {
+		return
+	}
+
+	now := c.nowFunc()
+	switch {
+	case token.Issuer != c.provider.Issuer:
+		err = fmt.Errorf("auth: ID token is from issuer %s", token.Issuer)
+	case !token.Audience.contains(c.provider.ClientID):
+		err = fmt.Errorf("auth: ID token is for another client")
+	case len(token.Audience) > 1 && token.AuthorizedParty != c.provider.ClientID:
+		err = fmt.Errorf("auth: ID token is authorized for another client")
+	case !now.Add(-clockSkew).Before(time.Unix(token.Expires, 0)):
+		err = fmt.Errorf("auth: ID token has expired")
+	case time.Unix(token.IssuedAt, 0).After(now.Add(clockSkew)):
+		err = fmt.Errorf("auth: ID token was issued in the future")
+	case !ConstantTimeStringCompare(token.Nonce, nonce):
+		err = fmt.Errorf("auth: ID token nonce does not match")
+	case token.Subject == "":
+		err = fmt.Errorf("auth: ID token has no subject")
+	}
+	if err != nil {
+		return IDToken{}, err
+	}
+	return
+}
+
+// publicKey returns the provider's key for the given header. The key set
+// is fetched again for unknown key IDs, as providers rotate their keys,
+// but at most once a minute.
+func (c *OIDCClient) publicKey(header jwsHeader) (crypto.PublicKey, error) {
+	c.Lock()
+	defer c.Unlock()
+	key, ok := c.jwks.Key(header.Kid)
+	if !ok && c.nowFunc().Sub(c.fetchedAt) > time.Minute {
+		if err := c.fetchKeys(); err != nil {
+			return nil, err
+		}
+		key, ok = c.jwks.Key(header.Kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("auth: provider has no key %s", header.Kid)
+	}
+	if key.Alg != "" && key.Alg != header.Alg {
+		return nil, fmt.Errorf("auth: key %s is not for %s", key.Kid, header.Alg)
+	}
+	return key.PublicKey()
+}
+
+func (c *OIDCClient) fetchKeys() error {
+	res, err := c.client.Get(c.provider.JWKSURI)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("auth: key set returned status %d", res.StatusCode)
+	}
+	var set JSONWebKeySet
+	if err = json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return err
+	}
+	c.jwks = set
+	c.fetchedAt = c.nowFunc()
+	return nil
+}
+
+// GetIdentity returns the identity of the given subject at the provider
+func (c *OIDCClient) GetIdentity(subject string) (identity Identity) {
+	if c.auth.requireConn("OIDC") != nil {
+		return
+	}
+	stmt := Identities.Select().Where(
+		Identities.C("provider").Equals(c.provider.Name),
+		Identities.C("subject").Equals(subject),
+	)
+	c.auth.conn.Query(stmt, &identity)
+	return
+}
+
+// Link links the subject of the given ID token to the given user
+func (c *OIDCClient) Link(user User, token IDToken) error {
+	if !user.Exists() {
+		return fmt.Errorf("auth: identities cannot be linked to users without IDs")
+	}
+	if err := c.auth.requireConn("OIDC"); err != nil {
+		return err
+	}
+	return c.auth.conn.Query(Identities.Insert().Values(Identity{
+		Provider: c.provider.Name,
+		Subject:  token.Subject,
+		UserID:   user.ID,
+		Email:    token.Email,
+	}))
+}
+
+// userFor returns the user linked to the given ID token. Unlinked tokens
+// are linked to the user with the same verified email or, if enabled, a
+// new user.
+func (c *OIDCClient) userFor(token IDToken) (user User, err error) {
+	if err = c.auth.requireConn("OIDC"); err != nil {
+		return
+	}
+	users := c.auth.users
+	if identity := c.GetIdentity(token.Subject); identity.Exists() {
+		user, err = users.GetByID(identity.UserID)
+	} else if token.Email == "" || !token.EmailVerified {
+		return user, fmt.Errorf(
+			"auth: %s did not provide a verified email", c.provider.Name,
+		)
+	} else if user, err = users.GetByEmail(token.Email); err == nil {
+		err = c.Link(user, token)
+	} else if c.CreateUsers {
+		user, err = c.createUser(token)
+	} else {
+		return User{}, fmt.Errorf("auth: no user exists for this identity")
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if !user.IsActive {
+		return User{}, fmt.Errorf("auth: user %s is inactive", user.Email)
+	}
+	return
+}
+
+// createUser creates a verified user with an unusable password for the
+// given ID token
+func (c *OIDCClient) createUser(token IDToken) (user User, err error) {
+	users := c.auth.users
+	user, err = users.Create(
+		token.Email, token.GivenName, token.FamilyName, RandomKey(),
+	)
+	if err != nil {
+		return
+	}
+	if err = users.SetVerified(&user, c.nowFunc()); err != nil {
+		return
+	}
+	err = c.Link(user, token)
+	return
+}
+
+// NewOIDC creates a client for the given provider that signs users in to
+// the given auth. Sign in cookies are signed with a key derived from the
+// auth's secret key, which must be at least MinSecretLength bytes.
+func NewOIDC(auth *Auth, provider OIDCProvider) (*OIDCClient, error) {
+	if err := CheckSecret(auth.config.SecretKey); err != nil {
+		return nil, err
+	}
+	return &OIDCClient{
+		auth:     auth,
+		provider: provider,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		key:      DeriveKey(auth.config.SecretKey, "auth.oidc."+provider.Name),
+		timeout:  10 * time.Minute,
+		nowFunc:  func() time.Time { return time.Now().In(time.UTC) },
+	}, nil
+}
@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testProvider is a stand-in OpenID provider. Codes must be issued with
+// authorize before they are exchanged.
+type testProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+	claims map[string]interface{}
+
+	sync.Mutex
+	codes map[string]url.Values // The authorization request of each code
+}
+
+func (p *testProvider) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": p.kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize issues a code for the given authorization request URL, as the
+// provider would after the user signs in
+func (p *testProvider) authorize(location string) (code, state string) {
+	u, _ := url.Parse(location)
+	query := u.Query()
+	p.Lock()
+	defer p.Unlock()
+	code = RandomKey()
+	p.codes[code] = query
+	return code, query.Get("state")
+}
+
+func (p *testProvider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	if id != "client" || secret != "secret" {
+		http.Error(w, `{"error":"invalid_client"}`, 401)
+		return
+	}
+	p.Lock()
+	request, ok := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	p.Unlock()
+	if !ok || pkceChallenge(r.FormValue("code_verifier")) != request.Get("code_challenge") {
+		http.Error(w, `{"error":"invalid_grant"}`, 400)
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":   p.URL,
+		"aud":   "client",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": request.Get("nonce"),
+	}
+	for key, value := range p.claims {
+		claims[key] = value
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     p.sign(claims),
+	})
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err, "Could not generate a provider key")
+	p := &testProvider{
+		key:   key,
+		kid:   "test",
+		codes: make(map[string]url.Values),
+		claims: map[string]interface{}{
+			"sub":            "12345",
+			"email":          "oidc@example.com",
+			"email_verified": "true",
+			"given_name":     "Open",
+			"family_name":    "ID",
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JSONWebKeySet{Keys: []JSONWebKey{{
+			Kty: "RSA",
+			Kid: p.kid,
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func newTestOIDC(t *testing.T, auth *Auth, p *testProvider) *OIDCClient {
+	provider, err := DiscoverOIDC(p.Client(), OIDCProvider{
+		Name:         "test",
+		Issuer:       p.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/callback",
+	})
+	require.Nil(t, err, "Discovery failed")
+	client, err := NewOIDC(auth, provider)
+	require.Nil(t, err)
+	return client
+}
+
+func TestOIDCVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewOIDC(Mock(config.Default, nil), OIDCProvider{Name: "test"})
+	assert.NotNil(err, "Sign in cookies should require a secret key")
+
+	p := newTestProvider(t)
+	defer p.Close()
+	client := newTestOIDC(t, Mock(testConfig(), nil), p)
+	assert.Equal(p.URL+"/token", client.Provider().TokenEndpoint)
+
+	valid := map[string]interface{}{
+		"iss":   p.URL,
+		"sub":   "12345",
+		"aud":   []string{"client"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": "nonce",
+	}
+	token, err := client.Verify(p.sign(valid), "nonce")
+	require.Nil(t, err, "Valid ID token failed verification")
+	assert.Equal("12345", token.Subject)
+
+	_, err = client.Verify(p.sign(valid), "other")
+	assert.NotNil(err, "Nonces should be checked")
+
+	for claim, value := range map[string]interface{}{
+		"iss": "https://example.com",
+		"aud": "other",
+		"exp": time.Now().Add(-time.Hour).Unix(),
+		"iat": time.Now().Add(time.Hour).Unix(),
+		"sub": "",
+	} {
+		invalid := make(map[string]interface{})
+		for k, v := range valid {
+			invalid[k] = v
+		}
+		invalid[claim] = value
+		_, err = client.Verify(p.sign(invalid), "nonce")
+		assert.NotNil(err, "An invalid %s claim passed verification", claim)
+	}
+
+	// Tokens signed by another key should fail
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	forged := &testProvider{key: other, kid: p.kid}
+	_, err = client.Verify(forged.sign(valid), "nonce")
+	assert.NotNil(err, "Forged ID tokens should fail verification")
+}
+
+func TestOIDCStart(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newTestProvider(t)
+	defer p.Close()
+	client := newTestOIDC(t, Mock(testConfig(), nil), p)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/login/test", nil)
+	require.Nil(t, client.Start(w, r, "https://evil.example.com"))
+	assert.Equal(302, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.Nil(t, err)
+	query := location.Query()
+	assert.Equal(p.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+	assert.Equal("code", query.Get("response_type"))
+	assert.Equal("S256", query.Get("code_challenge_method"))
+	assert.NotEqual("", query.Get("state"))
+	assert.NotEqual("", query.Get("nonce"))
+
+	cookies := w.Result().Cookies()
+	require.Equal(t, 1, len(cookies))
+	assert.Equal("oidc_test", cookies[0].Name)
+	assert.True(cookies[0].HttpOnly)
+
+	// The cookie should hold the state and a local next URL only
+	r.AddCookie(cookies[0])
+	in, err := client.readCookie(httptest.NewRecorder(), r)
+	require.Nil(t, err)
+	assert.Equal(query.Get("state"), in.state)
+	assert.Equal(query.Get("code_challenge"), pkceChallenge(in.verifier))
+	assert.Equal("", in.next)
+}
+
+func TestOIDCCallback(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(
+		tx, Users, Sessions, Tokens, TOTPDevices, RecoveryCodes, Identities,
+	)
+
+	auth := Mock(testConfig(), tx)
+	var log bytes.Buffer
+	auth.SetAuditSink(NewWriterAuditSink(&log, "secret", ""))
+	p := newTestProvider(t)
+	defer p.Close()
+	client := newTestOIDC(t, auth, p)
+
+	signIn := func(next string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/login/test", nil)
+		require.Nil(t, client.Start(w, r, next))
+		code, state := p.authorize(w.Header().Get("Location"))
+
+		callback := httptest.NewRequest(
+			"GET", "/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil,
+		)
+		for _, cookie := range w.Result().Cookies() {
+			callback.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		if err := client.Callback(w, callback); err != nil {
+			w.Code = 0
+			w.Body.WriteString(err.Error())
+		}
+		return w
+	}
+
+	// Unknown identities are refused unless users can be created
+	w := signIn("/")
+	assert.Equal(0, w.Code, "Unknown identities should be refused")
+
+	client.CreateUsers = true
+	w = signIn("/welcome")
+	require.Equal(t, 302, w.Code, w.Body.String())
+	assert.Equal("/welcome", w.Header().Get("Location"))
+
+	user, err := auth.users.GetByEmail("oidc@example.com")
+	require.Nil(t, err, "A user should have been created")
+	assert.True(user.IsVerified())
+	assert.Equal("Open", user.FirstName)
+	assert.Equal(user.ID, client.GetIdentity("12345").UserID)
+
+	// The linked identity signs in to the same user
+	w = signIn("")
+	require.Equal(t, 302, w.Code, w.Body.String())
+	var session string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == auth.CookieName() {
+			session = cookie.Value
+		}
+	}
+	assert.Equal(user.ID, auth.BySession(session).ID)
+
+	// A second identity with the same verified email is linked
+	p.claims["sub"] = "67890"
+	w = signIn("")
+	require.Equal(t, 302, w.Code, w.Body.String())
+	assert.Equal(user.ID, client.GetIdentity("67890").UserID)
+
+	// Mismatched states fail
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/login/test", nil)
+	require.Nil(t, client.Start(w, r, ""))
+	code, _ := p.authorize(w.Header().Get("Location"))
+	callback := httptest.NewRequest("GET", "/callback?code="+code+"&state=wrong", nil)
+	for _, cookie := range w.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	assert.NotNil(client.Callback(httptest.NewRecorder(), callback))
+
+	// Every sign in is audited
+	events, err := ReadAuditEvents(&log)
+	require.Nil(t, err)
+	assert.Equal([]AuditAction{
+		LoginFailed,
+		LoginSucceeded,
+		SessionCreated,
+		LoginSucceeded,
+		SessionCreated,
+		LoginSucceeded,
+		SessionCreated,
+		LoginFailed,
+	}, actions(events))
+	assert.Equal(user.ID, events[1].UserID)
+	assert.Equal("auth: sign in state does not match", events[7].Reason)
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
 	"hash"
 	"strconv"
@@ -83,6 +85,11 @@ func Pbkdf2(cleartext, salt []byte, rounds int, h func() hash.Hash) []byte {
 	return key(cleartext, salt, rounds, h().Size(), h)
 }
 
+// maxPBKDF2Rounds bounds the rounds of stored hashes, so that a corrupt
+// hash cannot exhaust the CPU of a login. It is above the rounds of
+// current Django releases.
+const maxPBKDF2Rounds = 4000000
+
 // TODO declare private?
 type PBKDF2_Base struct {
 	BaseHasher
@@ -90,6 +97,10 @@ type PBKDF2_Base struct {
 	digest func() hash.Hash // TODO move to base hasher?
 }
 
+func (h *PBKDF2_Base) params() string {
+	return fmt.Sprintf("%d", h.rounds)
+}
+
 func (h *PBKDF2_Base) Encode(cleartext, salt string) string {
 	// TODO these []byte conversions are a bit silly
 	hashed := EncodeBase64String(
@@ -103,7 +114,7 @@ func (h *PBKDF2_Base) Encode(cleartext, salt string) string {
 	return strings.Join(
 		[]string{
 			h.Algorithm(),
-			fmt.Sprintf("%d", h.rounds),
+			h.params(),
 			salt,
 			hashed,
 		},
@@ -113,6 +124,9 @@ func (h *PBKDF2_Base) Encode(cleartext, salt string) string {
 func (h *PBKDF2_Base) Verify(cleartext, encoded string) bool {
 	// Split the saved hash apart
 	parts := strings.SplitN(encoded, "$", 4)
+	if len(parts) != 4 {
+		return false
+	}
 
 	// The algorithm should match this hasher
 	algo := parts[0]
@@ -120,15 +134,23 @@ func (h *PBKDF2_Base) Verify(cleartext, encoded string) bool {
 		return false
 	}
 	rounds64, err := strconv.ParseInt(parts[1], 10, 0)
-	if err != nil {
+	if err != nil || rounds64 < 1 || rounds64 > maxPBKDF2Rounds {
 		return false
 	}
 	rounds := int(rounds64)
 	salt := parts[2]
 
+	// Passwords imported from Django use standard rather than URL encoding
+	expected, err := DecodeBase64String(parts[3])
+	if err != nil {
+		if expected, err = base64.StdEncoding.DecodeString(parts[3]); err != nil {
+			return false
+		}
+	}
+
 	// Generate a new hash using the given cleartext
 	hashed := Pbkdf2([]byte(cleartext), []byte(salt), rounds, h.digest)
-	return ConstantTimeStringCompare(EncodeBase64String(hashed), parts[3])
+	return subtle.ConstantTimeCompare(hashed, expected) == 1
 }
 
 func NewPBKDF2Hasher(alg string, n int, digest func() hash.Hash) *PBKDF2_Base {
@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aodin/sol"
+	"github.com/aodin/sol/postgres"
+	"github.com/aodin/sol/types"
+)
+
+// Group is a named set of permissions that users can be members of
+type Group struct {
+	ID   int64  `db:"id,omitempty"`
+	Name string `db:"name"`
+}
+
+// Exists returns true if the group has an assigned ID
+func (group Group) Exists() bool {
+	return group.ID != 0
+}
+
+// Permission is a named permission, such as "billing.refund". Names are
+// conventionally of the form "app.action".
+type Permission struct {
+	ID          int64  `db:"id,omitempty"`
+	Name        string `db:"name"`
+	Description string `db:"description"`
+}
+
+// Exists returns true if the permission has an assigned ID
+func (perm Permission) Exists() bool {
+	return perm.ID != 0
+}
+
+// Groups is the postgres schema for groups
+var Groups = postgres.Table("groups",
+	sol.Column("id", postgres.Serial()),
+	sol.Column("name", types.Varchar().Limit(128).NotNull()),
+	sol.PrimaryKey("id"),
+	sol.Unique("name"),
+)
+
+// Permissions is the postgres schema for permissions
+var Permissions = postgres.Table("permissions",
+	sol.Column("id", postgres.Serial()),
+	sol.Column("name", types.Varchar().Limit(128).NotNull()),
+	sol.Column("description", types.Varchar().Limit(512).NotNull()),
+	sol.PrimaryKey("id"),
+	sol.Unique("name"),
+)
+
+// GroupMembers is the postgres schema for the users of groups
+var GroupMembers = postgres.Table("group_members",
+	sol.ForeignKey(
+		"user_id",
+		Users.C("id"),
+		types.Integer().NotNull(),
+	).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+	sol.ForeignKey(
+		"group_id",
+		Groups.C("id"),
+		types.Integer().NotNull(),
+	).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+	sol.PrimaryKey("user_id", "group_id"),
+)
+
+// GroupPermissions is the postgres schema for the permissions of groups
+var GroupPermissions = postgres.Table("group_permissions",
+	sol.ForeignKey(
+		"group_id",
+		Groups.C("id"),
+		types.Integer().NotNull(),
+	).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+	sol.ForeignKey(
+		"permission_id",
+		Permissions.C("id"),
+		types.Integer().NotNull(),
+	).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+	sol.PrimaryKey("group_id", "permission_id"),
+)
+
+// permCache holds the permissions of a user once they are first checked.
+// Users are loaded for each request, so permissions are queried at most
+// once per request.
+type permCache struct {
+	once  sync.Once
+	names map[string]bool
+}
+
+// HasPerm returns true if the user has the permission with the given name
+// through any of their groups. Active superusers have every permission and
+// inactive users have none.
+func (user User) HasPerm(name string) bool {
+	if !user.Exists() || !user.IsActive {
+		return false
+	}
+	if user.IsSuperuser {
+		return true
+	}
+	if user.manager == nil || user.perms == nil {
+		return false
+	}
+	user.perms.once.Do(func() {
+		user.perms.names = make(map[string]bool)
+		for _, perm := range user.manager.Permissions(user.ID) {
+			user.perms.names[perm] = true
+		}
+	})
+	return user.perms.names[name]
+}
+
+// HasPerms returns true if the user has all of the given permissions
+func (user User) HasPerms(names ...string) bool {
+	for _, name := range names {
+		if !user.HasPerm(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateGroup creates a new group with the given name
+func (m *UserManager) CreateGroup(name string) (group Group, err error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		err = fmt.Errorf("auth: groups must have a name")
+		return
+	}
+	if m.GetGroup(name).Exists() {
+		err = fmt.Errorf("auth: group %s already exists", name)
+		return
+	}
+	group.Name = name
+	err = m.conn.Query(
+		postgres.Insert(Groups).Values(group).Returning(), &group,
+	)
+	return
+}
+
+// GetGroup returns the group with the given name
+func (m *UserManager) GetGroup(name string) (group Group) {
+	m.conn.Query(Groups.Select().Where(Groups.C("name").Equals(name)), &group)
+	return
+}
+
+// DeleteGroup removes the group with the given ID along with its members
+// and permissions
+func (m *UserManager) DeleteGroup(id int64) error {
+	return m.conn.Query(Groups.Delete().Where(Groups.C("id").Equals(id)))
+}
+
+// CreatePermission creates a new permission with the given name and
+// description
+func (m *UserManager) CreatePermission(name, description string) (perm Permission, err error) {
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		err = fmt.Errorf("auth: invalid permission name %q", name)
+		return
+	}
+	if m.GetPermission(name).Exists() {
+		err = fmt.Errorf("auth: permission %s already exists", name)
+		return
+	}
+	perm.Name = name
+	perm.Description = description
+	err = m.conn.Query(
+		postgres.Insert(Permissions).Values(perm).Returning(), &perm,
+	)
+	return
+}
+
+// GetPermission returns the permission with the given name
+func (m *UserManager) GetPermission(name string) (perm Permission) {
+	stmt := Permissions.Select().Where(Permissions.C("name").Equals(name))
+	m.conn.Query(stmt, &perm)
+	return
+}
+
+// DeletePermission removes the permission with the given name from the
+// database and every group
+func (m *UserManager) DeletePermission(name string) error {
+	stmt := Permissions.Delete().Where(Permissions.C("name").Equals(name))
+	return m.conn.Query(stmt)
+}
+
+// AddToGroup makes the given user a member of the given group
+func (m *UserManager) AddToGroup(user User, group Group) error {
+	if !user.Exists() || !group.Exists() {
+		return fmt.Errorf("auth: users and groups must exist to be added")
+	}
+	if m.inGroup(user.ID, group.ID) {
+		return nil
+	}
+	return m.conn.Query(GroupMembers.Insert().Values(sol.Values{
+		"user_id":  user.ID,
+		"group_id": group.ID,
+	}))
+}
+
+func (m *UserManager) inGroup(userID, groupID int64) bool {
+	var id int64
+	stmt := sol.Select(GroupMembers.C("group_id")).Where(
+		GroupMembers.C("user_id").Equals(userID),
+		GroupMembers.C("group_id").Equals(groupID),
+	).Limit(1)
+	m.conn.Query(stmt, &id)
+	return id != 0
+}
+
+// RemoveFromGroup removes the given user from the given group
+func (m *UserManager) RemoveFromGroup(user User, group Group) error {
+	return m.conn.Query(GroupMembers.Delete().Where(
+		GroupMembers.C("user_id").Equals(user.ID),
+		GroupMembers.C("group_id").Equals(group.ID),
+	))
+}
+
+// Grant gives the permission with the given name to the given group
+func (m *UserManager) Grant(group Group, name string) error {
+	perm := m.GetPermission(name)
+	if !group.Exists() || !perm.Exists() {
+		return fmt.Errorf("auth: could not grant %s to group %s", name, group.Name)
+	}
+	var id int64
+	stmt := sol.Select(GroupPermissions.C("permission_id")).Where(
+		GroupPermissions.C("group_id").Equals(group.ID),
+		GroupPermissions.C("permission_id").Equals(perm.ID),
+	).Limit(1)
+	m.conn.Query(stmt, &id)
+	if id != 0 {
+		return nil
+	}
+	return m.conn.Query(GroupPermissions.Insert().Values(sol.Values{
+		"group_id":      group.ID,
+		"permission_id": perm.ID,
+	}))
+}
+
+// Revoke removes the permission with the given name from the given group
+func (m *UserManager) Revoke(group Group, name string) error {
+	perm := m.GetPermission(name)
+	if !perm.Exists() {
+		return nil
+	}
+	return m.conn.Query(GroupPermissions.Delete().Where(
+		GroupPermissions.C("group_id").Equals(group.ID),
+		GroupPermissions.C("permission_id").Equals(perm.ID),
+	))
+}
+
+// GroupsOf returns the groups of the user with the given ID
+func (m *UserManager) GroupsOf(id int64) (groups []Group) {
+	var ids []int64
+	stmt := sol.Select(GroupMembers.C("group_id")).Where(
+		GroupMembers.C("user_id").Equals(id),
+	)
+	m.conn.Query(stmt, &ids)
+	if len(ids) == 0 {
+		return
+	}
+	m.conn.Query(Groups.Select().Where(Groups.C("id").In(ids)), &groups)
+	return
+}
+
+// Permissions returns the sorted names of every permission the user with
+// the given ID has through their groups
+func (m *UserManager) Permissions(id int64) (names []string) {
+	var groups []int64
+	stmt := sol.Select(GroupMembers.C("group_id")).Where(
+		GroupMembers.C("user_id").Equals(id),
+	)
+	m.conn.Query(stmt, &groups)
+	if len(groups) == 0 {
+		return
+	}
+
+	var perms []int64
+	stmt = sol.Select(GroupPermissions.C("permission_id")).Where(
+		GroupPermissions.C("group_id").In(groups),
+	)
+	m.conn.Query(stmt, &perms)
+	if len(perms) == 0 {
+		return
+	}
+
+	stmt = sol.Select(Permissions.C("name")).Where(
+		Permissions.C("id").In(perms),
+	)
+	m.conn.Query(stmt, &names)
+	sort.Strings(names)
+	return
+}
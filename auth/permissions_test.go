@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissions(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Groups, Permissions, GroupMembers, GroupPermissions)
+
+	users := MockUsers(tx)
+	user, err := users.Create("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error while creating user")
+	admin, err := users.CreateSuperuser("b@example.com", "super", "guy", "secret")
+	require.Nil(t, err, "Error while creating superuser")
+
+	billing, err := users.CreateGroup("billing")
+	require.Nil(t, err, "Error while creating group")
+	_, err = users.CreateGroup("billing")
+	assert.NotNil(err, "Duplicate groups should error")
+
+	_, err = users.CreatePermission("billing.refund", "Refund payments")
+	require.Nil(t, err, "Error while creating permission")
+	_, err = users.CreatePermission("billing view", "")
+	assert.NotNil(err, "Permission names cannot contain spaces")
+	_, err = users.CreatePermission("billing.view", "View invoices")
+	require.Nil(t, err, "Error while creating permission")
+
+	assert.Nil(users.Grant(billing, "billing.refund"))
+	assert.Nil(users.Grant(billing, "billing.refund"), "Grants should be idempotent")
+	assert.NotNil(users.Grant(billing, "dne"))
+	assert.Nil(users.AddToGroup(user, billing))
+	assert.Nil(users.AddToGroup(user, billing), "Membership should be idempotent")
+
+	assert.Equal([]string{"billing.refund"}, users.Permissions(user.ID))
+	assert.Equal(1, len(users.GroupsOf(user.ID)))
+
+	// Permissions are cached for the lifetime of the loaded user
+	loaded, err := users.GetByID(user.ID)
+	require.Nil(t, err)
+	assert.True(loaded.HasPerm("billing.refund"))
+	assert.False(loaded.HasPerm("billing.view"))
+	assert.Nil(users.Grant(billing, "billing.view"))
+	assert.False(loaded.HasPerm("billing.view"), "Permissions should be cached")
+
+	reloaded, _ := users.GetByID(user.ID)
+	assert.True(reloaded.HasPerms("billing.refund", "billing.view"))
+
+	// Superusers have every permission
+	assert.True(admin.HasPerm("billing.refund"))
+	assert.True(admin.HasPerm("dne"))
+
+	// Revoking and removal
+	assert.Nil(users.Revoke(billing, "billing.refund"))
+	assert.Equal([]string{"billing.view"}, users.Permissions(user.ID))
+	assert.Nil(users.RemoveFromGroup(user, billing))
+	assert.Equal(0, len(users.Permissions(user.ID)))
+	assert.Nil(users.DeleteGroup(billing.ID))
+	assert.False(users.GetGroup("billing").Exists())
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aodin/volta/email"
+)
+
+// DefaultResetTemplate is the default body of password reset emails. It is
+// given the User and the reset URL as Link.
+var DefaultResetTemplate = template.Must(template.New("reset").Parse(
+	`<p>Hello {{ .User.FirstName }},</p>
+<p>A password reset was requested for your account. To choose a new password, follow this link:</p>
+<p><a href="{{ .Link }}">{{ .Link }}</a></p>
+<p>If you did not request a reset, you can ignore this email.</p>`,
+))
+
+// PasswordReset emails users a link to reset their password. The link
+// includes the user's ID and token, which expires after MaxAge and can
+// only be used once.
+type PasswordReset struct {
+	auth   *Auth
+	sender email.Sender
+	url    string
+
+	MaxAge    time.Duration
+	MinLength int
+	Subject   string
+	Template  *template.Template
+}
+
+// Link returns the reset link for the given user, whose token must be set
+func (reset *PasswordReset) Link(user User) string {
+	values := url.Values{}
+	values.Set("id", strconv.FormatInt(user.ID, 10))
+	values.Set("token", user.Token)
+	return reset.url + "?" + values.Encode()
+}
+
+// Request generates a new token for the user with the given email and
+// emails them a reset link. No error is returned if no user has the email,
+// so that the existence of accounts is not leaked.
+func (reset *PasswordReset) Request(address string) error {
+	normalized, err := email.Normalize(address)
+	if err != nil {
+		return err
+	}
+	user, err := reset.auth.users.GetByEmail(normalized)
+	if err != nil || !user.IsActive {
+		return nil
+	}
+	if err = reset.auth.ResetUserToken(&user); err != nil {
+		return err
+	}
+
+	body := new(bytes.Buffer)
+	attrs := map[string]interface{}{"User": user, "Link": reset.Link(user)}
+	if err = reset.Template.Execute(body, attrs); err != nil {
+		return err
+	}
+	return reset.sender.Send(user.Email, reset.Subject, body.String())
+}
+
+// Validate returns the user with the given ID if the given token is valid
+// and has not expired.
+func (reset *PasswordReset) Validate(id int64, token string) (user User, err error) {
+	if user, err = reset.auth.ByUserToken(id, token); err != nil {
+		return
+	}
+	if !user.TokenSetAt.Add(reset.MaxAge).After(reset.auth.now()) {
+		user = User{} // Don't leak user info
+		err = fmt.Errorf("auth: password reset token has expired")
+	}
+	return
+}
+
+// Reset sets the password of the user with the given ID if the given token
+// is valid. The token is consumed before the password is set, so it can
+// only be used once even by concurrent requests, and the user is then
+// logged out everywhere.
+func (reset *PasswordReset) Reset(id int64, token, password string) (user User, err error) {
+	if len(password) < reset.MinLength {
+		err = fmt.Errorf(
+			"auth: passwords must be at least %d characters", reset.MinLength,
+		)
+		return
+	}
+	if user, err = reset.Validate(id, token); err != nil {
+		return
+	}
+	consumed, err := reset.auth.users.ConsumeToken(user.ID, HashKey(token))
+	if err != nil || !consumed {
+		if err == nil {
+			err = fmt.Errorf("auth: password reset token was already used")
+		}
+		return User{}, err
+	}
+	user.Token = ""
+	if err = reset.auth.users.SetPassword(&user, password); err != nil {
+		return
+	}
+	err = reset.auth.LogoutEverywhere(user)
+	return
+}
+
+// Sweeper creates a sweeper of the auth's stores that clears user tokens
+// once they are older than the reset's MaxAge
+func (reset *PasswordReset) Sweeper() *Sweeper {
+	sweeper := reset.auth.Sweeper()
+	sweeper.TokenAge = reset.MaxAge
+	return sweeper
+}
+
+// NewPasswordReset creates a password reset service that sends emails
+// with the given sender. The given URL is the page where users choose
+// their new password - the user's ID and token will be added to its query.
+func NewPasswordReset(auth *Auth, sender email.Sender, url string) *PasswordReset {
+	return &PasswordReset{
+		auth:      auth,
+		sender:    sender,
+		url:       url,
+		MaxAge:    24 * time.Hour,
+		MinLength: 8,
+		Subject:   "Reset your password",
+		Template:  DefaultResetTemplate,
+	}
+}
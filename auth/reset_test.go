@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockSender records sent emails
+type mockSender struct {
+	to, subject, body []string
+}
+
+func (sender *mockSender) Send(to, subject, body string) error {
+	sender.to = append(sender.to, to)
+	sender.subject = append(sender.subject, subject)
+	sender.body = append(sender.body, body)
+	return nil
+}
+
+func TestPasswordReset(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens, TOTPDevices, RecoveryCodes)
+
+	auth := Mock(config.Default, tx)
+	now := time.Now().In(time.UTC)
+	auth.now = func() time.Time { return now }
+
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+	session := auth.sessions.Create(user)
+	require.True(t, session.Exists())
+
+	sender := &mockSender{}
+	reset := NewPasswordReset(auth, sender, "https://example.com/reset")
+
+	// Unknown emails are not sent anything, but do not error
+	assert.Nil(reset.Request("b@example.com"))
+	assert.Equal(0, len(sender.to))
+	assert.NotNil(reset.Request("invalid"), "Invalid emails should error")
+
+	// Request a reset
+	require.Nil(t, reset.Request(" A@example.com "))
+	require.Equal(t, 1, len(sender.to))
+	assert.Equal("a@example.com", sender.to[0])
+
+	// Parse the link from the email
+	start := strings.Index(sender.body[0], "https://example.com/reset?")
+	require.True(t, start >= 0, "Email did not contain a reset link")
+	end := strings.Index(sender.body[0][start:], `"`)
+	link, err := url.Parse(strings.Replace(
+		sender.body[0][start:start+end], "&amp;", "&", -1,
+	))
+	require.Nil(t, err)
+	token := link.Query().Get("token")
+	assert.Equal(link.Query().Get("id"), strconv.FormatInt(user.ID, 10))
+
+	// Only the digest of the token is stored
+	stored, err := auth.users.GetByID(user.ID)
+	require.Nil(t, err)
+	assert.Equal(HashKey(token), stored.Token)
+
+	// Validate the token
+	valid, err := reset.Validate(user.ID, token)
+	require.Nil(t, err, "Token should be valid")
+	assert.Equal(user.ID, valid.ID)
+
+	_, err = reset.Validate(user.ID, "invalid")
+	assert.NotNil(err, "Invalid tokens should error")
+
+	// Tokens expire
+	now = now.Add(reset.MaxAge)
+	_, err = reset.Validate(user.ID, token)
+	assert.NotNil(err, "Expired tokens should error")
+	now = now.Add(-reset.MaxAge)
+
+	// Reset the password
+	_, err = reset.Reset(user.ID, token, "short")
+	assert.NotNil(err, "Short passwords should error")
+
+	_, err = reset.Reset(user.ID, token, "new secret")
+	require.Nil(t, err, "Reset should not error")
+
+	_, err = auth.ByPassword("a@example.com", "secret")
+	assert.NotNil(err, "The old password should no longer work")
+	_, err = auth.ByPassword("a@example.com", "new secret")
+	assert.Nil(err, "The new password should work")
+
+	// The token can only be used once and sessions are deleted
+	_, err = reset.Reset(user.ID, token, "another secret")
+	assert.NotNil(err, "A used token should error")
+	_, err = auth.ByUserToken(user.ID, "")
+	assert.NotNil(err, "A cleared token should not match an empty key")
+	assert.False(auth.sessions.Get(session.Key).Exists())
+
+	// Tokens are consumed once, even if they were validated twice
+	require.Nil(t, reset.Request("a@example.com"))
+	stored, err = auth.users.GetByID(user.ID)
+	require.Nil(t, err)
+	consumed, err := auth.users.ConsumeToken(user.ID, stored.Token)
+	require.Nil(t, err)
+	assert.True(consumed)
+	consumed, err = auth.users.ConsumeToken(user.ID, stored.Token)
+	require.Nil(t, err)
+	assert.False(consumed, "A consumed token should not be consumed again")
+}
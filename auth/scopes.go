@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Scopes are the permissions granted to an API token, such as "read:users"
+// or "write:billing". They are stored as a single space separated string.
+type Scopes []string
+
+// ParseScopes splits the given space separated scopes. Duplicates are
+// removed and the scopes are sorted.
+func ParseScopes(value string) Scopes {
+	return NewScopes(strings.Fields(value)...)
+}
+
+// NewScopes returns the given scopes without duplicates, sorted
+func NewScopes(scopes ...string) Scopes {
+	unique := make(map[string]bool)
+	var parsed Scopes
+	for _, scope := range scopes {
+		if scope == "" || unique[scope] {
+			continue
+		}
+		unique[scope] = true
+		parsed = append(parsed, scope)
+	}
+	sort.Strings(parsed)
+	return parsed
+}
+
+// Has returns true if the given scope was granted
+func (scopes Scopes) Has(scope string) bool {
+	for _, granted := range scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAll returns true if all of the given scopes were granted
+func (scopes Scopes) HasAll(required ...string) bool {
+	for _, scope := range required {
+		if !scopes.Has(scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the scopes separated by spaces
+func (scopes Scopes) String() string {
+	return strings.Join(scopes, " ")
+}
+
+// Scan implements the sql.Scanner interface
+func (scopes *Scopes) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*scopes = nil
+	case string:
+		*scopes = ParseScopes(v)
+	case []byte:
+		*scopes = ParseScopes(string(v))
+	default:
+		return fmt.Errorf("auth: cannot scan %T into scopes", value)
+	}
+	return nil
+}
+
+// Value implements the driver.Valuer interface
+func (scopes Scopes) Value() (driver.Value, error) {
+	return scopes.String(), nil
+}
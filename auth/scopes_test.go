@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopes(t *testing.T) {
+	assert := assert.New(t)
+
+	scopes := ParseScopes("write:billing  read:users read:users")
+	assert.Equal(Scopes{"read:users", "write:billing"}, scopes)
+	assert.Equal("read:users write:billing", scopes.String())
+	assert.True(scopes.Has("read:users"))
+	assert.False(scopes.Has("write:users"))
+	assert.True(scopes.HasAll("read:users", "write:billing"))
+	assert.False(scopes.HasAll("read:users", "write:users"))
+	assert.True(scopes.HasAll())
+	assert.Equal(0, len(ParseScopes("")))
+
+	// Database values
+	value, err := scopes.Value()
+	assert.Nil(err)
+	assert.Equal("read:users write:billing", value)
+
+	var scanned Scopes
+	assert.Nil(scanned.Scan([]byte("read:users")))
+	assert.Equal(Scopes{"read:users"}, scanned)
+	assert.Nil(scanned.Scan(nil))
+	assert.Equal(0, len(scanned))
+	assert.NotNil(scanned.Scan(1))
+}
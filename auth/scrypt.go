@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ScryptHasher hashes passwords with the memory-hard scrypt key
+// derivation function. Its parameters are encoded alongside the salt so
+// they can be changed without invalidating existing passwords.
+type ScryptHasher struct {
+	BaseHasher
+	n      int
+	r      int
+	p      int
+	keyLen int
+}
+
+// maxScryptMemory bounds the memory of stored hashes, which is 128 * n * r
+// bytes, to 1 GiB
+const maxScryptMemory = 1 << 30
+
+func (h *ScryptHasher) params() string {
+	return fmt.Sprintf("n=%d,r=%d,p=%d", h.n, h.r, h.p)
+}
+
+func (h *ScryptHasher) Encode(cleartext, salt string) string {
+	key, err := scrypt.Key(
+		[]byte(cleartext), []byte(salt), h.n, h.r, h.p, h.keyLen,
+	)
+	if err != nil {
+		// Only possible with invalid parameters, which are set in code
+		panic(fmt.Sprintf("auth: could not hash with scrypt: %s", err))
+	}
+	return strings.Join(
+		[]string{h.Algorithm(), h.params(), salt, EncodeBase64String(key)},
+		"$",
+	)
+}
+
+func (h *ScryptHasher) Verify(cleartext, encoded string) bool {
+	// Split the saved hash apart
+	parts := strings.SplitN(encoded, "$", 4)
+	if len(parts) != 4 || parts[0] != h.Algorithm() {
+		return false
+	}
+	params, err := parseParams(parts[1], "n", "r", "p")
+	if err != nil || params[1] < 1 || params[2] < 1 {
+		return false
+	}
+	if params[0] > maxScryptMemory/128/params[1] || params[2] > 16 {
+		return false
+	}
+	expected, err := DecodeBase64String(parts[3])
+	if err != nil || len(expected) == 0 || len(expected) > maxHashLength {
+		return false
+	}
+
+	// Generate a new hash using the given cleartext and saved parameters
+	hashed, err := scrypt.Key(
+		[]byte(cleartext),
+		[]byte(parts[2]),
+		params[0],
+		params[1],
+		params[2],
+		len(expected),
+	)
+	if err != nil {
+		return false
+	}
+	return ConstantTimeStringCompare(
+		EncodeBase64String(hashed), parts[3],
+	)
+}
+
+// NewScryptHasher creates a scrypt hasher with the given CPU/memory cost
+// n, which must be a power of two, block size r, and parallelism p.
+func NewScryptHasher(alg string, n, r, p int) *ScryptHasher {
+	return &ScryptHasher{NewBaseHasher(alg), n, r, p, 32}
+}
+
+func init() {
+	scryptHasher := NewScryptHasher("scrypt", 1<<15, 8, 1)
+	RegisterHasher(scryptHasher.algorithm, scryptHasher)
+}
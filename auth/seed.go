@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// SeedUser describes a user created by Auth.Seed. Seeded users are active
+// and verified unless Inactive or Unverified are set.
+type SeedUser struct {
+	Email      string
+	FirstName  string
+	LastName   string
+	Password   string
+	Superuser  bool
+	Inactive   bool
+	Unverified bool
+
+	// Permissions can only be seeded into a MemoryUserStore, groups and
+	// permissions of a database are managed with the UserManager
+	Permissions []string
+}
+
+// Seed creates the given users, such as the fixtures of a test, and
+// returns them in the same order.
+func (auth *Auth) Seed(seeds ...SeedUser) ([]User, error) {
+	users := make([]User, len(seeds))
+	for i, seed := range seeds {
+		var err error
+		if seed.Superuser {
+			users[i], err = auth.CreateSuperuser(
+				seed.Email, seed.FirstName, seed.LastName, seed.Password,
+			)
+		} else {
+			users[i], err = auth.users.Create(
+				seed.Email, seed.FirstName, seed.LastName, seed.Password,
+			)
+		}
+		if err != nil {
+			return users, err
+		}
+		if !seed.Unverified {
+			if err = auth.users.SetVerified(&users[i], auth.now()); err != nil {
+				return users, err
+			}
+		}
+		if seed.Inactive {
+			if err = auth.users.SetActive(&users[i], false); err != nil {
+				return users, err
+			}
+		}
+		if len(seed.Permissions) > 0 {
+			memory, ok := auth.users.(*MemoryUserStore)
+			if !ok {
+				return users, fmt.Errorf(
+					"auth: permissions can only be seeded in memory",
+				)
+			}
+			memory.SetPermissions(users[i].ID, seed.Permissions...)
+		}
+	}
+	return users, nil
+}
+
+// SeedSession creates a session for the given user and returns its
+// cookie, which can be added to requests to authenticate as the user.
+func (auth *Auth) SeedSession(user User) (*http.Cookie, error) {
+	session := auth.sessions.Create(user)
+	if !session.Exists() {
+		return nil, fmt.Errorf("auth: could not create new session")
+	}
+	return &http.Cookie{Name: auth.CookieName(), Value: session.Key}, nil
+}
@@ -2,50 +2,194 @@ package auth
 
 import (
 	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aodin/config"
 	"github.com/aodin/sol"
-	"github.com/aodin/sol/postgres"
 	"github.com/aodin/sol/types"
 )
 
-// Session is a database-backed user session.
+// Session is a database-backed user session. It records the client that
+// created it and when it was last used. Only the ID, a digest of the key,
+// is stored: the Key is set only when a session is created or retrieved
+// by its key.
 type Session struct {
-	Key     string          `db:"key"`
-	UserID  int64           `db:"user_id"`
-	Expires time.Time       `db:"expires"`
-	manager *SessionManager `db:"-"`
+	Key        string       `db:"-"`
+	ID         string       `db:"key"`
+	UserID     int64        `db:"user_id"`
+	Expires    time.Time    `db:"expires"`
+	CreatedAt  time.Time    `db:"created_at"`
+	LastSeenAt time.Time    `db:"last_seen_at"`
+	IP         string       `db:"ip"`
+	UserAgent  string       `db:"user_agent"`
+	Version    int64        `db:"-"` // Only set by stateless stores
+	manager    SessionStore `db:"-"`
 }
 
-// Delete removes the session with the given key from the database.
-// It will return an error if the session does not have a key or the key
-// was not deleted from the database. It will panic on any connection error.
+// Delete removes the session from its store. It will return an error if
+// the session does not have an ID. It will panic on any connection error.
 func (session Session) Delete() error {
 	if !session.Exists() {
 		return fmt.Errorf("auth: keyless sessions cannot be deleted")
 	}
-	return session.manager.Delete(session.Key)
+	return session.manager.DeleteByID(session.ID)
 }
 
 // Exists returns true if the session exists
 func (session Session) Exists() bool {
-	return session.Key != ""
+	return session.ID != ""
 }
 
-// Sessions is the postgres schema for sessions
-var Sessions = postgres.Table("sessions",
-	sol.Column("key", types.Varchar().NotNull()),
-	sol.ForeignKey(
-		"user_id",
-		Users.C("id"),
-		types.Integer().NotNull(),
-	).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
-	sol.Column("expires", postgres.Timestamp().WithTimezone()),
-	sol.PrimaryKey("key"),
+// The longest client IP and user agent that will be saved
+const (
+	maxIP        = 64
+	maxUserAgent = 512
+)
+
+var (
+	proxiesMu      sync.RWMutex
+	trustedProxies []*net.IPNet
 )
 
-// SessionManager is the internal manager of sessions
+// TrustProxies sets the networks, in CIDR notation such as "10.0.0.0/8",
+// of the proxies whose X-Real-IP header is trusted by ClientIP. Any
+// previously trusted networks are replaced. No proxies are trusted by
+// default.
+func TrustProxies(cidrs ...string) error {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("auth: invalid trusted proxy %q: %s", cidr, err)
+		}
+		networks[i] = network
+	}
+	proxiesMu.Lock()
+	defer proxiesMu.Unlock()
+	trustedProxies = networks
+	return nil
+}
+
+// isTrustedProxy returns true if the given IP belongs to a trusted proxy
+func isTrustedProxy(ip net.IP) bool {
+	proxiesMu.RLock()
+	defer proxiesMu.RUnlock()
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the request's client. The X-Real-IP header is
+// only used if the request was sent by a trusted proxy and the header is a
+// valid IP, otherwise the remote address is used.
+func ClientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if remote := net.ParseIP(ip); remote != nil && isTrustedProxy(remote) {
+		forwarded := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+		if net.ParseIP(forwarded) != nil {
+			ip = forwarded
+		}
+	}
+	if len(ip) > maxIP {
+		ip = ip[:maxIP]
+	}
+	return ip
+}
+
+// newSession creates a session for the given user at the given time. If a
+// request is given, its client IP and user agent are recorded.
+func newSession(user User, r *http.Request, now time.Time, age time.Duration) Session {
+	session := Session{
+		UserID:     user.ID,
+		Expires:    now.Add(age),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	if r != nil {
+		session.IP = ClientIP(r)
+		session.UserAgent = r.UserAgent()
+		if len(session.UserAgent) > maxUserAgent {
+			session.UserAgent = session.UserAgent[:maxUserAgent]
+		}
+	}
+	return session
+}
+
+// SessionStore is the storage of sessions used by Auth
+type SessionStore interface {
+	// Create creates a new session with a unique key for the given user
+	Create(User) Session
+
+	// CreateFrom is Create but also records the client IP and user agent
+	// of the given request
+	CreateFrom(User, *http.Request) Session
+
+	// Get returns the session with the given key, which will not exist if
+	// the key was not found
+	Get(key string) Session
+
+	// ListForUser returns all sessions of the user with the given ID, most
+	// recently used first
+	ListForUser(id int64) []Session
+
+	// Delete removes the session with the given key
+	Delete(key string) error
+
+	// DeleteByID removes the session with the given ID, such as a session
+	// from ListForUser
+	DeleteByID(id string) error
+
+	// DeleteForUser removes all sessions of the user with the given ID
+	DeleteForUser(id int64) error
+
+	// DeleteForUserExcept removes all sessions of the user with the given
+	// ID except the session with the given key
+	DeleteForUserExcept(id int64, key string) error
+
+	// Touch sets the expiration of the session with the given key and
+	// marks it as last seen now
+	Touch(key string, expires time.Time) error
+}
+
+// Sessions is the postgres schema for sessions
+var Sessions = sessionsTable(Postgres, SchemaVersion, Users)
+
+// sessionsTable declares the sessions table for the given dialect as it
+// was at the given schema version
+func sessionsTable(d Dialect, version int, users *sol.TableElem) *sol.TableElem {
+	modifiers := []sol.Modifier{
+		sol.Column(d.ident("key"), types.Varchar().Limit(64).NotNull()),
+		sol.ForeignKey(
+			"user_id",
+			users.C("id"),
+			types.Integer().NotNull(),
+		).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+		sol.Column("expires", d.timestamp()),
+		sol.PrimaryKey(d.ident("key")),
+	}
+	if version >= 4 {
+		modifiers = append(modifiers,
+			sol.Column("created_at", d.created()),
+			sol.Column("last_seen_at", d.created()),
+			sol.Column("ip", types.Varchar().Limit(64).NotNull()),
+			sol.Column("user_agent", types.Varchar().Limit(maxUserAgent).NotNull()),
+		)
+	}
+	return d.table("sessions", modifiers...)
+}
+
+// SessionManager is the postgres-backed SessionStore
 type SessionManager struct {
 	conn    sol.Conn
 	cookie  config.Cookie
@@ -54,23 +198,28 @@ type SessionManager struct {
 }
 
 // Create creates a new session using a key generated for the given User
-func (m *SessionManager) Create(user User) (session Session) {
+func (m *SessionManager) Create(user User) Session {
+	return m.CreateFrom(user, nil)
+}
+
+// CreateFrom creates a new session using a key generated for the given
+// User and records the client of the given request. If the session could
+// not be saved, the error is logged and the session will not exist.
+func (m *SessionManager) CreateFrom(user User, r *http.Request) (session Session) {
 	// Set the expires from the cookie config
-	session = Session{
-		Expires: m.nowFunc().Add(m.cookie.Age),
-		UserID:  user.ID,
-		manager: m,
-	}
+	session = newSession(user, r, m.nowFunc(), m.cookie.Age)
+	session.manager = m
 
 	// Generate a new random session key
 	for {
 		session.Key = m.keyFunc()
+		session.ID = HashKey(session.Key)
 
 		// No duplicates - generate a new key if this key already exists
 		var duplicate string
 		stmt := sol.Select(
 			Sessions.C("key"),
-		).Where(Sessions.C("key").Equals(session.Key)).Limit(1)
+		).Where(Sessions.C("key").Equals(session.ID)).Limit(1)
 		m.conn.Query(stmt, &duplicate)
 		if duplicate == "" {
 			break
@@ -78,23 +227,90 @@ func (m *SessionManager) Create(user User) (session Session) {
 	}
 
 	// Insert the session
-	m.conn.Query(Sessions.Insert().Values(session))
+	if err := m.conn.Query(Sessions.Insert().Values(session)); err != nil {
+		log.Printf("auth: could not create session: %s", err)
+		return Session{}
+	}
 	return
 }
 
 // Delete removes the session with the given key from the database.
 func (m *SessionManager) Delete(key string) error {
-	stmt := Sessions.Delete().Where(Sessions.C("key").Equals(key))
+	return m.DeleteByID(HashKey(key))
+}
+
+// DeleteByID removes the session with the given ID from the database.
+func (m *SessionManager) DeleteByID(id string) error {
+	stmt := Sessions.Delete().Where(Sessions.C("key").Equals(id))
+	return m.conn.Query(stmt)
+}
+
+// DeleteForUser removes all sessions of the user with the given ID.
+func (m *SessionManager) DeleteForUser(id int64) error {
+	stmt := Sessions.Delete().Where(Sessions.C("user_id").Equals(id))
 	return m.conn.Query(stmt)
 }
 
+// DeleteForUserExcept removes all sessions of the user with the given ID
+// except the session with the given key, such as the current session.
+func (m *SessionManager) DeleteForUserExcept(id int64, key string) error {
+	stmt := Sessions.Delete().Where(
+		Sessions.C("user_id").Equals(id),
+		Sessions.C("key").DoesNotEqual(HashKey(key)),
+	)
+	return m.conn.Query(stmt)
+}
+
+// DeleteExpired removes up to limit sessions that expired by the given
+// time and returns the number removed.
+func (m *SessionManager) DeleteExpired(now time.Time, limit int) (int64, error) {
+	var ids []string
+	stmt := sol.Select(Sessions.C("key")).Where(
+		Sessions.C("expires").LTE(now),
+	).Limit(limit)
+	if err := m.conn.Query(stmt, &ids); err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	deleted := Sessions.Delete().Where(Sessions.C("key").In(ids))
+	if err := m.conn.Query(deleted); err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
 // Get returns the session with the given key.
 func (m *SessionManager) Get(key string) (session Session) {
-	stmt := Sessions.Select().Where(Sessions.C("key").Equals(key))
+	stmt := Sessions.Select().Where(Sessions.C("key").Equals(HashKey(key)))
 	m.conn.Query(stmt, &session)
+	if session.Exists() {
+		session.Key = key
+		session.manager = m
+	}
 	return
 }
 
+// ListForUser returns all sessions of the user with the given ID, most
+// recently used first. Their keys are not known.
+func (m *SessionManager) ListForUser(id int64) (sessions []Session) {
+	stmt := Sessions.Select().Where(
+		Sessions.C("user_id").Equals(id),
+	).OrderBy(Sessions.C("last_seen_at").Desc())
+	m.conn.Query(stmt, &sessions)
+	for i := range sessions {
+		sessions[i].manager = m
+	}
+	return
+}
+
+// Touch sets the expiration of the session with the given key and marks it
+// as last seen now.
+func (m *SessionManager) Touch(key string, expires time.Time) error {
+	stmt := Sessions.Update().Values(
+		sol.Values{"expires": expires, "last_seen_at": m.nowFunc()},
+	).Where(Sessions.C("key").Equals(HashKey(key)))
+	return m.conn.Query(stmt)
+}
+
 // NewSessions will create a new internal session manager
 func NewSessions(c config.Cookie, conn sol.Conn) *SessionManager {
 	return &SessionManager{
@@ -104,3 +320,6 @@ func NewSessions(c config.Cookie, conn sol.Conn) *SessionManager {
 		nowFunc: func() time.Time { return time.Now().In(time.UTC) },
 	}
 }
+
+// SessionManager should implement the SessionStore interface
+var _ SessionStore = &SessionManager{}
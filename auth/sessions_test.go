@@ -1,10 +1,15 @@
 package auth
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aodin/config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSessions(t *testing.T) {
@@ -36,4 +41,122 @@ func TestSessions(t *testing.T) {
 
 	// Delete a session
 	assert.Nil(session.Delete(), "Deleting a session returned an error")
+
+	// Sessions that could not be saved do not exist. This must be last,
+	// since the failed insert aborts the transaction.
+	assert.False(sessions.Create(User{ID: admin.ID + 1}).Exists())
+}
+
+func TestMemorySessions(t *testing.T) {
+	assert := assert.New(t)
+
+	sessions := NewMemorySessions(config.DefaultCookie)
+	var mock mockKeyFunc
+	var calls int
+	sessions.keyFunc = func() string {
+		calls += 1
+		return mock.Key()
+	}
+
+	user := User{ID: 1}
+	session := sessions.Create(user)
+	assert.Equal("mock", session.Key)
+	assert.Equal(user.ID, session.UserID)
+
+	// A key collision should generate a new key: reset the mock so that it
+	// returns the duplicate key, then a random one
+	mock = false
+	other := sessions.Create(user)
+	assert.Equal(3, calls, "The duplicate key should have been replaced")
+	assert.NotEqual(session.Key, other.Key)
+	assert.Equal(user.ID, sessions.Get(session.Key).UserID)
+	assert.True(sessions.Get(other.Key).Exists())
+	assert.Equal(2, len(sessions.sessions))
+	assert.False(sessions.Get("dne").Exists())
+
+	// Touch
+	expires := session.Expires.Add(time.Hour)
+	assert.Nil(sessions.Touch(session.Key, expires))
+	assert.Equal(expires, sessions.Get(session.Key).Expires)
+
+	// Delete a single session and then all sessions for the user
+	assert.Nil(session.Delete(), "Deleting a session returned an error")
+	assert.False(sessions.Get(session.Key).Exists())
+	sessions.Create(User{ID: 2})
+	assert.Nil(sessions.DeleteForUser(user.ID))
+	assert.False(sessions.Get(other.Key).Exists())
+	assert.Equal(1, len(sessions.sessions))
+
+	// Record the client of a request
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Real-IP", "10.0.0.1")
+	r.Header.Set("User-Agent", "Mozilla/5.0")
+	session = sessions.CreateFrom(user, r)
+	assert.Equal("192.0.2.1", session.IP, "Untrusted IP headers should be ignored")
+	assert.Equal("Mozilla/5.0", session.UserAgent)
+
+	// The IP header of a trusted proxy is used if it is valid
+	assert.NotNil(TrustProxies("192.0.2.1"))
+	require.Nil(t, TrustProxies("192.0.2.0/24"))
+	defer TrustProxies()
+	assert.Equal("10.0.0.1", sessions.CreateFrom(user, r).IP)
+	r.Header.Set("X-Real-IP", strings.Repeat("1", 100))
+	assert.Equal("192.0.2.1", sessions.CreateFrom(user, r).IP)
+	r.Header.Set("X-Real-IP", "2001:db8::1")
+	assert.Equal("2001:db8::1", sessions.CreateFrom(user, r).IP)
+	r.RemoteAddr = strings.Repeat("1", 100)
+	assert.Equal(maxIP, len(sessions.CreateFrom(user, r).IP))
+	require.Nil(t, sessions.DeleteForUserExcept(user.ID, session.Key))
+
+	other = sessions.Create(user)
+	assert.Equal(2, len(sessions.ListForUser(user.ID)))
+
+	// Only digests of keys are kept
+	assert.Equal(HashKey(other.Key), other.ID)
+	for _, listed := range sessions.ListForUser(user.ID) {
+		assert.Equal("", listed.Key)
+	}
+	assert.Nil(sessions.DeleteForUserExcept(user.ID, session.Key))
+	assert.Equal(1, len(sessions.ListForUser(user.ID)))
+	assert.True(sessions.Get(session.Key).Exists())
+}
+
+func TestSessionMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens, TOTPDevices, RecoveryCodes)
+
+	auth := Mock(config.Default, tx)
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("User-Agent", "Mozilla/5.0")
+
+	current := auth.sessions.CreateFrom(user, r)
+	assert.Equal("10.0.0.1", current.IP)
+	assert.Equal("Mozilla/5.0", current.UserAgent)
+	assert.False(current.CreatedAt.IsZero())
+
+	other := auth.sessions.Create(user)
+	third := auth.sessions.Create(user)
+
+	sessions := auth.ListSessions(user)
+	require.Equal(t, 3, len(sessions))
+	assert.Equal("10.0.0.1", auth.sessions.Get(current.Key).IP)
+
+	// Sessions can only be revoked by their user
+	assert.NotNil(auth.RevokeSession(User{ID: user.ID + 1}, other.ID))
+	assert.Nil(auth.RevokeSession(user, other.ID))
+	assert.False(auth.sessions.Get(other.Key).Exists())
+
+	// Sign out other devices
+	r.AddCookie(&http.Cookie{Name: auth.CookieName(), Value: current.Key})
+	assert.Nil(auth.RevokeOtherSessions(user, r))
+	assert.True(auth.sessions.Get(current.Key).Exists())
+	assert.False(auth.sessions.Get(third.Key).Exists())
+	assert.Equal(1, len(auth.ListSessions(user)))
 }
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/aodin/sol"
+	_ "github.com/aodin/sol/sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getSQLite opens a new in-memory SQLite database with the auth schema.
+// Every connection to ":memory:" is a separate database, so only one
+// connection is opened.
+func getSQLite(t *testing.T) *sol.DB {
+	conn, err := sol.Open("sqlite3", ":memory:")
+	require.Nil(t, err, "Failed to open an in-memory SQLite database")
+	conn.SetMaxOpenConns(1)
+	for _, table := range Schema(SQLite) {
+		require.Nil(t, conn.Query(table.Create()), "Failed to create a table")
+	}
+	return conn
+}
+
+func TestSQLite(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := getSQLite(t)
+	defer conn.Close()
+
+	// Only the users, sessions and tokens tables exist, so features with
+	// their own tables, such as TOTP, must be disabled by default
+	auth := Mock(config.Default, conn)
+	require.Nil(t, auth.TOTP(), "TOTP should be disabled by default")
+
+	// Users are assigned IDs without RETURNING
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+	require.True(t, user.Exists(), "Failed to create user")
+	assert.False(user.CreatedAt.IsZero())
+
+	other, err := auth.CreateUser("b@example.com", "other", "guy", "secret")
+	require.Nil(t, err)
+	assert.NotEqual(user.ID, other.ID)
+
+	_, err = auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	assert.NotNil(err, "Duplicate users should not be created")
+
+	valid, err := auth.ByPassword("a@example.com", "secret")
+	require.Nil(t, err, "Could not auth by password")
+	assert.Equal(user.ID, valid.ID)
+	_, err = auth.ByPassword("a@example.com", "1234")
+	assert.NotNil(err)
+
+	// Sessions
+	session := auth.sessions.Create(user)
+	require.True(t, session.Exists(), "Failed to create session")
+	assert.Equal(user.ID, auth.BySession(session.Key).ID)
+	assert.Equal(1, len(auth.ListSessions(user)))
+
+	require.Nil(t, auth.LogoutEverywhere(user))
+	assert.False(auth.BySession(session.Key).Exists())
+
+	// Tokens
+	expires := time.Now().Add(time.Hour)
+	token, err := auth.tokens.Create(user, "ci", &expires, "read:users")
+	require.Nil(t, err, "Error during token creation")
+	assert.Equal(token.ID, auth.tokens.Get(token.Key).ID)
+
+	valid, scopes := auth.ByToken(user.ID, token.Key)
+	assert.Equal(user.ID, valid.ID)
+	assert.Equal(Scopes{"read:users"}, scopes)
+
+	invalid, _ := auth.ByToken(other.ID, token.Key)
+	assert.False(invalid.Exists(), "Tokens belong to a single user")
+
+	require.Nil(t, token.Delete())
+	invalid, _ = auth.ByToken(user.ID, token.Key)
+	assert.False(invalid.Exists(), "Deleted tokens should not authenticate")
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	conn, err := sol.Open("sqlite3", ":memory:")
+	require.Nil(t, err, "Failed to open an in-memory SQLite database")
+	defer conn.Close()
+	conn.SetMaxOpenConns(1)
+
+	migrations, err := Migrations(SQLite)
+	require.Nil(t, err)
+	for _, m := range migrations {
+		for _, stmt := range m.Up {
+			require.Nil(t, conn.Query(sol.Text(stmt)), "Failed migration %d", m.Version)
+		}
+	}
+
+	// The migrated tables match their declarations
+	auth := Mock(config.Default, conn)
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+	assert.True(t, auth.Sessions().Create(user).Exists())
+	_, err = auth.Tokens().Create(user, "ci", nil, "read:users")
+	assert.Nil(t, err)
+
+	// Keys can be hashed on SQLite, which cannot skip existing columns
+	require.Nil(t, HashStoredKeys(conn, SQLite))
+	require.Nil(t, HashStoredKeys(conn, SQLite))
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		for _, stmt := range migrations[i].Down {
+			require.Nil(t, conn.Query(sol.Text(stmt)), "Failed to revert migration %d", migrations[i].Version)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ExpiredDeleter is implemented by session and token stores that can
+// remove expired rows in batches. Stores without rows to remove, such as
+// cookie sessions, do not implement it.
+type ExpiredDeleter interface {
+	DeleteExpired(now time.Time, limit int) (int64, error)
+}
+
+// StaleTokenClearer is implemented by user stores that can clear user
+// tokens, such as password reset tokens, in batches
+type StaleTokenClearer interface {
+	ClearTokensBefore(before time.Time, limit int) (int64, error)
+}
+
+// Swept counts the rows removed by a sweep
+type Swept struct {
+	Sessions   int64
+	Tokens     int64
+	UserTokens int64
+}
+
+// Total returns the number of rows removed
+func (swept Swept) Total() int64 {
+	return swept.Sessions + swept.Tokens + swept.UserTokens
+}
+
+func (swept *Swept) add(other Swept) {
+	swept.Sessions += other.Sessions
+	swept.Tokens += other.Tokens
+	swept.UserTokens += other.UserTokens
+}
+
+// SweeperStats are the metrics of a Sweeper since it was created
+type SweeperStats struct {
+	Runs      int64
+	Removed   Swept
+	LastRun   time.Time
+	LastError error
+}
+
+// Sweeper removes expired sessions and tokens and clears user tokens older
+// than TokenAge, which BySession, ByToken and ByUserToken would otherwise
+// ignore forever. TokenAge must be at least the MaxAge of any password
+// reset, or its links will stop working early: use PasswordReset.Sweeper
+// to derive it. A zero TokenAge keeps user tokens. Rows are removed in
+// batches of BatchSize. Run Sweep once, such as from cron, or Start to
+// sweep every Interval until Stop is called or the context is cancelled.
+type Sweeper struct {
+	Interval  time.Duration
+	BatchSize int
+	TokenAge  time.Duration
+
+	auth *Auth
+
+	sync.Mutex
+	stats  SweeperStats
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// check returns an error if the sweeper's batch size cannot remove rows
+// or its token age is negative
+func (s *Sweeper) check() error {
+	if s.BatchSize <= 0 {
+		return fmt.Errorf("auth: sweeper batch size must be positive")
+	}
+	if s.TokenAge < 0 {
+		return fmt.Errorf("auth: sweeper token age must not be negative")
+	}
+	return nil
+}
+
+// Sweep removes expired rows until none remain or the context is
+// cancelled, and returns the number of rows removed.
+func (s *Sweeper) Sweep(ctx context.Context) (swept Swept, err error) {
+	now := s.auth.now()
+	if err = s.check(); err != nil {
+		return s.record(now, swept, err)
+	}
+	if store, ok := s.auth.sessions.(ExpiredDeleter); ok {
+		if swept.Sessions, err = s.batches(ctx, func(limit int) (int64, error) {
+			return store.DeleteExpired(now, limit)
+		}); err != nil {
+			return s.record(now, swept, err)
+		}
+	}
+	if store, ok := s.auth.tokens.(ExpiredDeleter); ok {
+		if swept.Tokens, err = s.batches(ctx, func(limit int) (int64, error) {
+			return store.DeleteExpired(now, limit)
+		}); err != nil {
+			return s.record(now, swept, err)
+		}
+	}
+	if store, ok := s.auth.users.(StaleTokenClearer); ok && s.TokenAge > 0 {
+		before := now.Add(-s.TokenAge)
+		swept.UserTokens, err = s.batches(ctx, func(limit int) (int64, error) {
+			return store.ClearTokensBefore(before, limit)
+		})
+	}
+	return s.record(now, swept, err)
+}
+
+// batches calls remove with the batch size until it removes less than a
+// full batch, and returns the total removed
+func (s *Sweeper) batches(ctx context.Context, remove func(int) (int64, error)) (total int64, err error) {
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		var removed int64
+		if removed, err = remove(s.BatchSize); err != nil {
+			return
+		}
+		total += removed
+		if removed == 0 || removed < int64(s.BatchSize) {
+			return
+		}
+	}
+}
+
+// record audits the removed sessions and tokens and adds the sweep to
+// the sweeper's stats. Rows are removed in bulk, so each sweep is audited
+// as one event per kind of row rather than per user.
+func (s *Sweeper) record(at time.Time, swept Swept, err error) (Swept, error) {
+	if swept.Sessions > 0 {
+		s.auth.audit.record(AuditEvent{
+			Action: SessionDeleted,
+			Reason: fmt.Sprintf("swept %d expired sessions", swept.Sessions),
+			At:     at,
+		})
+	}
+	if swept.Tokens > 0 {
+		s.auth.audit.record(AuditEvent{
+			Action: TokenDeleted,
+			Reason: fmt.Sprintf("swept %d expired tokens", swept.Tokens),
+			At:     at,
+		})
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.stats.Runs++
+	s.stats.Removed.add(swept)
+	s.stats.LastRun = at
+	s.stats.LastError = err
+	return swept, err
+}
+
+// Stats returns the metrics of the sweeper
+func (s *Sweeper) Stats() SweeperStats {
+	s.Lock()
+	defer s.Unlock()
+	return s.stats
+}
+
+// Start sweeps in the background every Interval until Stop is called or
+// the given context is cancelled. It does nothing if already started.
+// Errors are logged and the next sweep is attempted as scheduled.
+func (s *Sweeper) Start(ctx context.Context) error {
+	if s.Interval <= 0 {
+		return fmt.Errorf("auth: sweeper interval must be positive")
+	}
+	if err := s.check(); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.done != nil {
+		return nil
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go s.run(ctx, s.done)
+	return nil
+}
+
+func (s *Sweeper) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	defer s.finish(done)
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Sweep(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("auth: could not sweep expired rows: %s", err)
+			}
+		}
+	}
+}
+
+// finish clears the run if it ended without Stop, such as when its
+// parent context was cancelled, so that the sweeper can be started again
+func (s *Sweeper) finish(done chan struct{}) {
+	s.Lock()
+	defer s.Unlock()
+	if s.done == done {
+		s.cancel()
+		s.cancel, s.done = nil, nil
+	}
+}
+
+// Stop stops a started sweeper and waits for a sweep in progress to end
+func (s *Sweeper) Stop() {
+	s.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel, s.done = nil, nil
+	s.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Sweeper creates a sweeper of the auth's stores that sweeps hourly in
+// batches of 1000 rows and clears user tokens after a day, the default age
+// of password reset links. Use PasswordReset.Sweeper if the reset links
+// last longer.
+func (auth *Auth) Sweeper() *Sweeper {
+	return &Sweeper{
+		Interval:  time.Hour,
+		BatchSize: 1000,
+		TokenAge:  24 * time.Hour,
+		auth:      auth,
+	}
+}
+
+// The stores should implement the sweeper's interfaces
+var (
+	_ ExpiredDeleter    = &SessionManager{}
+	_ ExpiredDeleter    = &MemorySessionStore{}
+	_ ExpiredDeleter    = &TokenManager{}
+	_ ExpiredDeleter    = &MemoryTokenStore{}
+	_ StaleTokenClearer = &UserManager{}
+	_ StaleTokenClearer = &MemoryUserStore{}
+)
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweeper(t *testing.T) {
+	assert := assert.New(t)
+
+	auth := NewInMemory(config.Default)
+	users, err := auth.Seed(SeedUser{Email: "a@example.com"})
+	require.Nil(t, err)
+	user := users[0]
+
+	for i := 0; i < 5; i++ {
+		auth.Sessions().Create(user)
+	}
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		_, err = auth.TokenStore().Create(user, "ci", &expires)
+		require.Nil(t, err)
+	}
+	forever, err := auth.TokenStore().ForeverToken(user)
+	require.Nil(t, err)
+
+	sweeper := auth.Sweeper()
+	sweeper.BatchSize = 2
+
+	// Nothing has expired yet
+	swept, err := sweeper.Sweep(context.Background())
+	require.Nil(t, err)
+	assert.Equal(int64(0), swept.Total())
+
+	// Sweep past the expiration of the sessions, tokens and user token
+	auth.now = func() time.Time { return time.Now().Add(365 * 24 * time.Hour) }
+	swept, err = sweeper.Sweep(context.Background())
+	require.Nil(t, err)
+	assert.Equal(Swept{Sessions: 5, Tokens: 3, UserTokens: 1}, swept)
+	assert.Equal(1, len(auth.TokenStore().All(user.ID)))
+	assert.True(auth.TokenStore().Get(forever.Key).Exists())
+	stored, _ := auth.UserStore().GetByID(user.ID)
+	assert.Equal("", stored.Token)
+
+	stats := sweeper.Stats()
+	assert.Equal(int64(2), stats.Runs)
+	assert.Equal(int64(9), stats.Removed.Total())
+
+	// Cancelled sweeps remove nothing
+	auth.Sessions().Create(user)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = sweeper.Sweep(ctx)
+	assert.NotNil(err)
+	assert.Equal(err, sweeper.Stats().LastError)
+
+	// Started sweepers run until stopped
+	sweeper.Interval = time.Millisecond
+	require.Nil(t, sweeper.Start(context.Background()))
+	deadline := time.Now().Add(time.Second)
+	for sweeper.Stats().Removed.Sessions < 6 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	sweeper.Stop()
+	assert.Equal(int64(6), sweeper.Stats().Removed.Sessions)
+	runs := sweeper.Stats().Runs
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(runs, sweeper.Stats().Runs, "Stopped sweepers should not run")
+
+	// Sweepers stopped by their context can be started again
+	ctx, cancel = context.WithCancel(context.Background())
+	require.Nil(t, sweeper.Start(ctx))
+	cancel()
+	deadline = time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		sweeper.Lock()
+		done := sweeper.done
+		sweeper.Unlock()
+		if done == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	auth.Sessions().Create(user)
+	require.Nil(t, sweeper.Start(context.Background()))
+	deadline = time.Now().Add(time.Second)
+	for sweeper.Stats().Removed.Sessions < 7 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	sweeper.Stop()
+	assert.Equal(int64(7), sweeper.Stats().Removed.Sessions)
+
+	// Invalid intervals and batch sizes are errors
+	sweeper.Interval = 0
+	assert.NotNil(sweeper.Start(context.Background()))
+	sweeper.Interval = time.Hour
+	sweeper.BatchSize = 0
+	assert.NotNil(sweeper.Start(context.Background()))
+	_, err = sweeper.Sweep(context.Background())
+	assert.NotNil(err, "Sweeps without a batch size should error")
+	sweeper.BatchSize = 2
+	sweeper.TokenAge = -time.Hour
+	_, err = sweeper.Sweep(context.Background())
+	assert.NotNil(err, "Sweeps with a negative token age should error")
+
+	// Password resets derive the token age from their links
+	reset := NewPasswordReset(auth, &mockSender{}, "https://example.com/reset")
+	reset.MaxAge = 3 * 24 * time.Hour
+	assert.Equal(reset.MaxAge, reset.Sweeper().TokenAge)
+}
+
+func TestSweeperStores(t *testing.T) {
+	assert := assert.New(t)
+
+	// Get a blank DB and create the schemas
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens)
+
+	users := MockUsers(tx)
+	admin, err := users.Create("admin@example.com", "admin", "guy", "secret")
+	require.Nil(t, err)
+
+	sessions := NewSessions(config.DefaultCookie, tx)
+	tokens := NewTokens(tx)
+	for i := 0; i < 3; i++ {
+		sessions.Create(admin)
+	}
+	expires := time.Now().Add(time.Hour)
+	_, err = tokens.Create(admin, "ci", &expires)
+	require.Nil(t, err)
+	_, err = tokens.ForeverToken(admin)
+	require.Nil(t, err)
+
+	later := time.Now().Add(365 * 24 * time.Hour)
+	removed, err := sessions.DeleteExpired(later, 2)
+	require.Nil(t, err)
+	assert.Equal(int64(2), removed, "Sessions should be removed in batches")
+	removed, _ = sessions.DeleteExpired(later, 2)
+	assert.Equal(int64(1), removed)
+	assert.Equal(0, len(sessions.ListForUser(admin.ID)))
+
+	removed, err = tokens.DeleteExpired(later, 10)
+	require.Nil(t, err)
+	assert.Equal(int64(1), removed, "Tokens without expiration should be kept")
+	assert.Equal(1, len(tokens.All(admin.ID)))
+
+	removed, err = users.ClearTokensBefore(later, 10)
+	require.Nil(t, err)
+	assert.Equal(int64(1), removed)
+	admin, _ = users.GetByID(admin.ID)
+	assert.Equal("", admin.Token)
+}
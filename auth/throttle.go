@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aodin/sol"
+	"github.com/aodin/sol/postgres"
+	"github.com/aodin/sol/types"
+)
+
+// Attempts is a record of consecutive failed login attempts for a key,
+// such as an email or client IP.
+type Attempts struct {
+	Key         string    `db:"key"`
+	Failures    int       `db:"failures"`
+	LastFailure time.Time `db:"last_failure"`
+}
+
+// LockoutError is returned when login attempts are being throttled. No
+// further attempts will be checked until the given time.
+type LockoutError struct {
+	Until time.Time
+}
+
+func (e LockoutError) Error() string {
+	return fmt.Sprintf(
+		"auth: too many failed login attempts, locked until %s",
+		e.Until.Format(time.RFC3339),
+	)
+}
+
+// ThrottleStore persists failed login attempts
+type ThrottleStore interface {
+	Get(key string) (Attempts, error)
+	Fail(key string, at time.Time) (Attempts, error)
+	Clear(key string) error
+}
+
+// Throttle limits failed login attempts per email and per client IP.
+// After Free failures, each attempt must wait Backoff, doubling with every
+// further failure. After Limit failures, the key is locked out for the
+// Lockout duration. Failures older than Lockout are forgotten.
+type Throttle struct {
+	Free    int
+	Backoff time.Duration
+	Limit   int
+	Lockout time.Duration
+	store   ThrottleStore
+}
+
+// emailKey returns the throttled key of the given email. Emails are
+// lowercased so that changing their case does not reset the throttle.
+func emailKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// keys returns the throttled keys for the given email and IP. An empty IP
+// is not throttled.
+func (t *Throttle) keys(email, ip string) []string {
+	keys := []string{emailKey(email)}
+	if ip != "" {
+		keys = append(keys, ipKey(ip))
+	}
+	return keys
+}
+
+// until returns the time before which no attempts are allowed
+func (t *Throttle) until(attempts Attempts) time.Time {
+	if attempts.Failures >= t.Limit {
+		return attempts.LastFailure.Add(t.Lockout)
+	}
+	if attempts.Failures <= t.Free {
+		return time.Time{}
+	}
+	delay := t.Backoff << uint(attempts.Failures-t.Free-1)
+	if delay <= 0 || delay > t.Lockout {
+		delay = t.Lockout
+	}
+	return attempts.LastFailure.Add(delay)
+}
+
+// expired returns true if the given attempts should be forgotten
+func (t *Throttle) expired(attempts Attempts, now time.Time) bool {
+	return !now.Before(attempts.LastFailure.Add(t.Lockout))
+}
+
+// Allow returns a LockoutError if the given email or IP may not attempt
+// a login at the given time.
+func (t *Throttle) Allow(now time.Time, email, ip string) error {
+	var locked time.Time
+	for _, key := range t.keys(email, ip) {
+		attempts, err := t.store.Get(key)
+		if err != nil {
+			return err
+		}
+		if until := t.until(attempts); now.Before(until) && until.After(locked) {
+			locked = until
+		}
+	}
+	if !locked.IsZero() {
+		return LockoutError{Until: locked}
+	}
+	return nil
+}
+
+// Fail records a failed login attempt for the given email and IP
+func (t *Throttle) Fail(now time.Time, email, ip string) error {
+	for _, key := range t.keys(email, ip) {
+		attempts, err := t.store.Get(key)
+		if err != nil {
+			return err
+		}
+		if attempts.Failures > 0 && t.expired(attempts, now) {
+			if err = t.store.Clear(key); err != nil {
+				return err
+			}
+		}
+		if _, err = t.store.Fail(key, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnlockEmail clears all failed login attempts for the given email. It is
+// called after a successful login and can be used by admins to clear a
+// lockout.
+func (t *Throttle) UnlockEmail(email string) error {
+	return t.store.Clear(emailKey(email))
+}
+
+// UnlockIP clears all failed login attempts for the given client IP.
+func (t *Throttle) UnlockIP(ip string) error {
+	return t.store.Clear(ipKey(ip))
+}
+
+// NewThrottle creates a throttle using the given store. It allows three
+// free failures, then backs off from one second, and locks out for
+// fifteen minutes after ten failures.
+func NewThrottle(store ThrottleStore) *Throttle {
+	return &Throttle{
+		Free:    3,
+		Backoff: time.Second,
+		Limit:   10,
+		Lockout: 15 * time.Minute,
+		store:   store,
+	}
+}
+
+// MemoryThrottleStore keeps failed login attempts in memory. It is only
+// suitable for single process applications.
+type MemoryThrottleStore struct {
+	sync.Mutex
+	attempts map[string]Attempts
+}
+
+func (m *MemoryThrottleStore) Get(key string) (Attempts, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.attempts[key], nil
+}
+
+func (m *MemoryThrottleStore) Fail(key string, at time.Time) (Attempts, error) {
+	m.Lock()
+	defer m.Unlock()
+	attempts := m.attempts[key]
+	attempts.Key = key
+	attempts.Failures += 1
+	attempts.LastFailure = at
+	m.attempts[key] = attempts
+	return attempts, nil
+}
+
+func (m *MemoryThrottleStore) Clear(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+// NewMemoryThrottleStore creates an empty in-memory throttle store
+func NewMemoryThrottleStore() *MemoryThrottleStore {
+	return &MemoryThrottleStore{attempts: make(map[string]Attempts)}
+}
+
+// LoginAttempts is the postgres schema for failed login attempts
+var LoginAttempts = postgres.Table("login_attempts",
+	sol.Column("key", types.Varchar().Limit(320).NotNull()),
+	sol.Column("failures", types.Integer().NotNull()),
+	sol.Column(
+		"last_failure",
+		postgres.Timestamp().WithTimezone().NotNull(),
+	),
+	sol.PrimaryKey("key"),
+)
+
+// PostgresThrottleStore keeps failed login attempts in the login_attempts
+// table so they are shared between processes.
+type PostgresThrottleStore struct {
+	conn sol.Conn
+}
+
+func (m *PostgresThrottleStore) Get(key string) (attempts Attempts, err error) {
+	stmt := LoginAttempts.Select().Where(LoginAttempts.C("key").Equals(key))
+	err = m.conn.Query(stmt, &attempts)
+	return
+}
+
+// failAttempt counts a failure in a single statement, so that concurrent
+// failures are neither lost nor conflict
+const failAttempt = `INSERT INTO login_attempts (key, failures, last_failure)
+VALUES (:key, 1, :at)
+ON CONFLICT (key) DO UPDATE SET
+	failures = login_attempts.failures + 1,
+	last_failure = EXCLUDED.last_failure
+RETURNING key, failures, last_failure`
+
+func (m *PostgresThrottleStore) Fail(key string, at time.Time) (attempts Attempts, err error) {
+	stmt := sol.Text(failAttempt, sol.Values{"key": key, "at": at})
+	err = m.conn.Query(stmt, &attempts)
+	return
+}
+
+func (m *PostgresThrottleStore) Clear(key string) error {
+	stmt := LoginAttempts.Delete().Where(LoginAttempts.C("key").Equals(key))
+	return m.conn.Query(stmt)
+}
+
+// NewPostgresThrottleStore creates a throttle store using the given
+// connection
+func NewPostgresThrottleStore(conn sol.Conn) *PostgresThrottleStore {
+	return &PostgresThrottleStore{conn: conn}
+}
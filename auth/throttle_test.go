@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	throttle := NewThrottle(NewMemoryThrottleStore())
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Free failures are not throttled
+	for i := 0; i < throttle.Free; i++ {
+		assert.Nil(throttle.Allow(now, "a@example.com", "127.0.0.1"))
+		assert.Nil(throttle.Fail(now, "a@example.com", "127.0.0.1"))
+	}
+	assert.Nil(throttle.Allow(now, "a@example.com", "127.0.0.1"))
+
+	// Then back off exponentially
+	assert.Nil(throttle.Fail(now, "a@example.com", "127.0.0.1"))
+	err := throttle.Allow(now, "a@example.com", "")
+	require.IsType(t, LockoutError{}, err)
+	assert.Equal(now.Add(time.Second), err.(LockoutError).Until)
+	assert.Nil(throttle.Allow(now.Add(time.Second), "a@example.com", ""))
+
+	assert.Nil(throttle.Fail(now, "a@example.com", "127.0.0.1"))
+	err = throttle.Allow(now, "a@example.com", "")
+	require.IsType(t, LockoutError{}, err)
+	assert.Equal(now.Add(2*time.Second), err.(LockoutError).Until)
+
+	// The IP is throttled for other emails
+	assert.NotNil(throttle.Allow(now, "b@example.com", "127.0.0.1"))
+	assert.Nil(throttle.Allow(now, "b@example.com", "127.0.0.2"))
+
+	// Lock out after the limit
+	for i := throttle.Free + 2; i < throttle.Limit; i++ {
+		assert.Nil(throttle.Fail(now, "a@example.com", ""))
+	}
+	err = throttle.Allow(now.Add(time.Minute), "a@example.com", "")
+	require.IsType(t, LockoutError{}, err)
+	assert.Equal(now.Add(throttle.Lockout), err.(LockoutError).Until)
+
+	// Failures are forgotten after the lockout
+	later := now.Add(throttle.Lockout)
+	assert.Nil(throttle.Allow(later, "a@example.com", ""))
+	assert.Nil(throttle.Fail(later, "a@example.com", ""))
+	assert.Nil(throttle.Allow(later, "a@example.com", ""))
+
+	// Admins can clear a lockout
+	for i := 0; i < throttle.Limit; i++ {
+		assert.Nil(throttle.Fail(later, "c@example.com", ""))
+	}
+	assert.NotNil(throttle.Allow(later, "c@example.com", ""))
+	assert.NotNil(
+		throttle.Allow(later, "C@Example.com", ""),
+		"Changing the case of an email should not avoid a lockout",
+	)
+	assert.Nil(throttle.UnlockEmail("C@example.com"))
+	assert.Nil(throttle.Allow(later, "c@example.com", ""))
+
+	assert.Nil(throttle.UnlockIP("127.0.0.1"))
+	assert.Nil(throttle.Allow(now, "b@example.com", "127.0.0.1"))
+}
+
+func TestPostgresThrottleStore(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, LoginAttempts)
+
+	store := NewPostgresThrottleStore(tx)
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	attempts, err := store.Get("email:a@example.com")
+	assert.Nil(err)
+	assert.Equal(0, attempts.Failures)
+
+	attempts, err = store.Fail("email:a@example.com", now)
+	assert.Nil(err)
+	assert.Equal(1, attempts.Failures)
+
+	attempts, err = store.Fail("email:a@example.com", now.Add(time.Second))
+	assert.Nil(err)
+	assert.Equal(2, attempts.Failures)
+
+	attempts, err = store.Get("email:a@example.com")
+	assert.Nil(err)
+	assert.Equal(2, attempts.Failures)
+	assert.True(now.Add(time.Second).Equal(attempts.LastFailure))
+
+	assert.Nil(store.Clear("email:a@example.com"))
+	attempts, err = store.Get("email:a@example.com")
+	assert.Nil(err)
+	assert.Equal(0, attempts.Failures)
+}
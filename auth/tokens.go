@@ -1,66 +1,171 @@
 package auth
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"time"
 
 	"github.com/aodin/sol"
-	"github.com/aodin/sol/postgres"
 	"github.com/aodin/sol/types"
 )
 
 // Token is a database-backed user API token. The Expires field is nil if
-// the token never expires.
+// the token never expires, and LastUsedAt is nil if it was never used.
+// Handlers can limit what a token may do with its Scopes. Only the ID, a
+// digest of the key, and the key's non-secret prefix are stored: the Key
+// is set only when a token is created or retrieved by its key.
 type Token struct {
-	Key       string        `db:"key"`
-	UserID    int64         `db:"user_id"`
-	Expires   *time.Time    `db:"expires"`
-	CreatedAt time.Time     `db:"created_at,omitempty"`
-	manager   *TokenManager `db:"-"`
+	Key        string     `db:"-"`
+	ID         string     `db:"key"`
+	Prefix     string     `db:"prefix"`
+	UserID     int64      `db:"user_id"`
+	Name       string     `db:"name"`
+	Scopes     Scopes     `db:"scopes"`
+	Expires    *time.Time `db:"expires"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	CreatedAt  time.Time  `db:"created_at,omitempty"`
+	manager    TokenStore `db:"-"`
 }
 
-// Delete removes the token with the given key from the database.
-// It will return an error if the token does not have a key or the key
-// was not deleted from the database. It will panic on any connection error.
+// Delete removes the token from the database. It will return an error if
+// the token does not have an ID. It will panic on any connection error.
 func (token Token) Delete() error {
 	if !token.Exists() {
 		return fmt.Errorf("auth: keyless tokens cannot be deleted")
 	}
-	return token.manager.Delete(token.Key)
+	return token.manager.DeleteByID(token.ID)
 }
 
 // Exists returns true if the token exists
 func (token Token) Exists() bool {
-	return token.Key != ""
+	return token.ID != ""
+}
+
+// Bearer returns the Authorization header value that authenticates with
+// this token. The key must be known.
+func (token Token) Bearer() string {
+	return fmt.Sprintf("Bearer %d.%s", token.UserID, token.Key)
+}
+
+// Expired returns true if the token has an expiration at or before the
+// given time
+func (token Token) Expired(now time.Time) bool {
+	return token.Expires != nil && !token.Expires.After(now)
 }
 
 // Tokens is the postgres schema for user API tokens.
-var Tokens = postgres.Table("tokens",
-	sol.Column("key", types.Varchar().NotNull()),
-	sol.ForeignKey(
-		"user_id",
-		Users.C("id"),
-		types.Integer().NotNull(),
-	).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
-	sol.Column("expires", postgres.Timestamp().WithTimezone()),
-	sol.Column(
-		"created_at",
-		postgres.Timestamp().WithTimezone().NotNull().Default(postgres.Now),
-	),
-	sol.PrimaryKey("key"),
-)
+var Tokens = tokensTable(Postgres, SchemaVersion, Users)
+
+// tokensTable declares the tokens table for the given dialect as it was at
+// the given schema version
+func tokensTable(d Dialect, version int, users *sol.TableElem) *sol.TableElem {
+	modifiers := []sol.Modifier{
+		sol.Column(d.ident("key"), types.Varchar().Limit(64).NotNull()),
+		sol.ForeignKey(
+			"user_id",
+			users.C("id"),
+			types.Integer().NotNull(),
+		).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+		sol.Column("expires", d.timestamp()),
+		sol.Column("created_at", d.created()),
+		sol.PrimaryKey(d.ident("key")),
+	}
+	if version >= 5 {
+		modifiers = append(modifiers,
+			sol.Column("prefix", types.Varchar().Limit(PrefixLength).NotNull()),
+		)
+	}
+	if version >= 6 {
+		modifiers = append(modifiers,
+			sol.Column("name", types.Varchar().Limit(MaxTokenName).NotNull()),
+			sol.Column("scopes", d.text(MaxTokenScopes)),
+			sol.Column("last_used_at", d.timestamp()),
+		)
+	}
+	return d.table("tokens", modifiers...)
+}
+
+// MaxTokenName is the longest label a token can have
+const MaxTokenName = 128
+
+// MaxTokenScopes is the longest that the space separated scopes of a
+// token can be
+const MaxTokenScopes = 1024
+
+// TokenStore stores API tokens. Like sessions, only a digest of each key
+// is stored, so the key of a token is only known when it is created or
+// retrieved by its key.
+type TokenStore interface {
+	// All returns all tokens of the user with the given ID
+	All(id int64) []Token
+
+	// Create creates a token for the given user with the given name,
+	// optional expiration and scopes
+	Create(user User, name string, expires *time.Time, scopes ...string) (Token, error)
+
+	// ForeverToken creates an unnamed and unscoped token for the given
+	// user that never expires
+	ForeverToken(user User) (Token, error)
+
+	// Get returns the token with the given key, which will not exist if
+	// the key was not found
+	Get(key string) Token
+
+	// Rotate creates a replacement for the token with the given key and
+	// expires the old token after the given grace period
+	Rotate(key string, grace time.Duration) (Token, error)
+
+	// Used records that the given token was used now
+	Used(token *Token) error
+
+	// Delete removes the token with the given key
+	Delete(key string) error
+
+	// DeleteByID removes the token with the given ID, such as a token
+	// from All
+	DeleteByID(id string) error
+
+	// DeleteForUser removes all tokens of the user with the given ID
+	DeleteForUser(id int64) error
+}
+
+// checkNewToken returns an error if a token with the given name, scopes
+// and expiration cannot be created for the given user
+func checkNewToken(user User, name string, scopes Scopes, expires *time.Time, now time.Time) error {
+	if !user.Exists() {
+		return fmt.Errorf("auth: tokens cannot be created for users without IDs")
+	}
+	if len(name) > MaxTokenName {
+		return fmt.Errorf(
+			"auth: token names must be at most %d characters", MaxTokenName,
+		)
+	}
+	if len(scopes.String()) > MaxTokenScopes {
+		return fmt.Errorf(
+			"auth: token scopes must be at most %d characters", MaxTokenScopes,
+		)
+	}
+	if expires != nil && !expires.After(now) {
+		return fmt.Errorf("auth: tokens cannot be created expired")
+	}
+	return nil
+}
 
 // TokenManager is the internal manager of tokens
 type TokenManager struct {
+	auditor
 	conn    sol.Conn
 	keyFunc KeyFunc
 	nowFunc func() time.Time
 }
 
-// All returns all tokens for the given user ID
+// All returns all tokens for the given user ID. Their keys are not known.
 func (m *TokenManager) All(id int64) (tokens []Token) {
 	stmt := Tokens.Select().Where(Tokens.C("user_id").Equals(id))
 	m.conn.Query(stmt, &tokens)
+	for i := range tokens {
+		tokens[i].manager = m
+	}
 	return
 }
 
@@ -70,43 +175,171 @@ func (m *TokenManager) Count() (count int64) {
 }
 
 // Delete removes the token with the given key from the database.
-// It will return an error if the token does not have a key or the key
-// was not deleted from the database. It will panic on any connection error.
+// It will panic on any connection error.
 func (m *TokenManager) Delete(key string) error {
-	stmt := Tokens.Delete().Where(Tokens.C("key").Equals(key))
-	return m.conn.Query(stmt)
+	return m.DeleteByID(HashKey(key))
+}
+
+// DeleteByID removes the token with the given ID from the database, such
+// as a token from All.
+func (m *TokenManager) DeleteByID(id string) error {
+	stmt := Tokens.Delete().Where(Tokens.C("key").Equals(id))
+	if err := m.conn.Query(stmt); err != nil {
+		return err
+	}
+	m.record(AuditEvent{Action: TokenDeleted, Target: id, At: m.nowFunc()})
+	return nil
+}
+
+// DeleteForUser removes all tokens of the user with the given ID
+func (m *TokenManager) DeleteForUser(id int64) error {
+	stmt := Tokens.Delete().Where(Tokens.C("user_id").Equals(id))
+	if err := m.conn.Query(stmt); err != nil {
+		return err
+	}
+	m.record(AuditEvent{
+		Action: TokenDeleted,
+		UserID: id,
+		Reason: "all tokens of user",
+		At:     m.nowFunc(),
+	})
+	return nil
+}
+
+// DeleteExpired removes up to limit tokens that expired by the given time
+// and returns the number removed. Tokens without an expiration are kept.
+func (m *TokenManager) DeleteExpired(now time.Time, limit int) (int64, error) {
+	var ids []string
+	stmt := sol.Select(Tokens.C("key")).Where(
+		Tokens.C("expires").IsNotNull(),
+		Tokens.C("expires").LTE(now),
+	).Limit(limit)
+	if err := m.conn.Query(stmt, &ids); err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	deleted := Tokens.Delete().Where(Tokens.C("key").In(ids))
+	if err := m.conn.Query(deleted); err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
+// Create creates a new token for the given user with the given label and
+// scopes. A nil expires creates a token that never expires.
+func (m *TokenManager) Create(user User, name string, expires *time.Time, scopes ...string) (Token, error) {
+	parsed := NewScopes(scopes...)
+	if err := checkNewToken(user, name, parsed, expires, m.nowFunc()); err != nil {
+		return Token{}, err
+	}
+	return m.create(Token{
+		UserID:  user.ID,
+		Name:    name,
+		Scopes:  parsed,
+		Expires: expires,
+	})
 }
 
-// Create creates a new token for the user. It will panic on error. The user
-// ID must exist.
-func (m *TokenManager) ForeverToken(user User) (token Token) {
-	token.UserID = user.ID
+// ForeverToken creates a new unnamed and unscoped token for the user that
+// never expires. The user ID must exist.
+func (m *TokenManager) ForeverToken(user User) (Token, error) {
+	return m.Create(user, "", nil)
+}
+
+func (m *TokenManager) create(token Token) (Token, error) {
 	token.manager = m
 
 	// Generate a new token
 	for {
 		token.Key = m.keyFunc()
+		token.ID = HashKey(token.Key)
+		token.Prefix = KeyPrefix(token.Key)
 
 		// No duplicates - generate a new key if this key already exists
 		stmt := sol.Select(
 			Tokens.C("key"),
-		).Where(Tokens.C("key").Equals(token.Key)).Limit(1)
+		).Where(Tokens.C("key").Equals(token.ID)).Limit(1)
 		var duplicate string
-		m.conn.Query(stmt, &duplicate)
+		if err := m.conn.Query(stmt, &duplicate); err != nil {
+			return Token{}, err
+		}
 		if duplicate == "" {
 			break
 		}
 	}
 
 	// Insert the token into the database
-	m.conn.Query(postgres.Insert(Tokens).Values(token).Returning(), &token)
-	return
+	token.CreatedAt = m.nowFunc()
+	if err := m.conn.Query(Tokens.Insert().Values(token)); err != nil {
+		return Token{}, err
+	}
+	m.record(AuditEvent{
+		Action: TokenCreated,
+		UserID: token.UserID,
+		Target: token.ID,
+		At:     token.CreatedAt,
+	})
+	return token, nil
+}
+
+// Rotate creates a replacement for the token with the given key, with the
+// same user, name, scopes and expiration. The old token keeps working for
+// the given grace period, so clients can switch to the new key.
+func (m *TokenManager) Rotate(key string, grace time.Duration) (Token, error) {
+	old := m.Get(key)
+	if !old.Exists() || old.Expired(m.nowFunc()) {
+		return Token{}, fmt.Errorf("auth: no valid token exists with that key")
+	}
+	replacement, err := m.create(Token{
+		UserID:  old.UserID,
+		Name:    old.Name,
+		Scopes:  old.Scopes,
+		Expires: old.Expires,
+	})
+	if err != nil {
+		return replacement, err
+	}
+
+	// The grace period cannot extend the old token's expiration
+	ends := m.nowFunc().Add(grace)
+	if old.Expires != nil && old.Expires.Before(ends) {
+		return replacement, nil
+	}
+	stmt := Tokens.Update().Values(
+		sol.Values{"expires": ends},
+	).Where(Tokens.C("key").Equals(old.ID))
+	return replacement, m.conn.Query(stmt)
 }
 
-// Get returns the token with the given key. Panic on database error.
+// Used records that the given token was used now
+func (m *TokenManager) Used(token *Token) error {
+	now := m.nowFunc()
+	stmt := Tokens.Update().Values(
+		sol.Values{"last_used_at": now},
+	).Where(Tokens.C("key").Equals(token.ID))
+	if err := m.conn.Query(stmt); err != nil {
+		return err
+	}
+	token.LastUsedAt = &now
+	return nil
+}
+
+// Get returns the token with the given key. Tokens are looked up by the
+// key's prefix and then their digests are compared in constant time, so
+// the lookup does not leak information through a timing attack.
+// Panic on database error.
 func (m *TokenManager) Get(key string) (token Token) {
-	stmt := Tokens.Select().Where(Tokens.C("key").Equals(key))
-	m.conn.Query(stmt, &token)
+	var tokens []Token
+	stmt := Tokens.Select().Where(Tokens.C("prefix").Equals(KeyPrefix(key)))
+	m.conn.Query(stmt, &tokens)
+
+	digest := []byte(HashKey(key))
+	for _, candidate := range tokens {
+		if subtle.ConstantTimeCompare(digest, []byte(candidate.ID)) == 1 {
+			token = candidate
+			token.Key = key
+			token.manager = m
+		}
+	}
 	return
 }
 
@@ -117,3 +350,6 @@ func NewTokens(conn sol.Conn) *TokenManager {
 		nowFunc: time.Now,
 	}
 }
+
+// TokenManager should implement the TokenStore interface
+var _ TokenStore = &TokenManager{}
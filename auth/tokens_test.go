@@ -1,8 +1,12 @@
 package auth
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aodin/config"
+	"github.com/aodin/sol"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -27,15 +31,21 @@ func TestTokens(t *testing.T) {
 	require.Nil(t, err, "Error while creating user")
 
 	// Create a token for the user that lasts forever
-	token := tokens.ForeverToken(user)
+	token, err := tokens.ForeverToken(user)
+	require.Nil(t, err, "Error while creating token")
 	assert.Equal("mock", token.Key)
 	assert.Equal(user.ID, token.UserID)
 
 	// Generate a new token with a key collision. It should collide, then
 	// generate a random key.
-	repeat := tokens.ForeverToken(user)
+	repeat, err := tokens.ForeverToken(user)
+	require.Nil(t, err)
 	assert.Equal(user.ID, repeat.UserID)
 
+	// Tokens cannot be created for users that do not exist
+	_, err = tokens.ForeverToken(User{})
+	assert.NotNil(err, "Tokens should not be created without a user")
+
 	// There should now be two tokens
 	assert.EqualValues(2, tokens.Count())
 
@@ -49,6 +59,16 @@ func TestTokens(t *testing.T) {
 	invalid := tokens.Get("DNE")
 	assert.False(invalid.Exists(), "Token should not exist")
 
+	// Only the digest and prefix of the key are stored
+	assert.Equal(HashKey(repeat.Key), byKey.ID)
+	assert.Equal(repeat.Key[:PrefixLength], byKey.Prefix)
+	for _, stored := range tokens.All(user.ID) {
+		assert.Equal("", stored.Key)
+	}
+
+	// A key with the same prefix should not match
+	assert.False(tokens.Get(repeat.Key[:PrefixLength] + "wrong").Exists())
+
 	// Delete a token that exists
 	assert.Nil(
 		repeat.Delete(),
@@ -65,3 +85,112 @@ func TestTokens(t *testing.T) {
 	assert.Nil(user.Delete(), "Deleting a user should not return an error")
 	assert.EqualValues(0, tokens.Count())
 }
+
+func TestHashStoredKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens)
+
+	users := MockUsers(tx)
+	user, err := users.Create("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error while creating user")
+
+	// Insert rows with raw keys, as they were stored before hashing
+	sessionKey, tokenKey := RandomKey(), RandomKey()
+	tx.Query(Sessions.Insert().Values(sol.Values{
+		"key":        sessionKey,
+		"user_id":    user.ID,
+		"expires":    time.Now().Add(time.Hour),
+		"ip":         "",
+		"user_agent": "",
+	}))
+	tx.Query(Tokens.Insert().Values(sol.Values{
+		"key":     tokenKey,
+		"prefix":  "",
+		"user_id": user.ID,
+		"name":    "",
+		"scopes":  "",
+	}))
+
+	userToken := RandomKey()
+	tx.Query(Users.Update().Values(
+		sol.Values{"token": userToken},
+	).Where(Users.C("id").Equals(user.ID)))
+
+	sessions := NewSessions(config.DefaultCookie, tx)
+	tokens := NewTokens(tx)
+	assert.False(sessions.Get(sessionKey).Exists())
+	assert.False(tokens.Get(tokenKey).Exists())
+
+	// The existing keys should work after migrating, even twice
+	require.Nil(t, HashStoredKeys(tx, Postgres))
+	require.Nil(t, HashStoredKeys(tx, Postgres))
+	assert.True(sessions.Get(sessionKey).Exists())
+	assert.True(tokens.Get(tokenKey).Exists())
+	stored, err := users.GetByID(user.ID)
+	require.Nil(t, err)
+	assert.Equal(HashKey(userToken), stored.Token)
+}
+
+func TestScopedTokens(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens, TOTPDevices, RecoveryCodes)
+
+	auth := Mock(config.Default, tx)
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error while creating user")
+
+	tokens := auth.Tokens()
+	expires := time.Now().Add(time.Hour)
+	token, err := tokens.Create(
+		user, "deploy", &expires, "write:billing", "read:users",
+	)
+	require.Nil(t, err, "Error while creating token")
+	assert.Equal("deploy", token.Name)
+	assert.Equal(Scopes{"read:users", "write:billing"}, token.Scopes)
+	assert.Nil(token.LastUsedAt)
+
+	// Invalid tokens
+	past := time.Now().Add(-time.Hour)
+	_, err = tokens.Create(user, "expired", &past)
+	assert.NotNil(err, "Expired tokens should not be created")
+	_, err = tokens.Create(User{}, "userless", nil)
+	assert.NotNil(err, "Tokens should not be created without a user")
+	_, err = tokens.Create(user, "long", nil, strings.Repeat("a", MaxTokenScopes+1))
+	assert.NotNil(err, "Tokens should not be created with too many scopes")
+
+	// The scopes are returned with the user and the use is recorded
+	valid, scopes := auth.ByToken(user.ID, token.Key)
+	assert.Equal(user.ID, valid.ID)
+	assert.True(scopes.Has("read:users"))
+	assert.False(scopes.Has("write:users"))
+	assert.NotNil(tokens.Get(token.Key).LastUsedAt)
+
+	invalid, scopes := auth.ByToken(user.ID+1, token.Key)
+	assert.False(invalid.Exists())
+	assert.Equal(0, len(scopes))
+
+	// Rotation gives the old token a grace period
+	replacement, err := tokens.Rotate(token.Key, time.Minute)
+	require.Nil(t, err, "Error while rotating token")
+	assert.NotEqual(token.Key, replacement.Key)
+	assert.Equal(token.Name, replacement.Name)
+	assert.Equal(token.Scopes, replacement.Scopes)
+
+	old := tokens.Get(token.Key)
+	require.NotNil(t, old.Expires)
+	assert.True(old.Expires.Before(expires))
+	valid, _ = auth.ByToken(user.ID, token.Key)
+	assert.True(valid.Exists(), "The old token should work during the grace period")
+
+	auth.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	valid, _ = auth.ByToken(user.ID, token.Key)
+	assert.False(valid.Exists(), "The old token should expire after the grace period")
+	valid, _ = auth.ByToken(user.ID, replacement.Key)
+	assert.True(valid.Exists())
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTP(t *testing.T) {
+	assert := assert.New(t)
+
+	// Test vectors from RFC 6238, truncated to six digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, expected := range vectors {
+		code, err := TOTPCode(secret, time.Unix(unix, 0))
+		assert.Nil(err)
+		assert.Equal(expected, code)
+	}
+
+	// Codes are valid for the adjacent steps
+	now := time.Unix(1111111111, 0)
+	step, ok := matchTOTP(secret, "050471", now)
+	assert.True(ok)
+	assert.Equal(totpStep(now), step)
+
+	_, ok = matchTOTP(secret, "050471", now.Add(TOTPPeriod))
+	assert.True(ok)
+	_, ok = matchTOTP(secret, "050471", now.Add(3*TOTPPeriod))
+	assert.False(ok)
+	_, ok = matchTOTP(secret, "05047", now)
+	assert.False(ok)
+
+	// New secrets should be valid base32
+	_, err := TOTPCode(NewTOTPSecret(), now)
+	assert.Nil(err)
+	_, err = TOTPCode("not base32!", now)
+	assert.NotNil(err)
+
+	uri, err := url.Parse(ProvisioningURI("Volta", "a@example.com", secret))
+	assert.Nil(err)
+	assert.Equal("otpauth", uri.Scheme)
+	assert.Equal("totp", uri.Host)
+	assert.Equal("/Volta:a@example.com", uri.Path)
+	assert.Equal(secret, uri.Query().Get("secret"))
+	assert.Equal("Volta", uri.Query().Get("issuer"))
+	assert.Equal("6", uri.Query().Get("digits"))
+}
@@ -0,0 +1,396 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aodin/sol"
+	"github.com/aodin/sol/postgres"
+	"github.com/aodin/sol/types"
+)
+
+// TOTPDevice is a user's database-backed TOTP secret. The secret is
+// stored encrypted. Devices must be confirmed with a valid code before
+// they are required during login.
+type TOTPDevice struct {
+	UserID    int64     `db:"user_id"`
+	Secret    string    `db:"secret"`
+	Confirmed bool      `db:"confirmed"`
+	LastStep  int64     `db:"last_step"`
+	CreatedAt time.Time `db:"created_at,omitempty"`
+}
+
+// Exists returns true if the device exists
+func (device TOTPDevice) Exists() bool {
+	return device.UserID != 0
+}
+
+// RecoveryCode is a hashed, single use code that can be used in place of a
+// TOTP code.
+type RecoveryCode struct {
+	ID        int64     `db:"id,omitempty"`
+	UserID    int64     `db:"user_id"`
+	Code      string    `db:"code"`
+	CreatedAt time.Time `db:"created_at,omitempty"`
+}
+
+// TOTPDevices is the postgres schema for TOTP devices. Users may have
+// only one device.
+var TOTPDevices = postgres.Table("totp_devices",
+	sol.ForeignKey(
+		"user_id",
+		Users.C("id"),
+		types.Integer().NotNull(),
+	).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+	sol.Column("secret", types.Varchar().Limit(256).NotNull()),
+	sol.Column("confirmed", types.Boolean().NotNull().Default(false)),
+	sol.Column("last_step", types.Integer().NotNull().Default(0)),
+	sol.Column(
+		"created_at",
+		postgres.Timestamp().WithTimezone().NotNull().Default(postgres.Now),
+	),
+	sol.PrimaryKey("user_id"),
+)
+
+// RecoveryCodes is the postgres schema for hashed recovery codes
+var RecoveryCodes = postgres.Table("recovery_codes",
+	sol.Column("id", postgres.Serial()),
+	sol.ForeignKey(
+		"user_id",
+		Users.C("id"),
+		types.Integer().NotNull(),
+	).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+	sol.Column("code", types.Varchar().Limit(256).NotNull()),
+	sol.Column(
+		"created_at",
+		postgres.Timestamp().WithTimezone().NotNull().Default(postgres.Now),
+	),
+	sol.PrimaryKey("id"),
+)
+
+// TOTPManager is the internal manager of TOTP devices and recovery codes
+type TOTPManager struct {
+	conn    sol.Conn
+	hash    Hasher
+	key     []byte
+	nowFunc func() time.Time
+}
+
+// Enroll creates a new unconfirmed TOTP device for the given user,
+// replacing any unconfirmed device, and returns its base32 secret. It
+// errors if the user has a confirmed device, which must first be removed
+// with Disable by a user authenticated with their second factor.
+func (m *TOTPManager) Enroll(user User) (string, error) {
+	enabled, err := m.Enabled(user)
+	if err != nil {
+		return "", err
+	}
+	if enabled {
+		return "", fmt.Errorf(
+			"auth: user %d already has a confirmed TOTP device", user.ID,
+		)
+	}
+	secret := NewTOTPSecret()
+	encrypted, err := Encrypt(m.key, []byte(secret))
+	if err != nil {
+		return "", err
+	}
+	if err = m.Disable(user); err != nil {
+		return "", err
+	}
+	device := TOTPDevice{
+		UserID: user.ID,
+		Secret: EncodeBase64String(encrypted),
+	}
+	if err = m.conn.Query(TOTPDevices.Insert().Values(device)); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Get returns the TOTP device of the given user
+func (m *TOTPManager) Get(user User) (device TOTPDevice, err error) {
+	stmt := TOTPDevices.Select().Where(
+		TOTPDevices.C("user_id").Equals(user.ID),
+	)
+	err = m.conn.Query(stmt, &device)
+	return
+}
+
+// Enabled returns true if the given user has a confirmed TOTP device
+func (m *TOTPManager) Enabled(user User) (bool, error) {
+	device, err := m.Get(user)
+	return device.Confirmed, err
+}
+
+// Disable removes the TOTP device and recovery codes of the given user
+func (m *TOTPManager) Disable(user User) error {
+	stmt := TOTPDevices.Delete().Where(
+		TOTPDevices.C("user_id").Equals(user.ID),
+	)
+	if err := m.conn.Query(stmt); err != nil {
+		return err
+	}
+	return m.conn.Query(RecoveryCodes.Delete().Where(
+		RecoveryCodes.C("user_id").Equals(user.ID),
+	))
+}
+
+// Verify returns true if the given code is a valid TOTP or recovery code
+// for the given user. TOTP codes may only be used once and confirm an
+// unconfirmed device. Recovery codes are deleted once used.
+func (m *TOTPManager) Verify(user User, code string) (bool, error) {
+	device, err := m.Get(user)
+	if err != nil || !device.Exists() {
+		return false, err
+	}
+
+	code = normalizeCode(code)
+	if len(code) == TOTPDigits {
+		return m.verifyTOTP(device, code)
+	}
+	if !device.Confirmed {
+		return false, nil
+	}
+	return m.verifyRecoveryCode(user, code)
+}
+
+func (m *TOTPManager) verifyTOTP(device TOTPDevice, code string) (bool, error) {
+	encrypted, err := DecodeBase64String(device.Secret)
+	if err != nil {
+		return false, err
+	}
+	secret, err := Decrypt(m.key, encrypted)
+	if err != nil {
+		return false, err
+	}
+	step, ok := matchTOTP(string(secret), code, m.nowFunc())
+	if !ok || step <= device.LastStep {
+		return false, nil // Codes cannot be replayed
+	}
+	stmt := TOTPDevices.Update().Values(
+		sol.Values{"confirmed": true, "last_step": step},
+	).Where(TOTPDevices.C("user_id").Equals(device.UserID))
+	return true, m.conn.Query(stmt)
+}
+
+func (m *TOTPManager) verifyRecoveryCode(user User, code string) (bool, error) {
+	var codes []RecoveryCode
+	stmt := RecoveryCodes.Select().Where(
+		RecoveryCodes.C("user_id").Equals(user.ID),
+	)
+	if err := m.conn.Query(stmt, &codes); err != nil {
+		return false, err
+	}
+	for _, recovery := range codes {
+		if !CheckPassword(m.hash, code, recovery.Code) {
+			continue
+		}
+		return true, m.conn.Query(RecoveryCodes.Delete().Where(
+			RecoveryCodes.C("id").Equals(recovery.ID),
+		))
+	}
+	return false, nil
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of the given user with
+// n new codes. Only the hashes are saved, so the returned codes must be
+// shown to the user immediately.
+func (m *TOTPManager) GenerateRecoveryCodes(user User, n int) ([]string, error) {
+	stmt := RecoveryCodes.Delete().Where(
+		RecoveryCodes.C("user_id").Equals(user.ID),
+	)
+	if err := m.conn.Query(stmt); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, n)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		recovery := RecoveryCode{
+			UserID: user.ID,
+			Code:   MakePassword(m.hash, normalizeCode(codes[i])),
+		}
+		if err := m.conn.Query(RecoveryCodes.Insert().Values(recovery)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// newRecoveryCode returns a random code of the form xxxxx-xxxxx
+func newRecoveryCode() string {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	b := RandomBytes(10)
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b[:5]) + "-" + string(b[5:])
+}
+
+// normalizeCode removes any whitespace and dashes from the given code
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, code))
+}
+
+// NewTOTP creates a new TOTP manager. Secrets are encrypted with a key
+// derived from the given secret and recovery codes are hashed with the
+// given hasher. It will panic if the secret is too short.
+func NewTOTP(conn sol.Conn, secret string, hash Hasher) *TOTPManager {
+	if err := CheckSecret(secret); err != nil {
+		log.Panic(err)
+	}
+	return &TOTPManager{
+		conn:    conn,
+		hash:    hash,
+		key:     DeriveKey(secret, "auth.totp"),
+		nowFunc: func() time.Time { return time.Now().In(time.UTC) },
+	}
+}
+
+// SecondFactorRequired is returned by ByPassword when the user's password
+// was correct but a second factor is required. The Token should be given
+// to BySecondFactor along with a TOTP or recovery code. If Enroll is true,
+// the user has no TOTP device and must enroll one before logging in.
+type SecondFactorRequired struct {
+	Token  string
+	Enroll bool
+}
+
+func (e SecondFactorRequired) Error() string {
+	return "auth: a second factor is required to log in"
+}
+
+// pendingAge is how long a user has to provide their second factor
+const pendingAge = 5 * time.Minute
+
+func (auth *Auth) pendingKey() ([]byte, error) {
+	if err := CheckSecret(auth.config.SecretKey); err != nil {
+		return nil, err
+	}
+	return DeriveKey(auth.config.SecretKey, "auth.pending"), nil
+}
+
+// pendingToken returns a signed token for the given user that expires
+func (auth *Auth) pendingToken(user User) (string, error) {
+	key, err := auth.pendingKey()
+	if err != nil {
+		return "", err
+	}
+	value := fmt.Sprintf(
+		"%d:%d", user.ID, auth.now().Add(pendingAge).Unix(),
+	)
+	return Sign(key, value), nil
+}
+
+// Pending returns the user of the given pending login token for TOTP
+// enrollment. The token only proves the user's password, so it errors if
+// the user already has a confirmed device. The user has not yet been
+// authenticated by a second factor and no session should be created for
+// them.
+func (auth *Auth) Pending(token string) (user User, err error) {
+	if user, err = auth.pending(token); err != nil {
+		return
+	}
+	if auth.totp != nil {
+		var enabled bool
+		if enabled, err = auth.totp.Enabled(user); err != nil {
+			return User{}, err
+		}
+		if enabled {
+			return User{}, fmt.Errorf(
+				"auth: user %d must log in with their second factor", user.ID,
+			)
+		}
+	}
+	return
+}
+
+// pending returns the user of the given pending login token
+func (auth *Auth) pending(token string) (user User, err error) {
+	key, err := auth.pendingKey()
+	if err != nil {
+		return
+	}
+	value, ok := Unsign(key, token)
+	parts := strings.SplitN(value, ":", 2)
+	if !ok || len(parts) != 2 {
+		err = fmt.Errorf("auth: invalid pending login")
+		return
+	}
+	id, _ := strconv.ParseInt(parts[0], 10, 64)
+	expires, _ := strconv.ParseInt(parts[1], 10, 64)
+	if !auth.now().Before(time.Unix(expires, 0)) {
+		err = fmt.Errorf("auth: pending login has expired")
+		return
+	}
+	return auth.users.GetByID(id)
+}
+
+// BySecondFactor completes a login started by ByPassword with the given
+// pending login token and TOTP or recovery code. Only then should
+// CreateSession be called for the returned user. Failed codes count
+// against the user's email if the auth has a throttle.
+func (auth *Auth) BySecondFactor(token, code string) (user User, err error) {
+	user, err = auth.bySecondFactor(token, code)
+	auth.recordLogin(user.ID, user.Email, "", err)
+	if err != nil {
+		user = User{} // Do not leak user information
+	}
+	return
+}
+
+func (auth *Auth) bySecondFactor(token, code string) (user User, err error) {
+	if user, err = auth.pending(token); err != nil {
+		return User{}, err
+	}
+	if auth.throttle != nil {
+		if err = auth.throttle.Allow(auth.now(), user.Email, ""); err != nil {
+			return
+		}
+	}
+
+	if auth.totp == nil {
+		return user, fmt.Errorf("auth: TOTP is not available")
+	}
+	ok, err := auth.totp.Verify(user, code)
+	if err != nil || !ok {
+		if auth.throttle != nil {
+			if failErr := auth.throttle.Fail(auth.now(), user.Email, ""); failErr != nil {
+				log.Printf("auth: could not record failed second factor: %s", failErr)
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("auth: invalid code for user %d", user.ID)
+		}
+	}
+	return
+}
+
+// secondFactor returns a SecondFactorRequired error if the given user must
+// provide a second factor before logging in.
+func (auth *Auth) secondFactor(user User) (User, error) {
+	var enabled bool
+	if auth.totp != nil {
+		var err error
+		if enabled, err = auth.totp.Enabled(user); err != nil {
+			return User{}, err
+		}
+	}
+	if enabled || (user.IsSuperuser && auth.superuser2FA) {
+		token, err := auth.pendingToken(user)
+		if err != nil {
+			return User{}, err
+		}
+		return User{}, SecondFactorRequired{Token: token, Enroll: !enabled}
+	}
+	return user, nil
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTwoFactor(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens, TOTPDevices, RecoveryCodes)
+
+	// TOTP must be enabled with a secret key
+	_, err := Mock(config.Default, tx).EnableTOTP()
+	assert.NotNil(err, "TOTP should not be enabled without a secret key")
+
+	auth := Mock(testConfig(), tx)
+	assert.Nil(auth.TOTP(), "TOTP should be disabled by default")
+	totp, err := auth.EnableTOTP()
+	require.Nil(t, err)
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	auth.now = func() time.Time { return now }
+	totp.nowFunc = auth.now
+
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+
+	// Users without a device log in with a password
+	valid, err := auth.ByPassword("a@example.com", "secret")
+	require.Nil(t, err)
+	assert.Equal(user.ID, valid.ID)
+
+	// Enroll a device - it is not required until confirmed
+	secret, err := auth.TOTP().Enroll(user)
+	require.Nil(t, err, "Enroll should not error")
+	enabled, err := auth.TOTP().Enabled(user)
+	assert.Nil(err)
+	assert.False(enabled)
+
+	code, err := TOTPCode(secret, now)
+	require.Nil(t, err)
+	ok, err := auth.TOTP().Verify(user, code)
+	assert.Nil(err)
+	assert.True(ok, "The current TOTP code should verify")
+
+	enabled, err = auth.TOTP().Enabled(user)
+	assert.Nil(err)
+	assert.True(enabled)
+
+	// Codes cannot be replayed
+	ok, _ = auth.TOTP().Verify(user, code)
+	assert.False(ok, "A TOTP code should only verify once")
+
+	// Login now requires a second factor
+	var log bytes.Buffer
+	auth.SetAuditSink(NewWriterAuditSink(&log, "secret", ""))
+	_, err = auth.ByPassword("a@example.com", "secret")
+	require.IsType(t, SecondFactorRequired{}, err)
+	pending := err.(SecondFactorRequired)
+	assert.False(pending.Enroll)
+
+	// The password alone cannot replace a confirmed device
+	_, err = auth.Pending(pending.Token)
+	assert.NotNil(err, "Pending tokens should not enroll over a confirmed device")
+	_, err = auth.TOTP().Enroll(user)
+	assert.NotNil(err, "Enroll should not replace a confirmed device")
+	enabled, err = auth.TOTP().Enabled(user)
+	assert.Nil(err)
+	assert.True(enabled)
+
+	_, err = auth.BySecondFactor(pending.Token, "000000")
+	assert.NotNil(err, "An invalid code should not log in")
+
+	now = now.Add(TOTPPeriod)
+	code, _ = TOTPCode(secret, now)
+	valid, err = auth.BySecondFactor(pending.Token, code)
+	require.Nil(t, err, "A valid code should log in")
+	assert.Equal(user.ID, valid.ID)
+
+	// Waiting for a second factor is not a failed login
+	events, err := ReadAuditEvents(&log)
+	require.Nil(t, err)
+	assert.Equal(
+		[]AuditAction{SecondFactorRequested, LoginFailed, LoginSucceeded},
+		actions(events),
+	)
+	assert.Equal(user.ID, events[0].UserID)
+	assert.Equal(user.ID, events[1].UserID, "Failed codes should be audited")
+	auth.SetAuditSink(nil)
+
+	// Recovery codes can be used once
+	codes, err := auth.TOTP().GenerateRecoveryCodes(user, 10)
+	require.Nil(t, err)
+	assert.Equal(10, len(codes))
+
+	valid, err = auth.BySecondFactor(pending.Token, codes[0])
+	require.Nil(t, err, "A recovery code should log in")
+	assert.Equal(user.ID, valid.ID)
+
+	_, err = auth.BySecondFactor(pending.Token, codes[0])
+	assert.NotNil(err, "A recovery code should only be used once")
+
+	// Pending logins expire
+	now = now.Add(pendingAge)
+	_, err = auth.BySecondFactor(pending.Token, codes[1])
+	assert.NotNil(err, "An expired pending login should not log in")
+
+	// Superusers can be required to enroll, but only with TOTP
+	assert.NotNil(Mock(testConfig(), tx).RequireSuperuserSecondFactor(true))
+	require.Nil(t, auth.RequireSuperuserSecondFactor(true))
+	admin, err := auth.users.CreateSuperuser("b@example.com", "b", "b", "secret")
+	require.Nil(t, err)
+	_, err = auth.ByPassword("b@example.com", "secret")
+	require.IsType(t, SecondFactorRequired{}, err)
+	assert.True(err.(SecondFactorRequired).Enroll)
+
+	pendingAdmin, err := auth.Pending(err.(SecondFactorRequired).Token)
+	require.Nil(t, err)
+	assert.Equal(admin.ID, pendingAdmin.ID)
+
+	// Disabling removes the device and recovery codes
+	assert.Nil(auth.TOTP().Disable(user))
+	enabled, err = auth.TOTP().Enabled(user)
+	assert.Nil(err)
+	assert.False(enabled)
+}
@@ -7,25 +7,27 @@ import (
 	"time"
 
 	"github.com/aodin/sol"
-	"github.com/aodin/sol/postgres"
 	"github.com/aodin/sol/types"
 )
 
 // User is a database-backed user.
 type User struct {
-	ID          int64        `db:"id,omitempty"`
-	Email       string       `db:"email"`
-	FirstName   string       `db:"first_name"`
-	LastName    string       `db:"last_name"`
-	About       string       `db:"about"`
-	Photo       string       `db:"photo"`
-	IsActive    bool         `db:"is_active"`
-	IsSuperuser bool         `db:"is_superuser"`
-	Password    string       `db:"password"`
-	Token       string       `db:"token"`
-	TokenSetAt  time.Time    `db:"token_set_at,omitempty"`
-	CreatedAt   time.Time    `db:"created_at,omitempty"`
-	manager     *UserManager `db:"-"`
+	ID              int64      `db:"id,omitempty"`
+	Email           string     `db:"email"`
+	FirstName       string     `db:"first_name"`
+	LastName        string     `db:"last_name"`
+	About           string     `db:"about"`
+	Photo           string     `db:"photo"`
+	IsActive        bool       `db:"is_active"`
+	IsSuperuser     bool       `db:"is_superuser"`
+	Password        string     `db:"password"`
+	Token           string     `db:"token"`
+	TokenSetAt      time.Time  `db:"token_set_at,omitempty"`
+	CreatedAt       time.Time  `db:"created_at,omitempty"`
+	EmailVerifiedAt *time.Time `db:"email_verified_at"`
+	SessionVersion  int64      `db:"session_version"`
+	manager         UserStore  `db:"-"`
+	perms           *permCache `db:"-"`
 }
 
 // Delete removes the user with the given ID from the database.
@@ -43,6 +45,11 @@ func (user User) Exists() bool {
 	return user.ID != 0
 }
 
+// IsVerified returns true if the user's email address has been verified
+func (user User) IsVerified() bool {
+	return user.EmailVerifiedAt != nil
+}
+
 // Name returns the concatenated first and last name
 func (user User) Name() string {
 	return fmt.Sprintf("%s %s", user.FirstName, user.LastName)
@@ -54,28 +61,92 @@ func (user User) String() string {
 }
 
 // Users is the postgres schema for users
-var Users = postgres.Table("users",
-	sol.Column("id", postgres.Serial()),
-	sol.Column("email", types.Varchar().Limit(256).NotNull()),
-	sol.Column("first_name", types.Varchar().Limit(64).NotNull()),
-	sol.Column("last_name", types.Varchar().Limit(64).NotNull()),
-	sol.Column("about", types.Varchar().Limit(512).NotNull()),
-	sol.Column("photo", types.Varchar().Limit(512).NotNull()),
-	sol.Column("is_active", types.Boolean().NotNull().Default(true)),
-	sol.Column("is_superuser", types.Boolean().NotNull().Default(false)),
-	sol.Column("password", types.Varchar().Limit(256).NotNull()),
-	sol.Column("token", types.Varchar().Limit(256).NotNull()),
-	sol.Column(
-		"token_set_at",
-		postgres.Timestamp().WithTimezone().NotNull().Default(postgres.Now),
-	),
-	sol.Column(
-		"created_at",
-		postgres.Timestamp().WithTimezone().NotNull().Default(postgres.Now),
-	),
-	sol.PrimaryKey("id"),
-	sol.Unique("email"),
-)
+var Users = usersTable(Postgres, SchemaVersion)
+
+// usersTable declares the users table for the given dialect as it was at
+// the given schema version
+func usersTable(d Dialect, version int) *sol.TableElem {
+	modifiers := []sol.Modifier{
+		sol.Column("id", d.serial()),
+		sol.Column("email", types.Varchar().Limit(256).NotNull()),
+		sol.Column("first_name", types.Varchar().Limit(64).NotNull()),
+		sol.Column("last_name", types.Varchar().Limit(64).NotNull()),
+		sol.Column("about", types.Varchar().Limit(512).NotNull()),
+		sol.Column("photo", types.Varchar().Limit(512).NotNull()),
+		sol.Column("is_active", types.Boolean().NotNull().Default(true)),
+		sol.Column("is_superuser", types.Boolean().NotNull().Default(false)),
+		sol.Column("password", types.Varchar().Limit(256).NotNull()),
+		sol.Column("token", types.Varchar().Limit(256).NotNull()),
+		sol.Column("token_set_at", d.created()),
+		sol.Column("created_at", d.created()),
+		sol.PrimaryKey("id"),
+		sol.Unique("email"),
+	}
+	if version >= 2 {
+		modifiers = append(modifiers,
+			sol.Column("email_verified_at", d.timestamp()),
+		)
+	}
+	if version >= 3 {
+		modifiers = append(modifiers,
+			sol.Column("session_version", types.Integer().NotNull().Default(0)),
+		)
+	}
+	return d.table("users", modifiers...)
+}
+
+// UserStore stores users. Users returned by a store should be attached to
+// it, so that they can be deleted and their permissions checked.
+type UserStore interface {
+	// Create creates a new user with the given email and cleartext
+	// password. Emails must be unique.
+	Create(email, first, last, clear string) (User, error)
+
+	// CreateSuperuser is Create for a superuser
+	CreateSuperuser(email, first, last, clear string) (User, error)
+
+	// Delete removes the user with the given ID
+	Delete(id int64) error
+
+	// GetByEmail returns the user with the given email or an error
+	GetByEmail(email string) (User, error)
+
+	// GetByID returns the user with the given ID or an error
+	GetByID(id int64) (User, error)
+
+	// Hasher returns the hasher of new passwords
+	Hasher() Hasher
+
+	// SetPassword hashes and saves the given cleartext password and ends
+	// the user's sessions
+	SetPassword(user *User, cleartext string) error
+
+	// RehashPassword hashes and saves the user's current cleartext password
+	// without ending their sessions
+	RehashPassword(user *User, cleartext string) error
+
+	// SetVerified marks the user's email as verified at the given time
+	SetVerified(user *User, at time.Time) error
+
+	// SetActive sets whether the user is active. Deactivating a user ends
+	// their sessions.
+	SetActive(user *User, active bool) error
+
+	// SetToken saves the given user token and the time it was set
+	SetToken(user *User, token string, at time.Time) error
+
+	// ConsumeToken clears the token of the user with the given ID if it
+	// is the given token, and returns true if this call cleared it
+	ConsumeToken(id int64, token string) (bool, error)
+
+	// BumpSessionVersion increments the session version of the user with
+	// the given ID
+	BumpSessionVersion(id int64) error
+
+	// Permissions returns the names of the permissions of the user with
+	// the given ID
+	Permissions(id int64) []string
+}
 
 // UserManager is the internal manager of users
 type UserManager struct {
@@ -97,6 +168,7 @@ func (m *UserManager) CreateSuperuser(email, first, last, clear string) (User, e
 }
 
 func (m *UserManager) create(email, first, last, clear string, isAdmin bool) (User, error) {
+	token := m.tokenFunc()
 	user := User{
 		Email:       email,
 		FirstName:   first,
@@ -104,12 +176,16 @@ func (m *UserManager) create(email, first, last, clear string, isAdmin bool) (Us
 		IsActive:    true,
 		IsSuperuser: isAdmin,
 		Password:    MakePassword(m.hash, clear),
-		Token:       m.tokenFunc(),
+		Token:       HashKey(token),
 		TokenSetAt:  time.Now(),
 		manager:     m,
+		perms:       &permCache{},
+	}
+	if err := m.createUser(&user); err != nil {
+		return user, err
 	}
-	err := m.createUser(&user)
-	return user, err
+	user.Token = token // Only the digest is stored
+	return user, nil
 }
 
 // createUser checks for a duplicate email before inserting the user.
@@ -120,16 +196,31 @@ func (m *UserManager) createUser(user *User) error {
 	).Where(Users.C("email").Equals(user.Email)).Limit(1)
 
 	var duplicate string
-	m.conn.Query(email, &duplicate)
+	if err := m.conn.Query(email, &duplicate); err != nil {
+		return err
+	}
 	if duplicate != "" {
 		return fmt.Errorf(
 			"auth: user with email %s already exists", duplicate,
 		)
 	}
 
-	// Insert the new user
-	m.conn.Query(postgres.Insert(Users).Values(user).Returning(), user)
-	return nil
+	// Insert the new user and select it by its email to get its ID -
+	// not every dialect supports RETURNING. A concurrent create of the
+	// same email fails the insert on the unique constraint.
+	now := time.Now()
+	if user.TokenSetAt.IsZero() {
+		user.TokenSetAt = now
+	}
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	if err := m.conn.Query(Users.Insert().Values(user)); err != nil {
+		return err
+	}
+	return m.conn.Query(
+		Users.Select().Where(Users.C("email").Equals(user.Email)), user,
+	)
 }
 
 // Delete removes the user with the given ID from the database.
@@ -148,7 +239,9 @@ func (m *UserManager) GetByEmail(email string) (user User, err error) {
 	}
 	if !user.Exists() {
 		err = fmt.Errorf("auth: no user with email %s exists", email)
+		return
 	}
+	m.attach(&user)
 	return
 }
 
@@ -160,19 +253,203 @@ func (m *UserManager) GetByID(id int64) (user User, err error) {
 	}
 	if !user.Exists() {
 		err = fmt.Errorf("auth: no user with id %d exists", id)
+		return
 	}
+	m.attach(&user)
 	return
 }
 
+// attach sets the manager of the given user and gives it an empty
+// permission cache
+func (m *UserManager) attach(user *User) {
+	user.manager = m
+	user.perms = &permCache{}
+}
+
+// SetPassword hashes the given cleartext password with the manager's
+// hasher and saves it to the given user, then ends all of the user's
+// sessions. Use Auth.ChangePassword to also revoke their API tokens.
+func (m *UserManager) SetPassword(user *User, cleartext string) error {
+	if err := m.RehashPassword(user, cleartext); err != nil {
+		return err
+	}
+	return m.endSessions(user)
+}
+
+// RehashPassword hashes the given cleartext password with the manager's
+// hasher and saves it to the given user without ending their sessions. It
+// should only be used to upgrade the hash of the user's current password.
+func (m *UserManager) RehashPassword(user *User, cleartext string) error {
+	if !user.Exists() {
+		return fmt.Errorf("auth: users without IDs cannot set a password")
+	}
+	password := MakePassword(m.hash, cleartext)
+	stmt := Users.Update().Values(
+		sol.Values{"password": password},
+	).Where(Users.C("id").Equals(user.ID))
+	if err := m.conn.Query(stmt); err != nil {
+		return err
+	}
+	user.Password = password
+	return nil
+}
+
+// SetVerified marks the email address of the given user as verified at the
+// given time.
+func (m *UserManager) SetVerified(user *User, at time.Time) error {
+	if !user.Exists() {
+		return fmt.Errorf("auth: users without IDs cannot be verified")
+	}
+	stmt := Users.Update().Values(
+		sol.Values{"email_verified_at": at},
+	).Where(Users.C("id").Equals(user.ID))
+	if err := m.conn.Query(stmt); err != nil {
+		return err
+	}
+	user.EmailVerifiedAt = &at
+	return nil
+}
+
+// SetActive sets whether the given user is active. Inactive users
+// cannot log in, and deactivating a user ends all of their sessions.
+func (m *UserManager) SetActive(user *User, active bool) error {
+	if !user.Exists() {
+		return fmt.Errorf("auth: users without IDs cannot be deactivated")
+	}
+	stmt := Users.Update().Values(
+		sol.Values{"is_active": active},
+	).Where(Users.C("id").Equals(user.ID))
+	if err := m.conn.Query(stmt); err != nil {
+		return err
+	}
+	user.IsActive = active
+	if active {
+		return nil
+	}
+	return m.endSessions(user)
+}
+
+// endSessions revokes the user's cookie sessions by bumping their session
+// version and deletes their sessions from the sessions table
+func (m *UserManager) endSessions(user *User) error {
+	if err := m.BumpSessionVersion(user.ID); err != nil {
+		return err
+	}
+	user.SessionVersion += 1
+	stmt := Sessions.Delete().Where(Sessions.C("user_id").Equals(user.ID))
+	return m.conn.Query(stmt)
+}
+
+// SetToken saves the given user token, such as for a password reset, and
+// the time it was set. An empty token clears the user's token.
+func (m *UserManager) SetToken(user *User, token string, at time.Time) error {
+	if !user.Exists() {
+		return fmt.Errorf("auth: users without IDs cannot set a token")
+	}
+	stmt := Users.Update().Values(
+		sol.Values{"token": token, "token_set_at": at},
+	).Where(Users.C("id").Equals(user.ID))
+	if err := m.conn.Query(stmt); err != nil {
+		return err
+	}
+	user.Token, user.TokenSetAt = token, at
+	return nil
+}
+
+// ConsumeToken clears the token of the user with the given ID if it is the
+// given token, and returns true if this call cleared it. Concurrent calls
+// with the same token succeed only once. Not every dialect reports the
+// rows changed by an update, so the token is first claimed with a value
+// unique to this call.
+func (m *UserManager) ConsumeToken(id int64, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	claim := HashKey(RandomKey())
+	claimed := Users.Update().Values(sol.Values{"token": claim}).Where(
+		Users.C("id").Equals(id),
+		Users.C("token").Equals(token),
+	)
+	if err := m.conn.Query(claimed); err != nil {
+		return false, err
+	}
+	var current string
+	stmt := sol.Select(Users.C("token")).Where(Users.C("id").Equals(id))
+	if err := m.conn.Query(stmt, &current); err != nil || current != claim {
+		return false, err
+	}
+	cleared := Users.Update().Values(sol.Values{"token": ""}).Where(
+		Users.C("id").Equals(id),
+		Users.C("token").Equals(claim),
+	)
+	if err := m.conn.Query(cleared); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ClearTokensBefore clears up to limit user tokens, such as unused
+// password reset tokens, that were set before the given time and returns
+// the number cleared.
+func (m *UserManager) ClearTokensBefore(before time.Time, limit int) (int64, error) {
+	var ids []int64
+	stmt := sol.Select(Users.C("id")).Where(
+		Users.C("token").DoesNotEqual(""),
+		Users.C("token_set_at").LessThan(before),
+	).Limit(limit)
+	if err := m.conn.Query(stmt, &ids); err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	cleared := Users.Update().Values(
+		sol.Values{"token": ""},
+	).Where(
+		Users.C("id").In(ids),
+		Users.C("token").DoesNotEqual(""),
+		Users.C("token_set_at").LessThan(before),
+	)
+	if err := m.conn.Query(cleared); err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
+// bumpSessionVersion increments the version in a single statement, so that
+// concurrent bumps are not lost
+const bumpSessionVersion = `UPDATE users
+SET session_version = session_version + 1
+WHERE id = :id`
+
+// BumpSessionVersion increments the session version of the user with the
+// given ID, which revokes all of their stateless cookie sessions.
+func (m *UserManager) BumpSessionVersion(id int64) error {
+	return m.conn.Query(sol.Text(bumpSessionVersion, sol.Values{"id": id}))
+}
+
 // Hasher returns the hasher used by the UserManager
 func (m UserManager) Hasher() Hasher {
 	return m.hash
 }
 
+// DefaultHasher is the name of the hasher used by NewUsers
+const DefaultHasher = "pbkdf2_sha256"
+
+// NewUsers creates a user manager that hashes passwords with the
+// DefaultHasher.
 func NewUsers(conn sol.Conn) *UserManager {
-	hasher, err := GetHasher("pbkdf2_sha256")
+	return NewUsersWithHasher(conn, DefaultHasher)
+}
+
+// NewUsersWithHasher creates a user manager that hashes passwords with the
+// registered hasher of the given name, such as "argon2id" or "scrypt".
+// It will panic if no hasher with that name exists or if the hasher can
+// only verify passwords, such as "bcrypt".
+func NewUsersWithHasher(conn sol.Conn, name string) *UserManager {
+	hasher, err := GetHasher(name)
 	if err != nil {
-		log.Panicf("auth: could not get pbkdf2_sha256 hasher: %s", err)
+		log.Panicf("auth: could not get %s hasher: %s", name, err)
+	}
+	if !CanEncode(hasher) {
+		log.Panicf("auth: the %s hasher can only verify passwords", name)
 	}
 	return newUsers(conn, hasher)
 }
@@ -188,3 +465,6 @@ func newUsers(conn sol.Conn, hash Hasher) *UserManager {
 		tokenFunc: RandomKey,
 	}
 }
+
+// UserManager should implement the UserStore interface
+var _ UserStore = &UserManager{}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,4 +32,9 @@ func TestUsers(t *testing.T) {
 
 	// Only users with IDs can be deleted
 	assert.NotNil(User{}.Delete(), "Delete did not error for a zero ID user")
+
+	// Failed inserts are returned, such as the unique email constraint
+	// violated by a concurrent create. This aborts the transaction.
+	_, err = users.Create("b@example.com", strings.Repeat("b", 65), "B", "secret")
+	assert.NotNil(err, "A failed insert should error")
 }
@@ -2,8 +2,10 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"io"
 	"log"
 )
@@ -14,6 +16,35 @@ func RandomKey() string {
 	return RandomKeyN(24)
 }
 
+// HashKey returns the hex encoded SHA-256 digest of the given key. Keys are
+// random, so a fast unsalted hash is enough to keep the session and token
+// keys sent to clients out of the database.
+func HashKey(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+// PrefixLength is the length of the non-secret lookup prefix of tokens
+const PrefixLength = 8
+
+// KeyPrefix returns the lookup prefix of the given key
+func KeyPrefix(key string) string {
+	if len(key) < PrefixLength {
+		return key
+	}
+	return key[:PrefixLength]
+}
+
+// isDigest returns true if the given value looks like the output of
+// HashKey rather than a key generated by RandomKey
+func isDigest(value string) bool {
+	if len(value) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
 // RandomKeyN generates a new Base 64 encoded random string. N is the length
 // of the random bytes, not the final encoded string.
 func RandomKeyN(n int) string {
@@ -59,3 +90,8 @@ func ConstantTimeStringCompare(x, y string) bool {
 func EncodeBase64String(input []byte) string {
 	return base64.URLEncoding.EncodeToString(input)
 }
+
+// DecodeBase64String is a wrapper around the standard base64 decoding call.
+func DecodeBase64String(input string) ([]byte, error) {
+	return base64.URLEncoding.DecodeString(input)
+}
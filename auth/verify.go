@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aodin/volta/email"
+)
+
+// DefaultVerifyTemplate is the default body of email verification emails.
+// It is given the User and the verification URL as Link.
+var DefaultVerifyTemplate = template.Must(template.New("verify").Parse(
+	`<p>Hello {{ .User.FirstName }},</p>
+<p>Please confirm your email address by following this link:</p>
+<p><a href="{{ .Link }}">{{ .Link }}</a></p>
+<p>If you did not create an account, you can ignore this email.</p>`,
+))
+
+// EmailNotVerified is returned by ByPassword when the auth requires
+// verified email addresses and the user has not verified theirs.
+type EmailNotVerified struct {
+	Email string
+}
+
+func (e EmailNotVerified) Error() string {
+	return fmt.Sprintf("auth: email %s has not been verified", e.Email)
+}
+
+// EmailVerification emails users a signed link that verifies their
+// email address. Links expire after MaxAge and are only valid for the
+// email address they were sent to. Links can be resent to an email once
+// per ResendInterval, which is tracked by the Resends store.
+type EmailVerification struct {
+	auth   *Auth
+	sender email.Sender
+	url    string
+	key    []byte
+
+	MaxAge         time.Duration
+	ResendInterval time.Duration
+	Resends        ThrottleStore
+	Subject        string
+	Template       *template.Template
+}
+
+// Token returns a signed verification token for the given user
+func (v *EmailVerification) Token(user User) string {
+	value := fmt.Sprintf(
+		"%d:%d:%s",
+		user.ID, v.auth.now().Add(v.MaxAge).Unix(), user.Email,
+	)
+	return Sign(v.key, value)
+}
+
+// Link returns the verification link for the given user
+func (v *EmailVerification) Link(user User) string {
+	values := url.Values{}
+	values.Set("token", v.Token(user))
+	return v.url + "?" + values.Encode()
+}
+
+// Send emails a verification link to the given user
+func (v *EmailVerification) Send(user User) error {
+	body := new(bytes.Buffer)
+	attrs := map[string]interface{}{"User": user, "Link": v.Link(user)}
+	if err := v.Template.Execute(body, attrs); err != nil {
+		return err
+	}
+	return v.sender.Send(user.Email, v.Subject, body.String())
+}
+
+// Resend emails a new verification link to the active, unverified user
+// with the given email, since unverified users may be unable to log in. No
+// error is returned if there is no such user, so that the existence of
+// accounts is not leaked, but every email is throttled.
+func (v *EmailVerification) Resend(address string) error {
+	normalized, err := email.Normalize(address)
+	if err != nil {
+		return err
+	}
+	key := "verify:" + normalized
+	now := v.auth.now()
+	last, err := v.Resends.Get(key)
+	if err != nil {
+		return err
+	}
+	if last.Failures > 0 && !now.Before(last.LastFailure.Add(v.ResendInterval)) {
+		if err = v.Resends.Clear(key); err != nil {
+			return err
+		}
+	}
+	// Only the first concurrent request since the last send is counted once
+	sent, err := v.Resends.Fail(key, now)
+	if err != nil {
+		return err
+	}
+	if sent.Failures > 1 {
+		return fmt.Errorf("auth: a verification email was sent recently")
+	}
+
+	user, err := v.auth.users.GetByEmail(normalized)
+	if err != nil || !user.Exists() || !user.IsActive || user.IsVerified() {
+		return nil
+	}
+	return v.Send(user)
+}
+
+// Verify marks the user of the given token as verified if the token is
+// valid, has not expired, and matches the user's current email address.
+func (v *EmailVerification) Verify(token string) (user User, err error) {
+	value, ok := Unsign(v.key, token)
+	parts := strings.SplitN(value, ":", 3)
+	if !ok || len(parts) != 3 {
+		err = fmt.Errorf("auth: invalid verification token")
+		return
+	}
+	id, _ := strconv.ParseInt(parts[0], 10, 64)
+	expires, _ := strconv.ParseInt(parts[1], 10, 64)
+	if !v.auth.now().Before(time.Unix(expires, 0)) {
+		err = fmt.Errorf("auth: verification token has expired")
+		return
+	}
+	if user, err = v.auth.users.GetByID(id); err != nil {
+		return
+	}
+	if user.Email != parts[2] {
+		user = User{} // Don't leak user info
+		err = fmt.Errorf("auth: verification token is for another email")
+		return
+	}
+	if user.IsVerified() {
+		return
+	}
+	err = v.auth.users.SetVerified(&user, v.auth.now())
+	return
+}
+
+// NewEmailVerification creates an email verification service that sends
+// emails with the given sender. The given URL is the page that verifies
+// the token, which will be added to its query. Resends are tracked in
+// memory, so set Resends to a shared store when running several processes.
+// It will panic if the auth's secret key is too short.
+func NewEmailVerification(auth *Auth, sender email.Sender, url string) *EmailVerification {
+	if err := CheckSecret(auth.config.SecretKey); err != nil {
+		log.Panic(err)
+	}
+	return &EmailVerification{
+		auth:           auth,
+		sender:         sender,
+		url:            url,
+		key:            DeriveKey(auth.config.SecretKey, "auth.verify"),
+		MaxAge:         3 * 24 * time.Hour,
+		ResendInterval: 5 * time.Minute,
+		Resends:        NewMemoryThrottleStore(),
+		Subject:        "Confirm your email address",
+		Template:       DefaultVerifyTemplate,
+	}
+}
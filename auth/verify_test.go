@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/aodin/sol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmailVerification(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens, TOTPDevices, RecoveryCodes)
+
+	assert.Panics(func() {
+		NewEmailVerification(Mock(config.Default, tx), &mockSender{}, "/")
+	}, "Verification should require a secret key")
+
+	auth := Mock(testConfig(), tx)
+	now := time.Now().In(time.UTC)
+	auth.now = func() time.Time { return now }
+
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+	assert.False(user.IsVerified(), "New users should not be verified")
+	session := auth.sessions.Create(user)
+
+	// Unverified users can be refused
+	auth.RequireVerifiedEmail(true)
+	_, err = auth.ByPassword("a@example.com", "secret")
+	assert.IsType(EmailNotVerified{}, err)
+	assert.False(auth.BySession(session.Key).Exists())
+
+	// Send a verification link
+	sender := &mockSender{}
+	verification := NewEmailVerification(auth, sender, "https://example.com/verify")
+	require.Nil(t, verification.Send(user))
+	require.Equal(t, 1, len(sender.to))
+	assert.Equal("a@example.com", sender.to[0])
+
+	start := strings.Index(sender.body[0], "https://example.com/verify?")
+	require.True(t, start >= 0, "Email did not contain a verification link")
+	end := strings.Index(sender.body[0][start:], `"`)
+	link, err := url.Parse(sender.body[0][start : start+end])
+	require.Nil(t, err)
+	token := link.Query().Get("token")
+
+	// Invalid and expired tokens do not verify
+	_, err = verification.Verify(token + "x")
+	assert.NotNil(err, "Invalid tokens should error")
+
+	now = now.Add(verification.MaxAge)
+	_, err = verification.Verify(token)
+	assert.NotNil(err, "Expired tokens should error")
+	now = now.Add(-verification.MaxAge)
+
+	// Verify the user
+	verified, err := verification.Verify(token)
+	require.Nil(t, err, "Verify should not error")
+	assert.True(verified.IsVerified())
+
+	valid, err := auth.ByPassword("a@example.com", "secret")
+	require.Nil(t, err, "Verified users should log in")
+	assert.True(valid.IsVerified())
+	assert.True(auth.BySession(session.Key).Exists())
+
+	// Links are only resent to unverified users, and throttled per email
+	other, err := auth.CreateUser("b@example.com", "other", "guy", "secret")
+	require.Nil(t, err)
+	sender.to = nil
+	assert.Nil(verification.Resend("A@example.com"), "Verified users should not error")
+	assert.Nil(verification.Resend("nobody@example.com"), "Unknown emails should not error")
+	assert.Nil(verification.Resend("b@example.com"))
+	assert.Equal([]string{"b@example.com"}, sender.to)
+	assert.NotNil(verification.Resend("B@example.com"), "Resends should be throttled")
+	assert.NotNil(verification.Resend("nobody@example.com"), "Resends should be throttled")
+	now = now.Add(verification.ResendInterval)
+	assert.Nil(verification.Resend("b@example.com"))
+	assert.Equal(2, len(sender.to))
+
+	// Tokens are only valid for the email they were sent to
+	token = verification.Token(other)
+	other.Email = "c@example.com"
+	tx.Query(Users.Update().Values(
+		sol.Values{"email": other.Email},
+	).Where(Users.C("id").Equals(other.ID)))
+	_, err = verification.Verify(token)
+	assert.NotNil(err, "Tokens for a previous email should error")
+}
@@ -0,0 +1,589 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aodin/sol"
+	"github.com/aodin/sol/postgres"
+	"github.com/aodin/sol/types"
+)
+
+// Credential is a database-backed WebAuthn public key credential, also
+// known as a passkey. The ID and public key are base64 URL encoded.
+type Credential struct {
+	ID         string     `db:"id"`
+	UserID     int64      `db:"user_id"`
+	PublicKey  string     `db:"public_key"`
+	SignCount  int64      `db:"sign_count"`
+	CreatedAt  time.Time  `db:"created_at,omitempty"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+}
+
+// Exists returns true if the credential exists
+func (credential Credential) Exists() bool {
+	return credential.ID != ""
+}
+
+// Credentials is the postgres schema for WebAuthn credentials
+var Credentials = postgres.Table("credentials",
+	sol.Column("id", types.Varchar().Limit(1024).NotNull()),
+	sol.ForeignKey(
+		"user_id",
+		Users.C("id"),
+		types.Integer().NotNull(),
+	).OnDelete(sol.Cascade).OnUpdate(sol.Cascade),
+	sol.Column("public_key", types.Varchar().Limit(2048).NotNull()),
+	// Signature counters are unsigned 32 bit integers
+	sol.Column("sign_count", renamedType{
+		types.Integer().NotNull().Default(0), "INTEGER", "BIGINT",
+	}),
+	sol.Column(
+		"created_at",
+		postgres.Timestamp().WithTimezone().NotNull().Default(postgres.Now),
+	),
+	sol.Column("last_used_at", postgres.Timestamp().WithTimezone()),
+	sol.PrimaryKey("id"),
+)
+
+// UsedChallenges is the postgres schema for WebAuthn challenges that were
+// used. Challenges are signed rather than stored, but each can only be
+// used once: a captured response cannot be replayed before it expires.
+var UsedChallenges = postgres.Table("webauthn_challenges",
+	sol.Column("key", types.Varchar().Limit(64).NotNull()),
+	sol.Column("expires", postgres.Timestamp().WithTimezone().NotNull()),
+	sol.PrimaryKey("key"),
+)
+
+// CredentialParameter is a supported public key algorithm
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+// CredentialDescriptor identifies an existing credential
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// RelyingParty identifies the site to the authenticator
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// CredentialUser identifies the user to the authenticator
+type CredentialUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// AuthenticatorSelection states the preferred authenticator features
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the options given to navigator.credentials.create().
+// Binary fields are base64 URL encoded and must be decoded by the client.
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     RelyingParty           `json:"rp"`
+	User                   CredentialUser         `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options given to navigator.credentials.get().
+// Binary fields are base64 URL encoded and must be decoded by the client.
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// AuthenticatorResponse is the response of a registration or login
+// ceremony. Registrations set AttestationObject, logins set
+// AuthenticatorData and Signature.
+type AuthenticatorResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+// PublicKeyCredential is the JSON serialized result of a WebAuthn
+// ceremony, with all binary fields base64 URL encoded.
+type PublicKeyCredential struct {
+	ID       string                `json:"id"`
+	Type     string                `json:"type"`
+	Response AuthenticatorResponse `json:"response"`
+}
+
+// clientData is the parsed clientDataJSON of a ceremony
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is the parsed authenticator data of a ceremony
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte // CBOR encoded COSE key
+}
+
+// Authenticator data flags
+const (
+	flagUserPresent  byte = 0x01
+	flagUserVerified byte = 0x04
+	flagAttested     byte = 0x40
+)
+
+func parseAuthenticatorData(data []byte) (ad authenticatorData, err error) {
+	if len(data) < 37 {
+		err = fmt.Errorf("auth: authenticator data is too short")
+		return
+	}
+	ad.rpIDHash = data[:32]
+	ad.flags = data[32]
+	ad.signCount = binary.BigEndian.Uint32(data[33:37])
+	if ad.flags&flagAttested == 0 {
+		return
+	}
+
+	// Attested credential data: AAGUID, ID length, ID and COSE key
+	rest := data[37:]
+	if len(rest) < 18 {
+		err = fmt.Errorf("auth: attested credential data is too short")
+		return
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < n {
+		err = fmt.Errorf("auth: credential id is too short")
+		return
+	}
+	ad.credentialID, rest = rest[:n], rest[n:]
+	_, remaining, err := decodeCBOR(rest)
+	if err != nil {
+		return
+	}
+	ad.publicKey = rest[:len(rest)-len(remaining)]
+	return
+}
+
+// decodeBase64URL decodes base64 URL encoded strings with or without
+// padding, as browsers omit it.
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// WebAuthnManager performs WebAuthn registration and login ceremonies.
+// Challenges are signed rather than stored, so they can be verified by
+// any process sharing the secret, and are marked as used in the
+// webauthn_challenges table once a ceremony succeeds.
+type WebAuthnManager struct {
+	conn    sol.Conn
+	users   UserStore
+	rp      RelyingParty
+	origin  string
+	timeout time.Duration
+	key     []byte
+	nowFunc func() time.Time
+
+	// Require user verification, such as a PIN or biometric, during login
+	UserVerification bool
+}
+
+// challenge creates a signed challenge for the given ceremony and user
+func (m *WebAuthnManager) challenge(ceremony string, id int64) string {
+	value := fmt.Sprintf(
+		"%s:%d:%d:%s",
+		ceremony, id, m.nowFunc().Add(m.timeout).Unix(), RandomKeyN(16),
+	)
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(Sign(m.key, value)),
+	)
+}
+
+// verifiedChallenge is a valid challenge of a ceremony. The user ID may be
+// zero for logins.
+type verifiedChallenge struct {
+	UserID  int64
+	Expires time.Time
+	key     string
+}
+
+// verifyClientData checks the given client data and returns its challenge
+func (m *WebAuthnManager) verifyClientData(raw []byte, ceremony string) (verified verifiedChallenge, err error) {
+	var data clientData
+	if err = json.Unmarshal(raw, &data); err != nil {
+		return
+	}
+	if data.Type != "webauthn."+ceremony {
+		err = fmt.Errorf("auth: unexpected client data type %s", data.Type)
+		return
+	}
+	if data.Origin != m.origin {
+		err = fmt.Errorf("auth: unexpected origin %s", data.Origin)
+		return
+	}
+
+	challenge, err := decodeBase64URL(data.Challenge)
+	if err != nil {
+		return
+	}
+	value, ok := Unsign(m.key, string(challenge))
+	parts := strings.SplitN(value, ":", 4)
+	if !ok || len(parts) != 4 || parts[0] != ceremony {
+		err = fmt.Errorf("auth: invalid webauthn challenge")
+		return
+	}
+	id, _ := strconv.ParseInt(parts[1], 10, 64)
+	expires, _ := strconv.ParseInt(parts[2], 10, 64)
+	verified = verifiedChallenge{
+		UserID:  id,
+		Expires: time.Unix(expires, 0),
+		key:     HashKey(string(challenge)),
+	}
+	if !m.nowFunc().Before(verified.Expires) {
+		err = fmt.Errorf("auth: webauthn challenge has expired")
+	}
+	return
+}
+
+// useChallenge marks a challenge as used, unless it already was
+const useChallenge = `INSERT INTO webauthn_challenges (key, expires)
+VALUES (:key, :expires)
+ON CONFLICT (key) DO NOTHING
+RETURNING key`
+
+// consume marks the given challenge as used and returns an error if it
+// already was. Expired challenges are forgotten since they cannot be used.
+func (m *WebAuthnManager) consume(challenge verifiedChallenge) error {
+	expired := UsedChallenges.Delete().Where(
+		UsedChallenges.C("expires").LTE(m.nowFunc()),
+	)
+	if err := m.conn.Query(expired); err != nil {
+		return err
+	}
+	var used string
+	stmt := sol.Text(useChallenge, sol.Values{
+		"key": challenge.key, "expires": challenge.Expires,
+	})
+	if err := m.conn.Query(stmt, &used); err != nil {
+		return err
+	}
+	if used == "" {
+		return fmt.Errorf("auth: webauthn challenge was already used")
+	}
+	return nil
+}
+
+// verifyAuthenticatorData checks the relying party and flags
+func (m *WebAuthnManager) verifyAuthenticatorData(ad authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(m.rp.ID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return fmt.Errorf("auth: authenticator data is for another relying party")
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return fmt.Errorf("auth: user was not present")
+	}
+	if m.UserVerification && ad.flags&flagUserVerified == 0 {
+		return fmt.Errorf("auth: user was not verified")
+	}
+	return nil
+}
+
+// All returns all credentials of the given user
+func (m *WebAuthnManager) All(user User) (credentials []Credential, err error) {
+	stmt := Credentials.Select().Where(Credentials.C("user_id").Equals(user.ID))
+	err = m.conn.Query(stmt, &credentials)
+	return
+}
+
+// Get returns the credential with the given base64 URL encoded ID
+func (m *WebAuthnManager) Get(id string) (credential Credential, err error) {
+	stmt := Credentials.Select().Where(Credentials.C("id").Equals(id))
+	err = m.conn.Query(stmt, &credential)
+	return
+}
+
+// Delete removes the credential with the given ID
+func (m *WebAuthnManager) Delete(id string) error {
+	stmt := Credentials.Delete().Where(Credentials.C("id").Equals(id))
+	return m.conn.Query(stmt)
+}
+
+func descriptors(credentials []Credential) []CredentialDescriptor {
+	list := make([]CredentialDescriptor, len(credentials))
+	for i, credential := range credentials {
+		list[i] = CredentialDescriptor{Type: "public-key", ID: credential.ID}
+	}
+	return list
+}
+
+// BeginRegistration returns the options for registering a new credential
+// for the given user.
+func (m *WebAuthnManager) BeginRegistration(user User) (options CreationOptions, err error) {
+	existing, err := m.All(user)
+	if err != nil {
+		return
+	}
+	options = CreationOptions{
+		Challenge: m.challenge("create", user.ID),
+		RP:        m.rp,
+		User: CredentialUser{
+			ID: base64.RawURLEncoding.EncodeToString(
+				[]byte(strconv.FormatInt(user.ID, 10)),
+			),
+			Name:        user.Email,
+			DisplayName: user.Name(),
+		},
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: COSEAlgES256},
+			{Type: "public-key", Alg: COSEAlgEdDSA},
+			{Type: "public-key", Alg: COSEAlgRS256},
+		},
+		Timeout:            int64(m.timeout / time.Millisecond),
+		ExcludeCredentials: descriptors(existing),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+	}
+	return
+}
+
+// FinishRegistration verifies the given registration response for the
+// given user and saves its credential. Attestation formats "none" and
+// "packed" are accepted, but attestation certificates are not validated
+// against a trust root.
+func (m *WebAuthnManager) FinishRegistration(user User, response PublicKeyCredential) (credential Credential, err error) {
+	raw, err := decodeBase64URL(response.Response.ClientDataJSON)
+	if err != nil {
+		return
+	}
+	challenge, err := m.verifyClientData(raw, "create")
+	if err != nil {
+		return
+	}
+	if challenge.UserID != user.ID {
+		err = fmt.Errorf("auth: webauthn challenge is for another user")
+		return
+	}
+
+	// Parse the attestation object
+	object, err := decodeBase64URL(response.Response.AttestationObject)
+	if err != nil {
+		return
+	}
+	attestation, _, err := cborMap(object)
+	if err != nil {
+		return
+	}
+	format, _ := attestation["fmt"].(string)
+	authData, _ := attestation["authData"].([]byte)
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return
+	}
+	if err = m.verifyAuthenticatorData(ad); err != nil {
+		return
+	}
+	if ad.credentialID == nil {
+		err = fmt.Errorf("auth: no attested credential data")
+		return
+	}
+	key, err := parseCOSEKey(ad.publicKey)
+	if err != nil {
+		return
+	}
+
+	// Verify the attestation statement
+	clientDataHash := sha256.Sum256(raw)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	switch format {
+	case "none":
+	case "packed":
+		alg, _ := statement["alg"].(int64)
+		sig, _ := statement["sig"].([]byte)
+		if x5c, ok := statement["x5c"].([]interface{}); ok && len(x5c) > 0 {
+			der, _ := x5c[0].([]byte)
+			err = verifyCertificateSignature(alg, der, signed, sig)
+		} else if alg != key.alg {
+			err = fmt.Errorf("auth: self attestation algorithm mismatch")
+		} else {
+			err = verifySignature(alg, key.public, signed, sig)
+		}
+		if err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("auth: unsupported attestation format %s", format)
+		return
+	}
+
+	credential = Credential{
+		ID:        base64.RawURLEncoding.EncodeToString(ad.credentialID),
+		UserID:    user.ID,
+		PublicKey: base64.RawURLEncoding.EncodeToString(ad.publicKey),
+		SignCount: int64(ad.signCount),
+	}
+	if existing, _ := m.Get(credential.ID); existing.Exists() {
+		err = fmt.Errorf("auth: credential is already registered")
+		return
+	}
+	if err = m.consume(challenge); err != nil {
+		return
+	}
+	err = m.conn.Query(postgres.Insert(Credentials).Values(credential).Returning(), &credential)
+	return
+}
+
+// BeginLogin returns the options for logging in. If the given user exists,
+// only their credentials are allowed, otherwise the authenticator may
+// choose a discoverable credential.
+func (m *WebAuthnManager) BeginLogin(user User) (options RequestOptions, err error) {
+	options = RequestOptions{
+		Challenge:        m.challenge("get", user.ID),
+		Timeout:          int64(m.timeout / time.Millisecond),
+		RPID:             m.rp.ID,
+		UserVerification: "preferred",
+	}
+	if m.UserVerification {
+		options.UserVerification = "required"
+	}
+	if user.Exists() {
+		var existing []Credential
+		if existing, err = m.All(user); err != nil {
+			return
+		}
+		options.AllowCredentials = descriptors(existing)
+	}
+	return
+}
+
+// FinishLogin verifies the given login response and returns the user
+// that owns its credential.
+func (m *WebAuthnManager) FinishLogin(response PublicKeyCredential) (user User, err error) {
+	raw, err := decodeBase64URL(response.Response.ClientDataJSON)
+	if err != nil {
+		return
+	}
+	challenge, err := m.verifyClientData(raw, "get")
+	if err != nil {
+		return
+	}
+
+	credential, err := m.Get(strings.TrimRight(response.ID, "="))
+	if err != nil {
+		return
+	}
+	id := challenge.UserID
+	if !credential.Exists() || (id != 0 && id != credential.UserID) {
+		err = fmt.Errorf("auth: unknown webauthn credential")
+		return
+	}
+
+	authData, err := decodeBase64URL(response.Response.AuthenticatorData)
+	if err != nil {
+		return
+	}
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return
+	}
+	if err = m.verifyAuthenticatorData(ad); err != nil {
+		return
+	}
+
+	encoded, err := decodeBase64URL(credential.PublicKey)
+	if err != nil {
+		return
+	}
+	key, err := parseCOSEKey(encoded)
+	if err != nil {
+		return
+	}
+	sig, err := decodeBase64URL(response.Response.Signature)
+	if err != nil {
+		return
+	}
+	clientDataHash := sha256.Sum256(raw)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	if err = verifySignature(key.alg, key.public, signed, sig); err != nil {
+		return
+	}
+
+	// A counter that does not increase may indicate a cloned authenticator.
+	// Authenticators that do not implement counters always send zero.
+	count := int64(ad.signCount)
+	if (count != 0 || credential.SignCount != 0) && count <= credential.SignCount {
+		err = fmt.Errorf("auth: webauthn signature counter did not increase")
+		return
+	}
+
+	// Authenticators without counters can only be protected from replays
+	// by using each challenge once
+	if err = m.consume(challenge); err != nil {
+		return
+	}
+
+	now := m.nowFunc()
+	stmt := Credentials.Update().Values(
+		sol.Values{"sign_count": count, "last_used_at": now},
+	).Where(Credentials.C("id").Equals(credential.ID))
+	if err = m.conn.Query(stmt); err != nil {
+		return
+	}
+	if user, err = m.users.GetByID(credential.UserID); err != nil {
+		return User{}, err
+	}
+	if !user.IsActive {
+		return User{}, fmt.Errorf("auth: user %d is not active", user.ID)
+	}
+	return
+}
+
+// NewWebAuthn creates a WebAuthn manager for the given relying party ID,
+// which is the site's domain, and the origin of its pages, such as
+// "https://example.com". Challenges are signed with a key derived from
+// the given secret. It will panic if the secret is too short.
+func NewWebAuthn(conn sol.Conn, users UserStore, secret, rpID, rpName, origin string) *WebAuthnManager {
+	if err := CheckSecret(secret); err != nil {
+		log.Panic(err)
+	}
+	return &WebAuthnManager{
+		conn:    conn,
+		users:   users,
+		rp:      RelyingParty{ID: rpID, Name: rpName},
+		origin:  origin,
+		timeout: 5 * time.Minute,
+		key:     DeriveKey(secret, "auth.webauthn"),
+		nowFunc: func() time.Time { return time.Now().In(time.UTC) },
+	}
+}
@@ -0,0 +1,345 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aodin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeCBOR is a minimal CBOR encoder for building authenticator output
+func encodeCBOR(v interface{}) []byte {
+	header := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(n))
+			return b
+		}
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return b
+	}
+	switch value := v.(type) {
+	case int:
+		return encodeCBOR(int64(value))
+	case int64:
+		if value < 0 {
+			return header(1, uint64(-1-value))
+		}
+		return header(0, uint64(value))
+	case []byte:
+		return append(header(2, uint64(len(value))), value...)
+	case string:
+		return append(header(3, uint64(len(value))), value...)
+	case []interface{}:
+		out := header(4, uint64(len(value)))
+		for _, item := range value {
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := header(5, uint64(len(value)))
+		for key, item := range value {
+			out = append(out, encodeCBOR(key)...)
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	}
+	panic("encodeCBOR: unsupported type")
+}
+
+// softAuthenticator is a software WebAuthn authenticator using ES256
+type softAuthenticator struct {
+	key    *ecdsa.PrivateKey
+	id     []byte
+	count  uint32
+	rpID   string
+	origin string
+
+	// Like most passkeys, counterless authenticators always send zero
+	counterless bool
+}
+
+func newSoftAuthenticator(rpID, origin string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return &softAuthenticator{
+		key:    key,
+		id:     RandomBytes(16),
+		rpID:   rpID,
+		origin: origin,
+	}
+}
+
+func (a *softAuthenticator) publicKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return encodeCBOR(map[interface{}]interface{}{
+		int64(coseKty): int64(coseKtyEC2),
+		int64(coseAlg): COSEAlgES256,
+		int64(coseCrv): int64(1),
+		int64(coseX):   x,
+		int64(coseY):   y,
+	})
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	if !a.counterless {
+		a.count += 1
+	}
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := flagUserPresent | flagUserVerified
+	if attested {
+		flags |= flagAttested
+	}
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.count)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = append(data, byte(len(a.id)>>8), byte(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, a.publicKey()...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	b, _ := json.Marshal(clientData{
+		Type:      "webauthn." + ceremony,
+		Challenge: challenge,
+		Origin:    a.origin,
+	})
+	return b
+}
+
+func (a *softAuthenticator) sign(authData, clientData []byte) []byte {
+	hash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), hash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+func (a *softAuthenticator) create(options CreationOptions, format string) PublicKeyCredential {
+	raw := a.clientData("create", options.Challenge)
+	authData := a.authData(true)
+	statement := map[interface{}]interface{}{}
+	if format == "packed" {
+		statement["alg"] = COSEAlgES256
+		statement["sig"] = a.sign(authData, raw)
+	}
+	object := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      format,
+		"authData": authData,
+		"attStmt":  statement,
+	})
+	encode := base64.RawURLEncoding.EncodeToString
+	return PublicKeyCredential{
+		ID:   encode(a.id),
+		Type: "public-key",
+		Response: AuthenticatorResponse{
+			ClientDataJSON:    encode(raw),
+			AttestationObject: encode(object),
+		},
+	}
+}
+
+func (a *softAuthenticator) get(options RequestOptions) PublicKeyCredential {
+	raw := a.clientData("get", options.Challenge)
+	authData := a.authData(false)
+	encode := base64.RawURLEncoding.EncodeToString
+	return PublicKeyCredential{
+		ID:   encode(a.id),
+		Type: "public-key",
+		Response: AuthenticatorResponse{
+			ClientDataJSON:    encode(raw),
+			AuthenticatorData: encode(authData),
+			Signature:         encode(a.sign(authData, raw)),
+		},
+	}
+}
+
+func TestAuthenticatorData(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Panics(func() {
+		NewWebAuthn(nil, nil, "", "example.com", "Example", "https://example.com")
+	}, "WebAuthn should require a secret key")
+	m := NewWebAuthn(nil, nil, testSecret, "example.com", "Example", "https://example.com")
+	authenticator := newSoftAuthenticator("example.com", "https://example.com")
+
+	// Parse attested credential data
+	data := authenticator.authData(true)
+	ad, err := parseAuthenticatorData(data)
+	require.Nil(t, err)
+	assert.Nil(m.verifyAuthenticatorData(ad))
+	assert.Equal(authenticator.id, ad.credentialID)
+	assert.EqualValues(1, ad.signCount)
+
+	key, err := parseCOSEKey(ad.publicKey)
+	require.Nil(t, err)
+	assert.Equal(COSEAlgES256, key.alg)
+
+	raw := authenticator.clientData("get", "challenge")
+	sig := authenticator.sign(data, raw)
+	hash := sha256.Sum256(raw)
+	signed := append(append([]byte{}, data...), hash[:]...)
+	assert.Nil(verifySignature(key.alg, key.public, signed, sig))
+	assert.NotNil(verifySignature(key.alg, key.public, signed[1:], sig))
+
+	// Truncated data should error
+	_, err = parseAuthenticatorData(data[:36])
+	assert.NotNil(err)
+	_, err = parseAuthenticatorData(data[:len(data)-1])
+	assert.NotNil(err)
+
+	// Other relying parties should be rejected
+	other := newSoftAuthenticator("example.org", "https://example.org")
+	ad, err = parseAuthenticatorData(other.authData(false))
+	require.Nil(t, err)
+	assert.NotNil(m.verifyAuthenticatorData(ad))
+
+	// Challenges are signed and expire
+	options, err := m.BeginLogin(User{})
+	require.Nil(t, err)
+	_, err = m.verifyClientData(authenticator.clientData("get", options.Challenge), "get")
+	assert.Nil(err)
+	_, err = m.verifyClientData(authenticator.clientData("create", options.Challenge), "get")
+	assert.NotNil(err, "Client data of another ceremony should be rejected")
+	_, err = m.verifyClientData(authenticator.clientData("get", "forged"), "get")
+	assert.NotNil(err, "Unsigned challenges should be rejected")
+	_, err = m.verifyClientData(other.clientData("get", options.Challenge), "get")
+	assert.NotNil(err, "Other origins should be rejected")
+
+	m.nowFunc = func() time.Time { return time.Now().Add(m.timeout) }
+	_, err = m.verifyClientData(authenticator.clientData("get", options.Challenge), "get")
+	assert.NotNil(err, "Expired challenges should be rejected")
+}
+
+func TestWebAuthn(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := getConn(t).Must().Begin()
+	defer tx.Rollback()
+	initSchema(tx, Users, Sessions, Tokens, Credentials, UsedChallenges)
+
+	_, err := Mock(config.Default, tx).EnableWebAuthn("example.com", "Example", "https://example.com")
+	assert.NotNil(err, "WebAuthn should not be enabled without a secret key")
+
+	auth := Mock(testConfig(), tx)
+	m, err := auth.EnableWebAuthn("example.com", "Example", "https://example.com")
+	require.Nil(t, err)
+
+	user, err := auth.CreateUser("a@example.com", "admin", "guy", "secret")
+	require.Nil(t, err, "Error during user creation")
+
+	// Register two credentials, with none and packed attestation
+	authenticator := newSoftAuthenticator("example.com", "https://example.com")
+	options, err := m.BeginRegistration(user)
+	require.Nil(t, err)
+	assert.Equal(0, len(options.ExcludeCredentials))
+
+	credential, err := m.FinishRegistration(user, authenticator.create(options, "none"))
+	require.Nil(t, err, "Registration should not error")
+	assert.Equal(user.ID, credential.UserID)
+
+	packed := newSoftAuthenticator("example.com", "https://example.com")
+	options, err = m.BeginRegistration(user)
+	require.Nil(t, err)
+	assert.Equal(1, len(options.ExcludeCredentials))
+	_, err = m.FinishRegistration(user, packed.create(options, "packed"))
+	require.Nil(t, err, "Packed registration should not error")
+
+	// Credentials cannot be registered twice or for another user
+	options, err = m.BeginRegistration(user)
+	require.Nil(t, err)
+	_, err = m.FinishRegistration(user, packed.create(options, "packed"))
+	assert.NotNil(err, "Duplicate registration should error")
+	_, err = m.FinishRegistration(User{ID: user.ID + 1}, packed.create(options, "none"))
+	assert.NotNil(err, "Registration for another user should error")
+
+	// Login with a discoverable credential
+	login, err := m.BeginLogin(User{})
+	require.Nil(t, err)
+	valid, err := auth.ByPasskey(authenticator.get(login))
+	require.Nil(t, err, "Login should not error")
+	assert.Equal(user.ID, valid.ID)
+
+	// Login with the user's credentials
+	login, err = m.BeginLogin(user)
+	require.Nil(t, err)
+	assert.Equal(2, len(login.AllowCredentials))
+	valid, err = auth.ByPasskey(packed.get(login))
+	require.Nil(t, err, "Login should not error")
+	assert.Equal(user.ID, valid.ID)
+
+	// Challenges can only be used once
+	_, err = auth.ByPasskey(packed.get(login))
+	assert.NotNil(err, "A used challenge should not log in")
+
+	// A replayed response does not increase the counter
+	login, _ = m.BeginLogin(user)
+	response := packed.get(login)
+	_, err = auth.ByPasskey(response)
+	require.Nil(t, err)
+	_, err = auth.ByPasskey(response)
+	assert.NotNil(err, "A replayed login should error")
+
+	// Counters above the range of a 32 bit signed integer are saved
+	packed.count = 1 << 31
+	login, _ = m.BeginLogin(user)
+	_, err = auth.ByPasskey(packed.get(login))
+	require.Nil(t, err, "A large counter should not error")
+
+	// Responses of authenticators without counters cannot be replayed
+	passkey := newSoftAuthenticator("example.com", "https://example.com")
+	passkey.counterless = true
+	options, _ = m.BeginRegistration(user)
+	_, err = m.FinishRegistration(user, passkey.create(options, "none"))
+	require.Nil(t, err)
+	login, _ = m.BeginLogin(User{})
+	response = passkey.get(login)
+	_, err = auth.ByPasskey(response)
+	require.Nil(t, err, "Login without a counter should not error")
+	_, err = auth.ByPasskey(response)
+	assert.NotNil(err, "A replayed login without a counter should error")
+
+	// Deleted credentials cannot log in
+	login, _ = m.BeginLogin(User{})
+	require.Nil(t, m.Delete(credential.ID))
+	_, err = auth.ByPasskey(authenticator.get(login))
+	assert.NotNil(err, "A deleted credential should not log in")
+
+	// Unverified and inactive users cannot log in
+	auth.RequireVerifiedEmail(true)
+	login, _ = m.BeginLogin(User{})
+	_, err = auth.ByPasskey(passkey.get(login))
+	assert.IsType(EmailNotVerified{}, err)
+
+	auth.RequireVerifiedEmail(false)
+	require.Nil(t, auth.users.SetActive(&user, false))
+	login, _ = m.BeginLogin(User{})
+	_, err = auth.ByPasskey(passkey.get(login))
+	assert.NotNil(err, "An inactive user should not log in")
+}
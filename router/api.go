@@ -0,0 +1,197 @@
+package router
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aodin/volta/auth"
+	"github.com/aodin/volta/auth/jwt"
+)
+
+// bearerCredential returns the credential of a Bearer Authorization header
+func bearerCredential(header string) (string, bool) {
+	const prefix = "Bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	credential := strings.TrimSpace(header[len(prefix):])
+	return credential, credential != ""
+}
+
+// ParseBearer parses an Authorization header of the form
+// "Bearer <id>.<key>", where id is the user ID of the token.
+func ParseBearer(header string) (id int64, key string, ok bool) {
+	credential, found := bearerCredential(header)
+	if !found {
+		return
+	}
+	parts := strings.SplitN(credential, ".", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return
+	}
+	var err error
+	if id, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, "", false
+	}
+	return id, parts[1], true
+}
+
+// ParseBasic parses an Authorization header of the form
+// "Basic <base64 email:password>".
+func ParseBasic(header string) (email, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+	return parts[0], parts[1], true
+}
+
+// APIAuth authenticates requests by their Authorization header. It is
+// opted into per route by wrapping handlers with Require. Bearer tokens
+// are checked with auth.ByToken and Basic credentials with
+// auth.ByPasswordFrom, so failed Basic logins are throttled.
+//
+// Bearer JSON Web Tokens are verified by JWT, if set, without a database,
+// so that services can authenticate each other's requests. Their users are
+// only looked up if the APIAuth has an auth.Auth, such as one created by
+// NewAPIAuth: otherwise deactivated users keep their access until their
+// tokens expire.
+//
+// Scopes are only required of tokens - users authenticated by password or
+// session may do anything.
+type APIAuth struct {
+	auth  *auth.Auth
+	Realm string
+
+	// The accepted schemes
+	Bearer bool
+	Basic  bool
+
+	// JWT verifies Bearer JSON Web Tokens
+	JWT *jwt.Manager
+
+	// Session also accepts users authenticated by their session cookie
+	Session bool
+}
+
+// challenge sets the WWW-Authenticate headers of every accepted scheme
+// and writes the given status. The given error and scope are added to the
+// Bearer challenge as described by RFC 6750.
+func (a APIAuth) challenge(w http.ResponseWriter, code int, err, scope string) {
+	if a.Bearer || a.JWT != nil {
+		value := fmt.Sprintf(`Bearer realm=%q`, a.Realm)
+		if err != "" {
+			value += fmt.Sprintf(`, error=%q`, err)
+		}
+		if scope != "" {
+			value += fmt.Sprintf(`, scope=%q`, scope)
+		}
+		w.Header().Add("WWW-Authenticate", value)
+	}
+	if a.Basic {
+		w.Header().Add(
+			"WWW-Authenticate",
+			fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, a.Realm),
+		)
+	}
+	http.Error(w, http.StatusText(code), code)
+}
+
+// Authenticate sets the user and token scopes of the given request from
+// its Authorization header. False is returned if the request was not
+// authenticated, in which case a 401 response has been written.
+func (a APIAuth) Authenticate(w http.ResponseWriter, r *Request) bool {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		if a.Session && r.User.Exists() {
+			return true
+		}
+		a.challenge(w, http.StatusUnauthorized, "", "")
+		return false
+	}
+
+	if id, key, ok := ParseBearer(header); ok && a.Bearer {
+		ip := auth.ClientIP(r.Request)
+		if r.User, r.Scopes = a.auth.ByTokenFrom(id, key, ip); !r.User.Exists() {
+			a.challenge(w, http.StatusUnauthorized, "invalid_token", "")
+			return false
+		}
+		r.Token = true
+		return true
+	}
+
+	if credential, ok := bearerCredential(header); ok && a.JWT != nil {
+		claims, err := a.JWT.Verify(credential)
+		if err != nil {
+			a.challenge(w, http.StatusUnauthorized, "invalid_token", "")
+			return false
+		}
+		user := claims.User()
+		if a.auth != nil {
+			if user, err = a.auth.UserStore().GetByID(user.ID); err != nil || !user.IsActive {
+				a.challenge(w, http.StatusUnauthorized, "invalid_token", "")
+				return false
+			}
+		}
+		r.User, r.Scopes, r.Token = user, claims.Scopes(), true
+		return true
+	}
+
+	if email, password, ok := ParseBasic(header); ok && a.Basic {
+		user, err := a.auth.ByPasswordFrom(
+			email, password, auth.ClientIP(r.Request),
+		)
+		if err != nil {
+			a.challenge(w, http.StatusUnauthorized, "", "")
+			return false
+		}
+		r.User, r.Scopes, r.Token = user, nil, false
+		return true
+	}
+
+	a.challenge(w, http.StatusUnauthorized, "invalid_request", "")
+	return false
+}
+
+// Require wraps the given handler so it is only run for requests
+// authenticated by APIAuth. Tokens must have been granted all of the
+// given scopes, otherwise a 403 response is written.
+func (a APIAuth) Require(h Handler, scopes ...string) Handler {
+	return func(w http.ResponseWriter, r *Request) error {
+		if !a.Authenticate(w, r) {
+			return nil
+		}
+		if r.Token && !r.Scopes.HasAll(scopes...) {
+			a.challenge(
+				w, http.StatusForbidden,
+				"insufficient_scope", strings.Join(scopes, " "),
+			)
+			return nil
+		}
+		return h(w, r)
+	}
+}
+
+// NewAPIAuth creates an APIAuth with the given realm that accepts Bearer
+// tokens only.
+func NewAPIAuth(auth *auth.Auth, realm string) APIAuth {
+	return APIAuth{auth: auth, Realm: realm, Bearer: true}
+}
+
+// NewJWTAuth creates an APIAuth with the given realm that accepts Bearer
+// JSON Web Tokens verified by the given manager only. It does not need an
+// auth.Auth or a database, so the users of tokens are not looked up.
+func NewJWTAuth(m *jwt.Manager, realm string) APIAuth {
+	return APIAuth{Realm: realm, JWT: m}
+}
@@ -0,0 +1,232 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aodin/config"
+	"github.com/aodin/volta/auth"
+	"github.com/aodin/volta/auth/jwt"
+)
+
+func TestParseBearer(t *testing.T) {
+	token := auth.Token{UserID: 3, Key: "abc"}
+	if id, key, ok := ParseBearer(token.Bearer()); !ok || id != 3 || key != "abc" {
+		t.Errorf("unexpected bearer parse of token: %d %q %t", id, key, ok)
+	}
+
+	id, key, ok := ParseBearer("Bearer 12.abc-_DEF.ghi")
+	if !ok || id != 12 || key != "abc-_DEF.ghi" {
+		t.Errorf("unexpected bearer parse: %d %q %t", id, key, ok)
+	}
+	for _, header := range []string{
+		"", "Bearer", "Bearer abc", "Bearer x.abc", "Bearer 12.", "Basic 12.abc",
+	} {
+		if _, _, ok := ParseBearer(header); ok {
+			t.Errorf("header %q should not parse as a bearer token", header)
+		}
+	}
+}
+
+func TestParseBasic(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("a@example.com", "pass:word")
+	email, password, ok := ParseBasic(req.Header.Get("Authorization"))
+	if !ok || email != "a@example.com" || password != "pass:word" {
+		t.Errorf("unexpected basic parse: %q %q %t", email, password, ok)
+	}
+	for _, header := range []string{"", "Basic", "Basic !!!", "Bearer 1.abc"} {
+		if _, _, ok := ParseBasic(header); ok {
+			t.Errorf("header %q should not parse as basic credentials", header)
+		}
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	a := auth.NewInMemory(config.Default)
+	users, err := a.Seed(auth.SeedUser{Email: "a@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatalf("could not seed a user: %s", err)
+	}
+	user := users[0]
+
+	api := NewAPIAuth(a, "api")
+	api.Basic = true
+
+	var ran bool
+	var authed *Request
+	router := newMockRouter()
+	router.GET("/api", api.Require(func(w http.ResponseWriter, r *Request) error {
+		ran, authed = true, r
+		return nil
+	}, "read:users"))
+
+	// Requests without credentials should be challenged
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
+	challenges := w.Header()["Www-Authenticate"]
+	if len(challenges) != 2 {
+		t.Fatalf("expected two challenges, got %v", challenges)
+	}
+	if challenges[0] != `Bearer realm="api"` {
+		t.Errorf("unexpected bearer challenge %q", challenges[0])
+	}
+	if challenges[1] != `Basic realm="api", charset="UTF-8"` {
+		t.Errorf("unexpected basic challenge %q", challenges[1])
+	}
+
+	// Unknown schemes are invalid requests
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Digest abc")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
+	if challenge := w.Header().Get("WWW-Authenticate"); challenge != `Bearer realm="api", error="invalid_request"` {
+		t.Errorf("unexpected challenge %q", challenge)
+	}
+	if ran {
+		t.Error("the handler should not run for unauthenticated requests")
+	}
+
+	// Tokens with the required scopes authenticate their user
+	token, err := a.TokenStore().Create(user, "ci", nil, "read:users")
+	if err != nil {
+		t.Fatalf("could not create a token: %s", err)
+	}
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", token.Bearer())
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !ran {
+		t.Fatalf("valid tokens should authenticate, got %d", w.Code)
+	}
+	if authed.User.ID != user.ID || !authed.Token || !authed.Scopes.HasAll("read:users") {
+		t.Errorf("unexpected token request: %d %t %v", authed.User.ID, authed.Token, authed.Scopes)
+	}
+
+	// Invalid tokens and tokens without the scopes are refused
+	ran = false
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", auth.Token{UserID: user.ID, Key: "invalid"}.Bearer())
+	router.ServeHTTP(w, req)
+	if challenge := w.Header().Get("WWW-Authenticate"); w.Code != http.StatusUnauthorized || challenge != `Bearer realm="api", error="invalid_token"` {
+		t.Errorf("invalid tokens should be unauthorized, got %d %q", w.Code, challenge)
+	}
+
+	limited, err := a.TokenStore().Create(user, "ci", nil, "write:users")
+	if err != nil {
+		t.Fatalf("could not create a token: %s", err)
+	}
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", limited.Bearer())
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("tokens without the scope should be forbidden, got %d", w.Code)
+	}
+	if challenge := w.Header().Get("WWW-Authenticate"); challenge != `Bearer realm="api", error="insufficient_scope", scope="read:users"` {
+		t.Errorf("unexpected insufficient scope challenge %q", challenge)
+	}
+	if ran {
+		t.Error("the handler should not run for refused tokens")
+	}
+
+	// Basic logins are not limited by scopes
+	w = httptest.NewRecorder()
+	req.SetBasicAuth("a@example.com", "secret")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !ran {
+		t.Fatalf("valid basic logins should authenticate, got %d", w.Code)
+	}
+	if authed.User.ID != user.ID || authed.Token {
+		t.Errorf("unexpected basic request: %d %t", authed.User.ID, authed.Token)
+	}
+
+	ran = false
+	w = httptest.NewRecorder()
+	req.SetBasicAuth("a@example.com", "1234")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || ran {
+		t.Errorf("incorrect basic logins should be unauthorized, got %d", w.Code)
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	m := jwt.NewManager("users", "api", jwt.HMAC("a", []byte("secret")))
+	api := NewJWTAuth(m, "api")
+
+	var user auth.User
+	router := newMockRouter()
+	router.GET("/api", api.Require(func(w http.ResponseWriter, r *Request) error {
+		user = r.User
+		return nil
+	}, "read:users"))
+
+	for header, code := range map[string]int{
+		"":                 http.StatusUnauthorized,
+		"Bearer 1.abc":     http.StatusUnauthorized,
+		"Bearer not.a.jwt": http.StatusUnauthorized,
+		"Basic YTpi":       http.StatusUnauthorized,
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api", nil)
+		req.Header.Set("Authorization", header)
+		router.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("header %q: expected status %d, got %d", header, code, w.Code)
+		}
+	}
+
+	valid := auth.User{ID: 3, Email: "a@example.com", IsActive: true}
+	token, err := m.Issue(valid, "api", "read:users")
+	if err != nil {
+		t.Fatalf("could not issue a token: %s", err)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || user.ID != 3 {
+		t.Errorf("valid JWTs should authenticate, got %d for user %d", w.Code, user.ID)
+	}
+
+	token, _ = m.Issue(valid, "api")
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("JWTs without scopes should be forbidden, got %d", w.Code)
+	}
+
+	// With an auth, the users of tokens must still be active
+	a := auth.NewInMemory(config.Default)
+	users, err := a.Seed(
+		auth.SeedUser{Email: "a@example.com"},
+		auth.SeedUser{Email: "b@example.com", Inactive: true},
+	)
+	if err != nil {
+		t.Fatalf("could not seed users: %s", err)
+	}
+	api = NewAPIAuth(a, "api")
+	api.Bearer, api.JWT = false, m
+	router = newMockRouter()
+	router.GET("/api", api.Require(func(w http.ResponseWriter, r *Request) error {
+		user = r.User
+		return nil
+	}, "read:users"))
+	for i, code := range []int{http.StatusOK, http.StatusUnauthorized} {
+		issued := users[i]
+		issued.IsActive = true
+		token, _ = m.Issue(issued, "api", "read:users")
+		w = httptest.NewRecorder()
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("user %s: expected status %d, got %d", issued.Email, code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/aodin/volta/auth"
+	"github.com/aodin/volta/templates"
+)
+
+// DefaultConsentTemplate is the default consent screen of OAuthHandlers.
+// It is given the Client, the requested Scopes, the User, the request's
+// Values and a Consent token that must be POSTed back with the values.
+const DefaultConsentTemplate = `{{ define "oauth_consent" }}<!DOCTYPE html>
+<html>
+<head><title>Authorize {{ .Client.Name }}</title></head>
+<body>
+<p>{{ .Client.Name }} would like to access your account{{ if .Scopes }} with the following permissions{{ end }}:</p>
+<ul>{{ range .Scopes }}<li>{{ . }}</li>{{ end }}</ul>
+<form method="POST">
+{{ range $key, $values := .Values }}{{ range $values }}<input type="hidden" name="{{ $key }}" value="{{ . }}">
+{{ end }}{{ end }}<input type="hidden" name="consent" value="{{ .Consent }}">
+<button type="submit" name="approve" value="true">Allow</button>
+<button type="submit" name="deny" value="true">Deny</button>
+</form>
+</body>
+</html>{{ end }}`
+
+// OAuthHandlers serve the endpoints of an auth.OAuthServer: authorization
+// with a consent screen, tokens, revocation and introspection.
+type OAuthHandlers struct {
+	server    *auth.OAuthServer
+	templates *templates.Templates
+
+	// Template is the name of the consent screen template
+	Template string
+
+	// Login is where anonymous users are sent to sign in before they are
+	// asked for consent. The authorization URL is added as "next".
+	Login string
+}
+
+// writeJSON writes the given value as an uncacheable JSON response
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeOAuthError writes the given error as an OAuth error response.
+// Client authentication failures are 401 responses with a challenge.
+func writeOAuthError(w http.ResponseWriter, err error) {
+	oauthErr, ok := err.(auth.OAuthError)
+	if !ok {
+		oauthErr = auth.OAuthError{Code: "server_error"}
+	}
+	code := http.StatusBadRequest
+	if oauthErr.Code == "invalid_client" {
+		code = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	writeJSON(w, code, oauthErr)
+}
+
+// Authorize asks the request's user to consent to an authorization
+// request on GET and issues a code or denies the request on POST.
+func (h OAuthHandlers) Authorize(w http.ResponseWriter, r *Request) error {
+	values := r.URL.Query()
+	if r.Method == string(POST) {
+		if err := r.ParseForm(); err != nil {
+			return err
+		}
+		values = r.PostForm
+	}
+
+	req, err := h.server.ParseAuthorization(values)
+	if err != nil {
+		// Only redirect errors to a registered redirect URI
+		if req.Client.Exists() && req.Client.AllowsRedirect(req.RedirectURI) {
+			oauthErr, _ := err.(auth.OAuthError)
+			http.Redirect(w, r.Request, req.Redirect(url.Values{
+				"error":             {oauthErr.Code},
+				"error_description": {oauthErr.Description},
+			}), 302)
+			return nil
+		}
+		return err
+	}
+
+	if !r.User.Exists() {
+		if r.Method != string(GET) || h.Login == "" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return nil
+		}
+		next := url.Values{"next": {r.URL.Path + "?" + values.Encode()}}
+		http.Redirect(w, r.Request, h.Login+"?"+next.Encode(), 302)
+		return nil
+	}
+
+	if r.Method == string(POST) {
+		if !h.server.CheckConsent(req, r.User, r.PostFormValue("consent")) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return nil
+		}
+		if r.PostFormValue("approve") == "" {
+			http.Redirect(w, r.Request, req.Deny(), 302)
+			return nil
+		}
+		redirect, err := h.server.Approve(req, r.User)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, r.Request, redirect, 302)
+		return nil
+	}
+
+	// The consent page must not be framed, or users could be tricked
+	// into clicking its buttons
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	h.templates.Execute(w, h.Template, templates.Attrs{
+		"Client":  req.Client,
+		"Scopes":  req.Scopes,
+		"User":    r.User,
+		"Values":  req.Values(),
+		"Consent": h.server.ConsentToken(req, r.User),
+	})
+	return nil
+}
+
+// client authenticates the client of the given request by HTTP Basic
+// authentication or by its POSTed credentials
+func (h OAuthHandlers) client(r *Request) (auth.OAuthClient, error) {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		// Credentials are form encoded before Basic encoding
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	return h.server.AuthenticateClient(id, secret)
+}
+
+// Token issues tokens for the authorization code, client credentials and
+// refresh token grants
+func (h OAuthHandlers) Token(w http.ResponseWriter, r *Request) error {
+	client, err := h.client(r)
+	if err != nil {
+		writeOAuthError(w, err)
+		return nil
+	}
+
+	var token auth.OAuthToken
+	scopes := auth.ParseScopes(r.PostFormValue("scope"))
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		token, err = h.server.ExchangeCode(
+			client,
+			r.PostFormValue("code"),
+			r.PostFormValue("redirect_uri"),
+			r.PostFormValue("code_verifier"),
+		)
+	case "client_credentials":
+		token, err = h.server.ClientCredentials(client, scopes)
+	case "refresh_token":
+		token, err = h.server.Refresh(
+			client, r.PostFormValue("refresh_token"), scopes,
+		)
+	default:
+		err = auth.OAuthError{Code: "unsupported_grant_type"}
+	}
+	if err != nil {
+		writeOAuthError(w, err)
+		return nil
+	}
+	writeJSON(w, http.StatusOK, token)
+	return nil
+}
+
+// Revoke revokes the POSTed token if it was issued to the client
+func (h OAuthHandlers) Revoke(w http.ResponseWriter, r *Request) error {
+	client, err := h.client(r)
+	if err != nil {
+		writeOAuthError(w, err)
+		return nil
+	}
+	if err = h.server.Revoke(client, r.PostFormValue("token")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// Introspect describes the POSTed token to an authenticated confidential
+// client. Public clients cannot keep a secret, so anyone could use their
+// ID to probe tokens.
+func (h OAuthHandlers) Introspect(w http.ResponseWriter, r *Request) error {
+	client, err := h.client(r)
+	if err == nil && client.IsPublic() {
+		err = auth.OAuthError{
+			Code:        "invalid_client",
+			Description: "public clients cannot introspect tokens",
+		}
+	}
+	if err != nil {
+		writeOAuthError(w, err)
+		return nil
+	}
+	writeJSON(w, http.StatusOK, h.server.Introspect(r.PostFormValue("token")))
+	return nil
+}
+
+// Mount attaches the handlers below the given path: "/authorize",
+// "/token", "/revoke" and "/introspect".
+func (h OAuthHandlers) Mount(router *Router, path string) {
+	router.Route(path+"/authorize", h.Authorize, GET, POST)
+	router.POST(path+"/token", h.Token)
+	router.POST(path+"/revoke", h.Revoke)
+	router.POST(path+"/introspect", h.Introspect)
+}
+
+// NewOAuthHandlers creates handlers for the given server that render the
+// consent screen with the given templates. If no templates are given, the
+// DefaultConsentTemplate is used.
+func NewOAuthHandlers(server *auth.OAuthServer, t *templates.Templates) OAuthHandlers {
+	if t == nil {
+		t = templates.Empty()
+		if err := t.Add(DefaultConsentTemplate); err != nil {
+			panic(err)
+		}
+	}
+	return OAuthHandlers{
+		server:    server,
+		templates: t,
+		Template:  "oauth_consent",
+	}
+}
@@ -0,0 +1,57 @@
+package router
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aodin/volta/auth"
+	"github.com/aodin/volta/templates"
+)
+
+func TestOAuthConsentTemplate(t *testing.T) {
+	h := NewOAuthHandlers(nil, nil)
+	buf := &bytes.Buffer{}
+	h.templates.Execute(buf, h.Template, templates.Attrs{
+		"Client":  auth.OAuthClient{Name: "Partner"},
+		"Scopes":  auth.Scopes{"read:users"},
+		"Values":  url.Values{"client_id": {"abc"}, "state": {`"><script>`}},
+		"Consent": "signed",
+	})
+	page := buf.String()
+	for _, expected := range []string{
+		"Authorize Partner",
+		"<li>read:users</li>",
+		`name="client_id" value="abc"`,
+		`name="consent" value="signed"`,
+	} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("consent page is missing %q", expected)
+		}
+	}
+	if strings.Contains(page, "<script>") {
+		t.Error("consent page values were not escaped")
+	}
+}
+
+func TestWriteOAuthError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeOAuthError(w, auth.OAuthError{Code: "invalid_client"})
+	if w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("invalid clients should be challenged, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	writeOAuthError(w, auth.OAuthError{Code: "invalid_grant", Description: "nope"})
+	if w.Code != 400 {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"error":"invalid_grant"`) {
+		t.Errorf("unexpected error body %s", body)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("OAuth responses should not be cached")
+	}
+}
@@ -0,0 +1,36 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/aodin/volta/auth"
+)
+
+// OIDCHandlers serve sign ins with an external OpenID Connect provider
+type OIDCHandlers struct {
+	client *auth.OIDCClient
+}
+
+// Start redirects to the provider. The "next" GET parameter is where the
+// user is redirected after signing in.
+func (h OIDCHandlers) Start(w http.ResponseWriter, r *Request) error {
+	return h.client.Start(w, r.Request, r.Get("next"))
+}
+
+// Callback completes the sign in from the provider's redirect
+func (h OIDCHandlers) Callback(w http.ResponseWriter, r *Request) error {
+	return h.client.Callback(w, r.Request)
+}
+
+// Mount attaches the start handler to the given path and the callback
+// handler to the path plus "/callback", which should be the provider's
+// redirect URL.
+func (h OIDCHandlers) Mount(router *Router, path string) {
+	router.GET(path, h.Start)
+	router.GET(path+"/callback", h.Callback)
+}
+
+// NewOIDCHandlers creates handlers for the given OIDC client
+func NewOIDCHandlers(client *auth.OIDCClient) OIDCHandlers {
+	return OIDCHandlers{client: client}
+}
@@ -0,0 +1,23 @@
+package router
+
+import (
+	"net/http"
+)
+
+// RequirePerms wraps the given handler so it is only run for users with
+// all of the given permissions. Anonymous users receive a 401 response and
+// users without the permissions a 403 response. It can be combined with
+// APIAuth.Require, which must wrap it so the user is authenticated first.
+func RequirePerms(h Handler, perms ...string) Handler {
+	return func(w http.ResponseWriter, r *Request) error {
+		if !r.User.Exists() {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return nil
+		}
+		if !r.User.HasPerms(perms...) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return nil
+		}
+		return h(w, r)
+	}
+}
@@ -0,0 +1,40 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aodin/volta/auth"
+)
+
+func TestRequirePerms(t *testing.T) {
+	var ran bool
+	h := RequirePerms(func(w http.ResponseWriter, r *Request) error {
+		ran = true
+		return nil
+	}, "billing.refund")
+
+	for _, test := range []struct {
+		user auth.User
+		code int
+		ran  bool
+	}{
+		{auth.User{}, http.StatusUnauthorized, false},
+		{auth.User{ID: 1, IsActive: true}, http.StatusForbidden, false},
+		{auth.User{ID: 1, IsActive: true, IsSuperuser: true}, http.StatusOK, true},
+	} {
+		ran = false
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		if err := h(w, &Request{Request: req, User: test.user}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if w.Code != test.code || ran != test.ran {
+			t.Errorf(
+				"user %v: expected %d and ran %t, got %d and %t",
+				test.user, test.code, test.ran, w.Code, ran,
+			)
+		}
+	}
+}
@@ -12,6 +12,11 @@ type Request struct {
 	Params Params
 	User   auth.User
 	Values url.Values
+
+	// Token is true if the user was authenticated by an API token, and
+	// Scopes are the scopes granted to that token
+	Token  bool
+	Scopes auth.Scopes
 }
 
 // Get gets a GET parameter and ONLY a get parameter - never POST form data
@@ -60,6 +65,18 @@ func NewRequest(r *http.Request, auth *auth.Auth) (request *Request) {
 	request.User = auth.BySession(cookie.Value)
 
 	// Do not perform authentication by tokens here - tokens are only good
-	// for the API
+	// for the API and are opted into per route with APIAuth
 	return
 }
+
+// newRequest is NewRequest but may also renew the session cookie using
+// the given http.ResponseWriter if the auth has sliding expiration.
+func newRequest(w http.ResponseWriter, r *http.Request, auth *auth.Auth) *Request {
+	if auth == nil {
+		return NewRequest(r, nil)
+	}
+	return &Request{
+		Request: r,
+		User:    auth.BySessionCookie(w, r),
+	}
+}
@@ -0,0 +1,52 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aodin/config"
+	"github.com/aodin/volta/auth"
+)
+
+func TestRequestInMemory(t *testing.T) {
+	a := auth.NewInMemory(config.Default)
+	users, err := a.Seed(
+		auth.SeedUser{Email: "a@example.com", Permissions: []string{"billing.refund"}},
+		auth.SeedUser{Email: "b@example.com"},
+	)
+	if err != nil {
+		t.Fatalf("could not seed users: %s", err)
+	}
+
+	var user auth.User
+	router := New(a)
+	router.GET("/refund", RequirePerms(func(w http.ResponseWriter, r *Request) error {
+		user = r.User
+		return nil
+	}, "billing.refund"))
+
+	for i, code := range []int{http.StatusOK, http.StatusForbidden} {
+		cookie, err := a.SeedSession(users[i])
+		if err != nil {
+			t.Fatalf("could not seed a session: %s", err)
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/refund", nil)
+		req.AddCookie(cookie)
+		router.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("user %s: expected status %d, got %d", users[i].Email, code, w.Code)
+		}
+	}
+	if user.ID != users[0].ID {
+		t.Errorf("the request user should be set from the session")
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/refund", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous requests should be unauthorized, got %d", w.Code)
+	}
+}
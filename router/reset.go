@@ -0,0 +1,63 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aodin/volta/auth"
+)
+
+// PasswordResetHandlers serve the password reset flow of an
+// auth.PasswordReset. Successful requests redirect to Next if it is set,
+// otherwise they respond with 204 No Content.
+type PasswordResetHandlers struct {
+	reset *auth.PasswordReset
+	Next  string
+}
+
+func (h PasswordResetHandlers) done(w http.ResponseWriter, r *Request) {
+	if h.Next == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r.Request, h.Next, 302)
+}
+
+// Request emails a reset link to the POSTed email
+func (h PasswordResetHandlers) Request(w http.ResponseWriter, r *Request) error {
+	if err := h.reset.Request(r.FormValue("email")); err != nil {
+		return err
+	}
+	h.done(w, r)
+	return nil
+}
+
+// Confirm sets the POSTed password if the POSTed id and token are valid
+func (h PasswordResetHandlers) Confirm(w http.ResponseWriter, r *Request) error {
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if id == 0 {
+		return fmt.Errorf("router: an id is required to reset a password")
+	}
+	if r.FormValue("password") != r.FormValue("confirm") {
+		return fmt.Errorf("router: passwords do not match")
+	}
+	_, err := h.reset.Reset(id, r.FormValue("token"), r.FormValue("password"))
+	if err != nil {
+		return err
+	}
+	h.done(w, r)
+	return nil
+}
+
+// Mount attaches the handlers to the given router: the request handler at
+// the given path and the confirm handler at the path plus "/confirm".
+func (h PasswordResetHandlers) Mount(router *Router, path string) {
+	router.POST(path, h.Request)
+	router.POST(path+"/confirm", h.Confirm)
+}
+
+// NewPasswordResetHandlers creates handlers for the given password reset
+func NewPasswordResetHandlers(reset *auth.PasswordReset) PasswordResetHandlers {
+	return PasswordResetHandlers{reset: reset}
+}
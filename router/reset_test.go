@@ -0,0 +1,37 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPasswordResetHandlers(t *testing.T) {
+	router := newMockRouter()
+	NewPasswordResetHandlers(nil).Mount(router, "/reset")
+
+	if h, _, _ := router.Lookup(POST, "/reset"); h == nil {
+		t.Fatal("reset request handler was not mounted")
+	}
+	if h, _, _ := router.Lookup(POST, "/reset/confirm"); h == nil {
+		t.Fatal("reset confirm handler was not mounted")
+	}
+
+	// Invalid forms should error before a reset is attempted
+	for _, form := range []url.Values{
+		{"token": {"abc"}, "password": {"a"}, "confirm": {"a"}},
+		{"id": {"1"}, "token": {"abc"}, "password": {"a"}, "confirm": {"b"}},
+	} {
+		req, _ := http.NewRequest(
+			"POST", "/reset/confirm", strings.NewReader(form.Encode()),
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Errorf("expected status 400 for form %v, got %d", form, w.Code)
+		}
+	}
+}
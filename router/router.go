@@ -150,7 +150,7 @@ func (router *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	// Build a new request and attach a user - if there is no valid user
 	// the request.User will be an auth.AnonUser
-	request := NewRequest(req, router.auth)
+	request := newRequest(w, req, router.auth)
 
 	// Record if a handler ran, so if false, a 404 page can be served
 	var ranHandler bool
@@ -0,0 +1,52 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/aodin/volta/auth"
+)
+
+// EmailVerificationHandlers serve the verification links sent by an
+// auth.EmailVerification. Successful verifications redirect to Next if it
+// is set, otherwise they respond with 204 No Content.
+type EmailVerificationHandlers struct {
+	verification *auth.EmailVerification
+	Next         string
+}
+
+// Verify marks the user of the token in the GET parameters as verified
+func (h EmailVerificationHandlers) Verify(w http.ResponseWriter, r *Request) error {
+	if _, err := h.verification.Verify(r.Get("token")); err != nil {
+		return err
+	}
+	if h.Next == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	http.Redirect(w, r.Request, h.Next, 302)
+	return nil
+}
+
+// Resend emails a new verification link to the POSTed email, which is
+// usually the email of an auth.EmailNotVerified error, since unverified
+// users may not be able to log in. It responds with 204 No Content whether
+// or not a user has the email.
+func (h EmailVerificationHandlers) Resend(w http.ResponseWriter, r *Request) error {
+	if err := h.verification.Resend(r.FormValue("email")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Mount attaches the verify handler to the given path and the resend
+// handler to the path plus "/resend".
+func (h EmailVerificationHandlers) Mount(router *Router, path string) {
+	router.GET(path, h.Verify)
+	router.POST(path+"/resend", h.Resend)
+}
+
+// NewEmailVerificationHandlers creates handlers for the given verification
+func NewEmailVerificationHandlers(verification *auth.EmailVerification) EmailVerificationHandlers {
+	return EmailVerificationHandlers{verification: verification}
+}